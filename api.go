@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// clashAPIClient is shared by all requests to the clash api, so that connections
+// are reused across reloads instead of creating a new client each time.
+var clashAPIClient = sync.OnceValue(func() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   5 * time.Second,
+		KeepAlive: conf.APIKeepAlive,
+	}
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        4,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     conf.APIIdleTimeout,
+		},
+	}
+})
+
+// currentClashConf is the config of the running clash, it is updated after each reload
+var currentClashConf atomic.Pointer[ClashConf]
+
+func clashAPIAddr(cc *ClashConf) string {
+	if cc.ExternalController == "" {
+		return "127.0.0.1:9090"
+	}
+
+	// a wildcard bind address is dialed on loopback, so the api connection never leaves the
+	// host, clash listens dual-stack on [::] so ipv4 loopback works for both families
+	host, port, err := net.SplitHostPort(cc.ExternalController)
+	if err != nil {
+		return cc.ExternalController
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return cc.ExternalController
+}
+
+// isUnixController reports whether the clash api listens on a unix socket, tpclash only
+// talks to the clash api over tcp
+func isUnixController(cc *ClashConf) bool {
+	return strings.HasPrefix(cc.ExternalController, "unix://") || filepath.IsAbs(cc.ExternalController)
+}
+
+// clashAPIIPs returns the addresses(both families) of the clash api: the resolved addresses of
+// a host name, and the ipv4 and ipv6 loopback of a wildcard bind address since clash listens
+// dual-stack on it.
+func clashAPIIPs(cc *ClashConf) ([]net.IP, error) {
+	addr := clashAPIAddr(cc)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("[api] failed to parse clash api address(external-controller): %w", err)
+	}
+	// only an empty or wildcard address is dialed on another address than the configured one
+	if addr != cc.ExternalController {
+		return []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("[api] failed to resolve clash api address(external-controller): %w", err)
+	}
+	return ips, nil
+}
+
+// checkClashAPILocal makes sure that every address(both families) of the clash api is
+// local to the host: local addresses are resolved by the kernel local routing table
+// before the clash tun routes, so reloads can never be routed into the tun themselves.
+func checkClashAPILocal(cc *ClashConf) error {
+	ips, err := clashAPIIPs(cc)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("[api] failed to list local addresses: %w", err)
+	}
+	for _, ip := range ips {
+		if ip.IsLoopback() {
+			continue
+		}
+		local := false
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				local = true
+				break
+			}
+		}
+		if !local {
+			return fmt.Errorf("[api] clash api address %s is not local to this host, reloads may be routed through the clash tun", ip)
+		}
+	}
+	return nil
+}
+
+// clashAPIBypassRules are the rules that send the traffic to the clash api addresses through the
+// main routing table, ahead of the rules of the clash tun(auto-route) and --proxy-fwmark.
+func clashAPIBypassRules(cc *ClashConf) ([]IPRule, error) {
+	ips, err := clashAPIIPs(cc)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []IPRule
+	seen := map[string]bool{}
+	for _, ip := range ips {
+		if seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+
+		r := IPRule{Priority: apiBypassRulePriority, Table: unix.RT_TABLE_MAIN}
+		if ip4 := ip.To4(); ip4 != nil {
+			r.Family, r.Dst = unix.AF_INET, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		} else {
+			r.Family, r.Dst = unix.AF_INET6, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// EnableAPIBypass installs the rules of clashAPIBypassRules, so that the connections of tpclash
+// to the clash api are never redirected into the proxy
+func EnableAPIBypass(rules []IPRule) error {
+	for _, r := range rules {
+		logrus.Debugf("[api] bypassing the proxy for the clash api: ip rule %s", r)
+		if err := AddIPRule(r); err != nil {
+			return fmt.Errorf("[api] %w", err)
+		}
+	}
+	return nil
+}
+
+// DisableAPIBypass removes the rules of EnableAPIBypass
+func DisableAPIBypass(rules []IPRule) error {
+	var errs []error
+	for _, r := range rules {
+		if err := DelIPRule(r); err != nil {
+			errs = append(errs, fmt.Errorf("[api] %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// clashAPIRequest sends a request to the clash api, non-2xx responses are returned as errors.
+func clashAPIRequest(cc *ClashConf, method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, "http://"+clashAPIAddr(cc)+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+cc.Secret)
+
+	resp, err := clashAPIClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api response: %w", err)
+	}
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, string(bs))
+	}
+
+	return bs, nil
+}
+
+// loadInternalConfig reads the api related settings from the running internal config
+func loadInternalConfig() (*ClashConf, error) {
+	var bs []byte
+	if p := inMemoryConfig.Load(); conf.InMemory && p != nil {
+		bs = []byte(*p)
+	} else {
+		var err error
+		if bs, err = os.ReadFile(filepath.Join(conf.ClashHome, InternalConfigName)); err != nil {
+			return nil, fmt.Errorf("failed to read internal config: %w", err)
+		}
+	}
+
+	var cc ClashConf
+	if err := yaml.Unmarshal(bs, &cc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal internal config: %w", err)
+	}
+	return &cc, nil
+}
+
+// reloadClashConfig asks clash to reload the config from the given path, with --reload-body
+// inline the config is sent in the request(payload) instead, in in-memory mode the running
+// config is always sent inline.
+func reloadClashConfig(cc *ClashConf, path string) error {
+	var payload string
+	if p := inMemoryConfig.Load(); conf.InMemory && p != nil {
+		payload = *p
+	} else if conf.ReloadBody == "inline" {
+		bs, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read config for inline reload: %w", err)
+		}
+		payload = string(bs)
+	} else {
+		_, err := clashAPIRequest(cc, "PUT", "/configs", []byte(fmt.Sprintf(`{"path": "%s"}`, path)))
+		return err
+	}
+
+	body, err := json.Marshal(map[string]string{"payload": payload})
+	if err != nil {
+		return fmt.Errorf("failed to marshal reload payload: %w", err)
+	}
+	_, err = clashAPIRequest(cc, "PUT", "/configs", body)
+	return err
+}
+
+// ApplyGroupDefaults pins the select groups to their configured proxies(--group-default),
+// clash resets select groups to the first proxy when the config is reloaded.
+func ApplyGroupDefaults(cc *ClashConf) {
+	defaults, err := parseGroupDefaults()
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, d := range defaults {
+		body, _ := json.Marshal(map[string]string{"name": d.Proxy})
+		if _, err = clashAPIRequest(cc, "PUT", "/proxies/"+url.PathEscape(d.Group), body); err != nil {
+			logrus.Errorf("[config] failed to set group %s to %s: %v", d.Group, d.Proxy, err)
+			continue
+		}
+		logrus.Infof("[config] group %s pinned to %s(--group-default)", d.Group, d.Proxy)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestClashAPIClientReused(t *testing.T) {
+	var conns, requests atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	if clashAPIClient() != clashAPIClient() {
+		t.Fatal("expected the same clash api client for every call")
+	}
+
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.InMemory, conf.ReloadBody = false, "path"
+
+	cc := &ClashConf{ExternalController: strings.TrimPrefix(srv.URL, "http://"), Secret: "secret"}
+	const reloads = 5
+	for i := 0; i < reloads; i++ {
+		if err := reloadClashConfig(cc, "/etc/clash/xclash.yaml"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := requests.Load(); n != reloads {
+		t.Fatalf("expected %d requests, got %d", reloads, n)
+	}
+	// the keep-alive connection of the shared client is reused by all reloads
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("expected 1 connection to the clash api, got %d", n)
+	}
+
+	cc.Secret = "wrong"
+	if err := reloadClashConfig(cc, "/etc/clash/xclash.yaml"); err == nil || !strings.Contains(err.Error(), "status 401") {
+		t.Fatalf("expected the non-2xx status as an error, got %v", err)
+	}
+}
+
+func TestCheckClashAPILocal(t *testing.T) {
+	tests := []struct {
+		controller string
+		addr       string
+		wantErr    bool
+	}{
+		{controller: "", addr: "127.0.0.1:9090"},
+		{controller: "127.0.0.1:9090", addr: "127.0.0.1:9090"},
+		{controller: "127.0.0.2:9090", addr: "127.0.0.2:9090"},
+		{controller: "[::1]:9090", addr: "[::1]:9090"},
+		{controller: "localhost:9090", addr: "localhost:9090"},
+		{controller: "0.0.0.0:9090", addr: "127.0.0.1:9090"},
+		{controller: "[::]:9090", addr: "127.0.0.1:9090"},
+		{controller: ":9090", addr: "127.0.0.1:9090"},
+		// unix sockets are rejected by CheckConfig
+		{controller: "/run/clash/clash.sock", wantErr: true},
+		{controller: "unix:///run/clash/clash.sock", wantErr: true},
+		// TEST-NET-1, never assigned to a local interface
+		{controller: "192.0.2.1:9090", addr: "192.0.2.1:9090", wantErr: true},
+		{controller: "clash-api", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.controller, func(t *testing.T) {
+			cc := &ClashConf{ExternalController: tt.controller}
+			if tt.addr != "" {
+				if addr := clashAPIAddr(cc); addr != tt.addr {
+					t.Errorf("expected the clash api to be dialed on %s, got %s", tt.addr, addr)
+				}
+			}
+			err := checkClashAPILocal(cc)
+			if tt.wantErr && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestClashAPIBypassRules(t *testing.T) {
+	tests := []struct {
+		controller string
+		dsts       []string
+		wantErr    bool
+	}{
+		{controller: "", dsts: []string{"127.0.0.1/32", "::1/128"}},
+		{controller: "0.0.0.0:9090", dsts: []string{"127.0.0.1/32", "::1/128"}},
+		{controller: "[::]:9090", dsts: []string{"127.0.0.1/32", "::1/128"}},
+		{controller: "127.0.0.1:9090", dsts: []string{"127.0.0.1/32"}},
+		{controller: "[::1]:9090", dsts: []string{"::1/128"}},
+		{controller: "192.168.1.2:9090", dsts: []string{"192.168.1.2/32"}},
+		{controller: "[fd00::2]:9090", dsts: []string{"fd00::2/128"}},
+		{controller: "/run/clash/clash.sock", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.controller, func(t *testing.T) {
+			rules, err := clashAPIBypassRules(&ClashConf{ExternalController: tt.controller})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var dsts []string
+			for _, r := range rules {
+				if r.Priority != apiBypassRulePriority || r.Table != unix.RT_TABLE_MAIN {
+					t.Errorf("unexpected bypass rule %s", r)
+				}
+				if (r.Family == unix.AF_INET) != (r.Dst.IP.To4() != nil) {
+					t.Errorf("family %d does not match %s", r.Family, r.Dst)
+				}
+				dsts = append(dsts, r.Dst.String())
+			}
+			if strings.Join(dsts, ",") != strings.Join(tt.dsts, ",") {
+				t.Fatalf("expected the bypass set %v, got %v", tt.dsts, dsts)
+			}
+		})
+	}
+
+	// a host name is bypassed with every resolved address, without duplicates
+	rules, err := clashAPIBypassRules(&ClashConf{ExternalController: "localhost:9090"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, r := range rules {
+		if !r.Dst.IP.IsLoopback() || seen[r.Dst.String()] {
+			t.Fatalf("unexpected bypass set for localhost: %v", rules)
+		}
+		seen[r.Dst.String()] = true
+	}
+	if !seen["127.0.0.1/32"] {
+		t.Fatalf("expected localhost to be bypassed on 127.0.0.1, got %v", rules)
+	}
+}
+
+func TestCheckConfigUnixController(t *testing.T) {
+	for _, controller := range []string{"/run/clash/clash.sock", "unix:///run/clash/clash.sock"} {
+		_, err := CheckConfig(validateTestConfig + "external-controller: " + controller + "\n")
+		if err == nil || !strings.Contains(err.Error(), "external-controller") {
+			t.Errorf("expected %s to be rejected, got %v", controller, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// StartAPIProxy exposes the clash api through an authenticated reverse proxy, clients
+// authenticate with basic auth or a bearer token(also accepted as the `token` query for
+// websocket), and the clash secret is injected upstream.
+func StartAPIProxy(ctx context.Context) error {
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			cc := currentClashConf.Load()
+			r.SetURL(&url.URL{Scheme: "http", Host: clashAPIAddr(cc)})
+			r.SetXForwarded()
+
+			q := r.Out.URL.Query()
+			q.Del("token")
+			r.Out.URL.RawQuery = q.Encode()
+			r.Out.Header.Set("Authorization", "Bearer "+cc.Secret)
+		},
+	}
+
+	srv := &http.Server{
+		Addr:              conf.APIProxyAddr,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !apiProxyAuthorized(r) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="tpclash"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			rp.ServeHTTP(w, r)
+		}),
+	}
+
+	ln, err := net.Listen("tcp", conf.APIProxyAddr)
+	if err != nil {
+		return fmt.Errorf("[apiproxy] failed to listen %s: %w", conf.APIProxyAddr, err)
+	}
+
+	go func() {
+		logrus.Infof("[apiproxy] clash api reverse proxy listening on %s", conf.APIProxyAddr)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("[apiproxy] reverse proxy stopped: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	return nil
+}
+
+func apiProxyAuthorized(r *http.Request) bool {
+	if conf.APIProxyToken != "" {
+		token := r.URL.Query().Get("token")
+		if auth := r.Header.Get("Authorization"); len(auth) > 7 && auth[:7] == "Bearer " {
+			token = auth[7:]
+		}
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(conf.APIProxyToken)) == 1 {
+			return true
+		}
+	}
+
+	if conf.APIProxyUser != "" {
+		user, password, ok := r.BasicAuth()
+		if ok && subtle.ConstantTimeCompare([]byte(user), []byte(conf.APIProxyUser)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(conf.APIProxyPassword)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
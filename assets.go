@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// geoAssets are the geo databases clash resolves relative to its home dir(-d)
+var geoAssets = []string{"Country.mmdb", "geoip.metadb", "geoip.dat", "geosite.dat", "GeoIP.dat", "GeoSite.dat", "ASN.mmdb"}
+
+// clashAssetDir returns the dir passed to clash as -d, clash resolves all relative
+// assets(geo databases, providers, cache.db) against it rather than the config path.
+func clashAssetDir() string {
+	if conf.ClashAssetDir != "" {
+		return conf.ClashAssetDir
+	}
+	return conf.ClashHome
+}
+
+// PrepareAssetDir makes sure that the geo databases extracted to the clash home are
+// also available in the asset dir(--clash-asset-dir).
+func PrepareAssetDir() error {
+	dir := clashAssetDir()
+	if dir == conf.ClashHome {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("[assets] failed to create asset dir: %w", err)
+	}
+	for _, name := range geoAssets {
+		src, dst := filepath.Join(conf.ClashHome, name), filepath.Join(dir, name)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		logrus.Infof("[assets] copy %s -> %s", src, dst)
+		if err := copyFileMode(src, dst, 0644); err != nil {
+			return fmt.Errorf("[assets] failed to copy %s to asset dir: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// PrepareCacheFile links cache.db in the asset dir to --cache-file, clash always opens
+// cache.db relative to its -d dir, so the link is how the cache location is pinned. An
+// existing cache.db is moved to the cache file unless that already exists.
+func PrepareCacheFile() error {
+	if conf.CacheFile == "" {
+		return nil
+	}
+
+	link := filepath.Join(clashAssetDir(), clashCacheName)
+	if target, err := os.Readlink(link); err == nil && target == conf.CacheFile {
+		return nil
+	}
+
+	if fi, err := os.Lstat(link); err == nil {
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			if err = os.Remove(link); err != nil {
+				return fmt.Errorf("[assets] failed to remove the previous cache link: %w", err)
+			}
+		case fileExists(conf.CacheFile):
+			logrus.Warnf("[assets] both %s and %s exist, keep the cache file and move the other one to %s.old", link, conf.CacheFile, link)
+			if err = os.Rename(link, link+".old"); err != nil {
+				return fmt.Errorf("[assets] failed to move %s: %w", link, err)
+			}
+		default:
+			logrus.Infof("[assets] move %s -> %s", link, conf.CacheFile)
+			if err = copyFileMode(link, conf.CacheFile, 0644); err != nil {
+				return fmt.Errorf("[assets] failed to move cache to %s: %w", conf.CacheFile, err)
+			}
+			if err = os.Remove(link); err != nil {
+				return fmt.Errorf("[assets] failed to remove %s: %w", link, err)
+			}
+		}
+	}
+
+	logrus.Infof("[assets] clash cache: %s -> %s", link, conf.CacheFile)
+	if err := os.Symlink(conf.CacheFile, link); err != nil {
+		return fmt.Errorf("[assets] failed to link clash cache file: %w", err)
+	}
+	return nil
+}
+
+// checkCacheFile validates --cache-file, it must be a file path in an existing writable dir
+// outside the pseudo filesystems.
+func checkCacheFile(path string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("[config] cache file must be an absolute path: %s", path)
+	}
+	for _, dir := range []string{"/proc", "/sys", "/dev"} {
+		if path == dir || (strings.HasPrefix(path, dir+"/") && !strings.HasPrefix(path, "/dev/shm/")) {
+			return fmt.Errorf("[config] cache file can not be placed in %s: %s", dir, path)
+		}
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		return fmt.Errorf("[config] cache file is a directory: %s", path)
+	}
+	if err := unix.Access(filepath.Dir(path), unix.W_OK); err != nil {
+		return fmt.Errorf("[config] cache file dir %s is not writable: %w", filepath.Dir(path), err)
+	}
+	if filepath.Clean(path) == filepath.Join(clashAssetDir(), clashCacheName) {
+		return fmt.Errorf("[config] cache file is the default clash cache location, --cache-file is not needed: %s", path)
+	}
+	return nil
+}
+
+// CheckAssets returns the assets referenced by the config that are missing in the asset
+// dir, clash fails to start(or tries to download them) in that case.
+func CheckAssets(c string) []string {
+	var ac struct {
+		ProxyProviders map[string]struct {
+			Type string `yaml:"type"`
+			Path string `yaml:"path"`
+		} `yaml:"proxy-providers"`
+		RuleProviders map[string]struct {
+			Type string `yaml:"type"`
+			Path string `yaml:"path"`
+		} `yaml:"rule-providers"`
+		Rules       []string `yaml:"rules"`
+		GeodataMode bool     `yaml:"geodata-mode"`
+		GeoxURL     struct {
+			GeoIP   string `yaml:"geoip"`
+			GeoSite string `yaml:"geosite"`
+			MMDB    string `yaml:"mmdb"`
+		} `yaml:"geox-url"`
+	}
+	if err := yaml.Unmarshal([]byte(c), &ac); err != nil {
+		logrus.Debugf("[assets] skip asset check: %v", err)
+		return nil
+	}
+
+	dir := clashAssetDir()
+	resolve := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+
+	var missing []string
+	check := func(kind, name, typ, path string) {
+		// http providers are downloaded by clash
+		if typ != "file" || path == "" {
+			return
+		}
+		if _, err := os.Stat(resolve(path)); err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s: %s", kind, name, resolve(path)))
+		}
+	}
+	for name, p := range ac.ProxyProviders {
+		check("proxy-provider", name, p.Type, p.Path)
+	}
+	for name, p := range ac.RuleProviders {
+		check("rule-provider", name, p.Type, p.Path)
+	}
+
+	// meta loads geoip.dat instead of Country.mmdb in geodata mode, geosite.dat is always required by GEOSITE rules
+	geoip, geoipURL := "Country.mmdb", ac.GeoxURL.MMDB
+	if ac.GeodataMode {
+		geoip, geoipURL = "geoip.dat", ac.GeoxURL.GeoIP
+		logrus.Infof("[assets] clash geodata mode: dat(%s/geosite.dat)", geoip)
+	} else {
+		logrus.Infof("[assets] clash geodata mode: mmdb(%s)", geoip)
+	}
+
+	var needGeoIP, needGeoSite bool
+	for _, r := range ac.Rules {
+		r = strings.ToUpper(strings.TrimSpace(r))
+		needGeoIP = needGeoIP || strings.HasPrefix(r, "GEOIP,")
+		needGeoSite = needGeoSite || strings.HasPrefix(r, "GEOSITE,")
+	}
+
+	checkGeo := func(rule, name, url string) {
+		path := filepath.Join(dir, name)
+		if fileExists(path) {
+			return
+		}
+		// clash downloads the database from geox-url
+		if url != "" {
+			logrus.Debugf("[assets] %s is missing, clash will download it from %s", path, url)
+			return
+		}
+		msg := fmt.Sprintf("geo database(%s rules): %s", rule, path)
+		if ac.GeodataMode && name == "geoip.dat" && fileExists(filepath.Join(dir, "Country.mmdb")) {
+			msg += ", Country.mmdb is present but not used in geodata-mode"
+		}
+		if !ac.GeodataMode && name == "Country.mmdb" && fileExists(filepath.Join(dir, "geoip.dat")) {
+			msg += ", geoip.dat is present but only used in geodata-mode"
+		}
+		missing = append(missing, msg)
+	}
+	if needGeoIP {
+		checkGeo("GEOIP", geoip, geoipURL)
+	}
+	if needGeoSite {
+		checkGeo("GEOSITE", "geosite.dat", ac.GeoxURL.GeoSite)
+	}
+
+	return missing
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
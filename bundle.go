@@ -0,0 +1,383 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	bundleManifestName  = "manifest.json"
+	bundleSignatureName = "manifest.json.minisig"
+)
+
+// BundleManifest describes the files of a config bundle(--config-bundle), it is signed by
+// manifest.json.minisig. Files maps each file of the bundle to its sha256, config names
+// the clash config among them, all other files are assets extracted to the asset dir.
+// Created orders the bundles, a bundle older than the cached one is rejected so that an
+// old signed bundle can not be replayed.
+type BundleManifest struct {
+	Version int               `json:"version"`
+	Created time.Time         `json:"created"`
+	Config  string            `json:"config"`
+	Files   map[string]string `json:"files"`
+}
+
+// configBundle is a verified bundle
+type configBundle struct {
+	manifest BundleManifest
+	files    map[string][]byte
+}
+
+// isRemoteBundle reports whether the bundle is fetched over http(s) rather than read from a local file
+func isRemoteBundle() bool {
+	return strings.HasPrefix(conf.ConfigBundle, "http://") || strings.HasPrefix(conf.ConfigBundle, "https://")
+}
+
+// loadConfigBundle fetches and verifies the bundle, stages its assets(see bundleStage) and returns
+// its config. A bundle that can not be fetched, fails the verification or is older than the cached
+// bundle is rejected, the last applied bundle(cached in the clash home) is used instead.
+func loadConfigBundle() (string, error) {
+	pk, err := loadMinisignPublicKey(conf.VerifyKey)
+	if err != nil {
+		return "", err
+	}
+
+	var cached *configBundle
+	cachedBs, cerr := os.ReadFile(filepath.Join(conf.ClashHome, InternalBundleCacheName))
+	if cerr == nil {
+		if cached, cerr = parseConfigBundle(cachedBs, pk); cerr != nil {
+			logrus.Warnf("[bundle] cached config bundle rejected: %v", cerr)
+		}
+	}
+
+	bs, err := fetchConfigBundle()
+	if err == nil {
+		var b *configBundle
+		if b, err = parseConfigBundle(bs, pk); err == nil {
+			if cached != nil && b.manifest.Created.Before(cached.manifest.Created) {
+				err = fmt.Errorf("[bundle] config bundle created at %s is older than the cached one(%s)",
+					b.manifest.Created.Format(time.RFC3339), cached.manifest.Created.Format(time.RFC3339))
+			} else {
+				return stageConfigBundle(b, bs)
+			}
+		}
+	}
+
+	if cached == nil {
+		return "", err
+	}
+	logrus.Warnf("%v, falling back to the cached config bundle...", err)
+	return stageConfigBundle(cached, nil)
+}
+
+func fetchConfigBundle() ([]byte, error) {
+	if !isRemoteBundle() {
+		bs, err := os.ReadFile(conf.ConfigBundle)
+		if err != nil {
+			return nil, fmt.Errorf("[bundle] failed to read config bundle: %w", err)
+		}
+		return bs, nil
+	}
+
+	req, err := newRemoteConfigRequest(conf.ConfigBundle)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := newFetchClient().Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("[bundle] failed to download config bundle: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("[bundle] failed to get config bundle: status code %d", resp.StatusCode)
+	}
+	bs, err := io.ReadAll(io.LimitReader(resp.Body, bundleMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("[bundle] failed to download config bundle: %w", err)
+	}
+	if len(bs) > bundleMaxSize {
+		return nil, fmt.Errorf("[bundle] config bundle exceeds %d MiB", bundleMaxSize>>20)
+	}
+	return bs, nil
+}
+
+// parseConfigBundle reads the tar(optionally gzipped) bundle, the manifest must be signed by
+// the key and match the files of the bundle exactly
+func parseConfigBundle(bs []byte, pk *minisignPublicKey) (*configBundle, error) {
+	var r io.Reader = bytes.NewReader(bs)
+	if len(bs) > 2 && bs[0] == 0x1f && bs[1] == 0x8b {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("[bundle] invalid gzip bundle: %w", err)
+		}
+		r = io.LimitReader(gr, bundleMaxSize)
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[bundle] invalid tar bundle: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("[bundle] %s is not a regular file", hdr.Name)
+		}
+		name, err := bundlePath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := files[name]; ok {
+			return nil, fmt.Errorf("[bundle] duplicate file %s", name)
+		}
+		if files[name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("[bundle] failed to read %s: %w", name, err)
+		}
+	}
+
+	manifest, sig := files[bundleManifestName], files[bundleSignatureName]
+	if manifest == nil || sig == nil {
+		return nil, fmt.Errorf("[bundle] %s or %s is missing", bundleManifestName, bundleSignatureName)
+	}
+	if err := pk.Verify(manifest, sig); err != nil {
+		return nil, fmt.Errorf("[bundle] manifest rejected: %w", err)
+	}
+	delete(files, bundleManifestName)
+	delete(files, bundleSignatureName)
+
+	b := &configBundle{files: files}
+	if err := json.Unmarshal(manifest, &b.manifest); err != nil {
+		return nil, fmt.Errorf("[bundle] invalid manifest: %w", err)
+	}
+	if b.manifest.Version != 1 {
+		return nil, fmt.Errorf("[bundle] unsupported manifest version: %d", b.manifest.Version)
+	}
+	if b.manifest.Created.IsZero() {
+		return nil, errors.New("[bundle] manifest creation time(created) is missing")
+	}
+	if _, ok := b.manifest.Files[b.manifest.Config]; !ok {
+		return nil, fmt.Errorf("[bundle] config %q is not listed in the manifest", b.manifest.Config)
+	}
+	for name, sum := range b.manifest.Files {
+		if name != b.manifest.Config && bundleReservedName(name) {
+			return nil, fmt.Errorf("[bundle] %s would overwrite a file of tpclash or clash", name)
+		}
+		data, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("[bundle] %s is listed in the manifest but missing", name)
+		}
+		actual := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(actual[:]), sum) {
+			return nil, fmt.Errorf("[bundle] sha256 of %s does not match the manifest", name)
+		}
+	}
+	for name := range files {
+		if _, ok := b.manifest.Files[name]; !ok {
+			return nil, fmt.Errorf("[bundle] %s is not listed in the manifest", name)
+		}
+	}
+	return b, nil
+}
+
+// bundlePath cleans the path of a bundle entry, it must stay inside the bundle
+func bundlePath(name string) (string, error) {
+	p := path.Clean(strings.TrimPrefix(name, "./"))
+	if p == "." || path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("[bundle] invalid file path %q", name)
+	}
+	return p, nil
+}
+
+// bundleReservedName reports whether the asset would replace a file managed by tpclash or
+// clash in the asset dir(the clash home by default), hidden files are reserved for markers
+// and temp files.
+func bundleReservedName(name string) bool {
+	top := strings.SplitN(name, "/", 2)[0]
+	switch top {
+	case InternalClashBinName, InternalConfigName, InternalRemoteCacheName, InternalBundleCacheName,
+		clashCacheName, stateManifestName, diagnosticsDirName, "yacd", "official":
+		return true
+	}
+	return strings.HasPrefix(top, ".") || strings.HasSuffix(top, ".pid")
+}
+
+// bundleStage holds the changed assets of a verified bundle in a staging dir until its config has
+// passed all checks of the reload(or the startup), they are moved into the asset dir right before
+// clash loads the config. A config that is rejected, held by freeze or only dry-run discards them.
+type bundleStage struct {
+	dir   string
+	files []string
+	// raw is the bundle, it is cached once it is applied
+	raw []byte
+}
+
+// pendingBundle is the stage of the latest fetched bundle, every config update carries the latest
+// state of all sources, so it belongs to the next update that is applied.
+var pendingBundle atomic.Pointer[bundleStage]
+
+var cleanBundleStagesOnce sync.Once
+
+// bundleStageBase returns the dir the staging dirs are created in, the asset dir(so that the assets
+// are moved by a rename) or tmpfs in in-memory mode
+func bundleStageBase() string {
+	if conf.InMemory {
+		return inMemoryConfigDir()
+	}
+	return clashAssetDir()
+}
+
+// stageConfigBundle decrypts the config of the verified bundle and stages its assets, unchanged
+// assets are not staged. The stage replaces the pending stage of an earlier bundle.
+func stageConfigBundle(b *configBundle, raw []byte) (string, error) {
+	c := b.files[b.manifest.Config]
+	if conf.ConfigEncPassword != "" {
+		plaintext, err := Decrypt(c, conf.ConfigEncPassword)
+		if err != nil {
+			return "", err
+		}
+		c = plaintext
+	}
+
+	base := bundleStageBase()
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", fmt.Errorf("[bundle] failed to create staging dir: %w", err)
+	}
+	// staging dirs of a run that exited before applying them
+	cleanBundleStagesOnce.Do(func() {
+		dirs, _ := filepath.Glob(filepath.Join(base, bundleStagePrefix+"*"))
+		for _, d := range dirs {
+			_ = os.RemoveAll(d)
+		}
+	})
+
+	stage := &bundleStage{raw: raw}
+	for name, data := range b.files {
+		if name == b.manifest.Config {
+			continue
+		}
+		if old, err := os.ReadFile(filepath.Join(clashAssetDir(), filepath.FromSlash(name))); err == nil && bytes.Equal(old, data) {
+			continue
+		}
+		if stage.dir == "" {
+			dir, err := os.MkdirTemp(base, bundleStagePrefix)
+			if err != nil {
+				return "", fmt.Errorf("[bundle] failed to create staging dir: %w", err)
+			}
+			stage.dir = dir
+		}
+		tmp := filepath.Join(stage.dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(tmp), 0755)
+		if err == nil {
+			err = WriteFileAtomic(tmp, data, 0644)
+		}
+		if err != nil {
+			stage.discard()
+			return "", fmt.Errorf("[bundle] failed to stage %s: %w", name, err)
+		}
+		stage.files = append(stage.files, name)
+	}
+	sort.Strings(stage.files)
+
+	if old := pendingBundle.Swap(stage); old != nil {
+		old.discard()
+	}
+	if len(stage.files) > 0 {
+		logrus.Infof("[bundle] %d changed assets staged, they are applied with the config", len(stage.files))
+	}
+	return string(c), nil
+}
+
+// takeBundleStage removes the pending stage, the caller commits or discards it
+func takeBundleStage() *bundleStage {
+	return pendingBundle.Swap(nil)
+}
+
+// bundleAssetsPending reports whether changed assets are staged, so that a bundle which only
+// changed its assets is applied as well
+func bundleAssetsPending() bool {
+	s := pendingBundle.Load()
+	return s != nil && len(s.files) > 0
+}
+
+// commit moves the staged assets into the asset dir and caches the bundle, the stage is discarded
+// afterwards. It is nil safe.
+func (s *bundleStage) commit() error {
+	if s == nil {
+		return nil
+	}
+	defer s.discard()
+
+	dir := clashAssetDir()
+	for _, name := range s.files {
+		src, dst := filepath.Join(s.dir, filepath.FromSlash(name)), filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("[bundle] failed to create asset dir: %w", err)
+		}
+		if err := os.Rename(src, dst); err != nil {
+			// the staging dir is on tmpfs in in-memory mode
+			bs, err := os.ReadFile(src)
+			if err == nil {
+				err = WriteFileAtomic(dst, bs, 0644)
+			}
+			if err != nil {
+				return fmt.Errorf("[bundle] failed to extract %s: %w", name, err)
+			}
+		}
+		logrus.Infof("[bundle] asset %s extracted to %s", name, dst)
+	}
+	if s.raw != nil && !conf.InMemory {
+		if err := WriteFileAtomic(filepath.Join(conf.ClashHome, InternalBundleCacheName), s.raw, 0600); err != nil {
+			logrus.Warnf("[bundle] failed to cache config bundle: %v", err)
+		}
+	}
+	return nil
+}
+
+// discard removes the staged assets, it is nil safe
+func (s *bundleStage) discard() {
+	if s != nil && s.dir != "" {
+		_ = os.RemoveAll(s.dir)
+	}
+}
+
+// checkConfigBundle validates the bundle related flags
+func checkConfigBundle() error {
+	if conf.ConfigBundle == "" {
+		return nil
+	}
+	if conf.VerifyKey == "" {
+		return errors.New("[config] --config-bundle requires the minisign public key of the bundle(--verify-key)")
+	}
+	if _, err := loadMinisignPublicKey(conf.VerifyKey); err != nil {
+		return err
+	}
+	if strings.Contains(conf.ConfigBundle, "://") && !isRemoteBundle() {
+		return fmt.Errorf("[config] config bundle must be a http(s) url or a local file: %s", conf.ConfigBundle)
+	}
+	return nil
+}
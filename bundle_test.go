@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testBundleConfig = `mixed-port: 7890
+interface-name: eth0
+dns:
+  enable: true
+  listen: 0.0.0.0:1053
+  enhanced-mode: fake-ip
+  fake-ip-range: 198.18.0.1/16
+tun:
+  enable: true
+  auto-route: true
+`
+
+// testBundleKey returns a minisign key pair in the legacy(Ed) format
+func testBundleKey(t *testing.T) (string, ed25519.PrivateKey) {
+	pub, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte("Ed12345678"), pub...)
+	return base64.StdEncoding.EncodeToString(raw), sk
+}
+
+func testBundle(t *testing.T, sk ed25519.PrivateKey, created time.Time, files map[string]string) []byte {
+	m := BundleManifest{Version: 1, Created: created, Config: "config.yaml", Files: map[string]string{}}
+	for name, data := range files {
+		sum := sha256.Sum256([]byte(data))
+		m.Files[name] = hex.EncodeToString(sum[:])
+	}
+	manifest, _ := json.Marshal(&m)
+
+	sig := ed25519.Sign(sk, manifest)
+	global := ed25519.Sign(sk, append(append([]byte{}, sig...), "test"...))
+	minisig := "untrusted comment: test\n" + base64.StdEncoding.EncodeToString(append([]byte("Ed12345678"), sig...)) +
+		"\ntrusted comment: test\n" + base64.StdEncoding.EncodeToString(global) + "\n"
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	add := func(name, data string) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = tw.Write([]byte(data))
+	}
+	add(bundleManifestName, string(manifest))
+	add(bundleSignatureName, minisig)
+	for name, data := range files {
+		add("./"+name, data)
+	}
+	_ = tw.Close()
+	return buf.Bytes()
+}
+
+func setupBundleTest(t *testing.T) (string, ed25519.PrivateKey) {
+	key, sk := testBundleKey(t)
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.ClashHome, conf.ClashAssetDir = t.TempDir(), ""
+	conf.VerifyKey, conf.NoValidateCache = key, true
+	conf.ConfigBundle = filepath.Join(t.TempDir(), "clash.bundle.tar")
+	return conf.ConfigBundle, sk
+}
+
+func TestLoadConfigBundle(t *testing.T) {
+	path, sk := setupBundleTest(t)
+	t.Cleanup(func() { takeBundleStage().discard() })
+	now := time.Now().UTC().Truncate(time.Second)
+	asset := filepath.Join(conf.ClashHome, "providers", "proxy.yaml")
+
+	files := map[string]string{"config.yaml": testBundleConfig, "providers/proxy.yaml": "proxies: []\n"}
+	if err := os.WriteFile(path, testBundle(t, sk, now, files), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfigBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != testBundleConfig {
+		t.Fatalf("unexpected config: %q", c)
+	}
+	// the assets are only staged until the config is applied
+	if _, err = os.Stat(asset); err == nil {
+		t.Fatal("asset extracted before the config is applied")
+	}
+	if !bundleAssetsPending() {
+		t.Fatal("expected the changed assets to be staged")
+	}
+	if err = takeBundleStage().commit(); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := os.ReadFile(asset); err != nil || string(bs) != "proxies: []\n" {
+		t.Fatalf("asset not extracted: %q %v", bs, err)
+	}
+	if _, err = os.Stat(filepath.Join(conf.ClashHome, InternalBundleCacheName)); err != nil {
+		t.Fatalf("applied bundle is not cached: %v", err)
+	}
+
+	// rejected bundles fall back to the cached one, whose assets are already in place
+	rejected := map[string][]byte{
+		"older":    testBundle(t, sk, now.Add(-time.Hour), map[string]string{"config.yaml": testBundleConfig, "old.yaml": "old"}),
+		"reserved": testBundle(t, sk, now.Add(time.Hour), map[string]string{"config.yaml": testBundleConfig, InternalClashBinName: "binary"}),
+	}
+	for name, bs := range rejected {
+		if err = os.WriteFile(path, bs, 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err = loadConfigBundle()
+		if err != nil || c != testBundleConfig {
+			t.Fatalf("%s: expected the cached config, got %q %v", name, c, err)
+		}
+		if bundleAssetsPending() {
+			t.Fatalf("%s: unexpected staged assets", name)
+		}
+	}
+
+	// a config rejected by the reload(or held, or only dry-run) discards its staged assets
+	newer := testBundle(t, sk, now.Add(time.Hour), map[string]string{"config.yaml": "mixed-port: 7890\n", "new.yaml": "new"})
+	if err = os.WriteFile(path, newer, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = loadConfigBundle(); err != nil || c != "mixed-port: 7890\n" {
+		t.Fatalf("unexpected config: %q %v", c, err)
+	}
+	takeBundleStage().discard()
+
+	for _, name := range []string{"old.yaml", "new.yaml", InternalClashBinName} {
+		if _, err = os.Stat(filepath.Join(conf.ClashHome, name)); err == nil {
+			t.Fatalf("asset %s of a rejected bundle was extracted", name)
+		}
+	}
+	entries, _ := os.ReadDir(conf.ClashHome)
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != "providers" {
+			t.Fatalf("staging dir %s left behind", e.Name())
+		}
+	}
+}
+
+func TestBundleStageReplaced(t *testing.T) {
+	path, sk := setupBundleTest(t)
+	t.Cleanup(func() { takeBundleStage().discard() })
+	now := time.Now().UTC().Truncate(time.Second)
+
+	// a newer bundle fetched while the first one is held(e.g. frozen) replaces its stage
+	for i, data := range []string{"v1", "v2"} {
+		bs := testBundle(t, sk, now.Add(time.Duration(i)*time.Minute), map[string]string{"config.yaml": testBundleConfig, "rules.yaml": data})
+		if err := os.WriteFile(path, bs, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfigBundle(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stages, _ := filepath.Glob(filepath.Join(conf.ClashHome, bundleStagePrefix+"*"))
+	if len(stages) != 1 {
+		t.Fatalf("expected a single staging dir, got %v", stages)
+	}
+	if err := takeBundleStage().commit(); err != nil {
+		t.Fatal(err)
+	}
+	if bs, err := os.ReadFile(filepath.Join(conf.ClashHome, "rules.yaml")); err != nil || string(bs) != "v2" {
+		t.Fatalf("expected the assets of the latest bundle, got %q %v", bs, err)
+	}
+	if stages, _ = filepath.Glob(filepath.Join(conf.ClashHome, bundleStagePrefix+"*")); len(stages) != 0 {
+		t.Fatalf("staging dir left behind: %v", stages)
+	}
+}
+
+func TestBundleReservedName(t *testing.T) {
+	for name, reserved := range map[string]bool{
+		InternalClashBinName:   true,
+		InternalConfigName:     true,
+		clashCacheName:         true,
+		frozenMarkerName:       true,
+		"tpclash.pid":          true,
+		"yacd/index.html":      true,
+		"Country.mmdb":         false,
+		"providers/proxy.yaml": false,
+	} {
+		if bundleReservedName(name) != reserved {
+			t.Errorf("bundleReservedName(%q) = %v, want %v", name, !reserved, reserved)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// canonicalizeConfig sorts the proxies and proxy-groups by name and the rules by their text
+// (--canonical-output), so that the internal config is reproducible across fetches from
+// providers with a non-deterministic order. The members of a group keep their order, it is
+// significant for select/fallback groups. The rules are only reordered if no two rules that
+// change their relative order can match the same traffic with different targets, the terminal
+// MATCH rule always stays last.
+func canonicalizeConfig(rootNode *yaml.Node) {
+	if len(rootNode.Content) == 0 {
+		return
+	}
+	doc := rootNode.Content[0]
+
+	for _, key := range []string{"proxies", "proxy-groups"} {
+		list := yamlMapValue(doc, key)
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		name := func(n *yaml.Node) string {
+			if v := yamlMapValue(n, "name"); v != nil {
+				return v.Value
+			}
+			return ""
+		}
+		sort.SliceStable(list.Content, func(i, j int) bool { return name(list.Content[i]) < name(list.Content[j]) })
+	}
+
+	rules := yamlMapValue(doc, "rules")
+	if rules == nil || rules.Kind != yaml.SequenceNode {
+		return
+	}
+	sorted, err := sortRules(rules.Content)
+	if err != nil {
+		logrus.Warnf("[canonical] rules are kept in their original order: %v", err)
+		return
+	}
+	rules.Content = sorted
+}
+
+// sortRules returns the rules sorted by their text with the terminal MATCH rules last, an error
+// is returned if the sorting could change which rule matches some traffic.
+func sortRules(nodes []*yaml.Node) ([]*yaml.Node, error) {
+	var body, tail []*yaml.Node
+	for _, n := range nodes {
+		if r := parseRule(n.Value); r.typ == "MATCH" || r.typ == "FINAL" {
+			tail = append(tail, n)
+		} else if len(tail) > 0 {
+			// the rules after MATCH are never reached, moving them before it would enable them
+			return nil, fmt.Errorf("%q follows the terminal rule %q", n.Value, tail[0].Value)
+		} else {
+			body = append(body, n)
+		}
+	}
+
+	index := make(map[*yaml.Node]int, len(body))
+	for i, n := range body {
+		index[n] = i
+	}
+	sorted := append([]*yaml.Node{}, body...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value < sorted[j].Value })
+
+	// every pair that changes its relative order must be provably independent
+	pos := make([]int, len(body))
+	for i, n := range sorted {
+		pos[index[n]] = i
+	}
+	parsed := make([]rule, len(body))
+	for i, n := range body {
+		parsed[i] = parseRule(n.Value)
+	}
+	for i := 0; i < len(body); i++ {
+		for j := i + 1; j < len(body); j++ {
+			if pos[i] < pos[j] || parsed[i].target == parsed[j].target {
+				continue
+			}
+			if rulesMayOverlap(parsed[i], parsed[j]) {
+				return nil, fmt.Errorf("%q and %q may match the same traffic with different targets", body[i].Value, body[j].Value)
+			}
+		}
+	}
+
+	return append(sorted, tail...), nil
+}
+
+// rule is a clash rule "TYPE,PAYLOAD,TARGET[,OPTIONS]", logical rules keep their nested rules
+// in the payload
+type rule struct {
+	typ, payload, target string
+	noResolve            bool
+}
+
+func parseRule(s string) rule {
+	fields := strings.Split(s, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	r := rule{typ: strings.ToUpper(fields[0])}
+	if r.typ == "MATCH" || r.typ == "FINAL" {
+		if len(fields) > 1 {
+			r.target = fields[1]
+		}
+		return r
+	}
+
+	for len(fields) > 3 && (fields[len(fields)-1] == "no-resolve" || fields[len(fields)-1] == "src") {
+		r.noResolve = r.noResolve || fields[len(fields)-1] == "no-resolve"
+		fields = fields[:len(fields)-1]
+	}
+	if len(fields) >= 3 {
+		r.target = fields[len(fields)-1]
+		r.payload = strings.Join(fields[1:len(fields)-1], ",")
+	}
+	return r
+}
+
+// rulesMayOverlap reports whether both rules could match the same connection, it is only
+// false if that is provable from the rule payloads.
+func rulesMayOverlap(a, b rule) bool {
+	isDomain := func(r rule) bool { return r.typ == "DOMAIN" || r.typ == "DOMAIN-SUFFIX" }
+	isIP := func(r rule) bool { return r.typ == "IP-CIDR" || r.typ == "IP-CIDR6" }
+
+	switch {
+	case isDomain(a) && isDomain(b):
+		return domainRuleMatches(a, b) || domainRuleMatches(b, a)
+	case isIP(a) && isIP(b):
+		_, na, erra := net.ParseCIDR(a.payload)
+		_, nb, errb := net.ParseCIDR(b.payload)
+		if erra != nil || errb != nil {
+			return true
+		}
+		return na.Contains(nb.IP) || nb.Contains(na.IP)
+	case isDomain(a) && isIP(b):
+		// an ip rule only sees connections with a domain if it resolves them
+		return !b.noResolve
+	case isIP(a) && isDomain(b):
+		return !a.noResolve
+	}
+	return true
+}
+
+// domainRuleMatches checks whether a domain matched by b can be matched by a
+func domainRuleMatches(a, b rule) bool {
+	bDomain := strings.ToLower(b.payload)
+	aDomain := strings.ToLower(a.payload)
+	switch {
+	case a.typ == "DOMAIN" && b.typ == "DOMAIN":
+		return aDomain == bDomain
+	case a.typ == "DOMAIN-SUFFIX":
+		// clash matches the suffix itself and its subdomains
+		return bDomain == aDomain || strings.HasSuffix(bDomain, "."+aDomain)
+	}
+	return false
+}
@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 
@@ -25,20 +32,107 @@ import (
 )
 
 type TPClashConf struct {
-	ClashHome         string
-	ClashConfig       string
-	ClashUI           string
-	HttpHeader        []string
-	HttpTimeout       time.Duration
-	CheckInterval     time.Duration
-	ConfigEncPassword string
-	AutoFixMode       string
-
-	ForceExtract         bool
-	EnableTracing        bool
-	PrintVersion         bool
-	UpgradeWithGhProxy   bool
-	AllowStandardDNSPort bool
+	ClashHome            string
+	ClashAssetDir        string
+	CacheFile            string
+	AssetOverlay         string
+	ClashInterface       string
+	ConfigFifo           string
+	ClashConfig          string
+	ConfigBundle         string
+	ConfigOverrideDir    string
+	ReloadTriggerFile    string
+	ControlSocket        string
+	OnDuplicate          string
+	LanBindCheck         string
+	ReloadBody           string
+	RulesPosition        string
+	ClashUI              string
+	HttpHeader           []string
+	RoutePorts           []string
+	GroupDefaults        []string
+	GroupTestURLs        []string
+	GroupTestIntervals   []string
+	Schedules            []string
+	HttpTimeout          time.Duration
+	APIKeepAlive         time.Duration
+	APIIdleTimeout       time.Duration
+	APIProxyAddr         string
+	APIProxyToken        string
+	APIProxyUser         string
+	APIProxyPassword     string
+	HealthAddr           string
+	MetricsTextfile      string
+	RestartOnLog         string
+	SSHKey               string
+	SSHKnownHosts        string
+	FetchResolver        string
+	FetchHostIP          string
+	CheckInterval        time.Duration
+	Once                 time.Duration
+	ShutdownGrace        time.Duration
+	StartupTimeout       time.Duration
+	ProbeTimeout         time.Duration
+	ProbeInterval        time.Duration
+	TopInterval          time.Duration
+	RollbackWindow       time.Duration
+	MetricsInterval      time.Duration
+	OtelEndpoint         string
+	RestartOnLogCooldown time.Duration
+	HealthyGroupsMin     int
+	ClashNice            int
+	Confirm              bool
+	SSHSafe              bool
+	RollbackMinErrors    int
+	RollbackFactor       float64
+	TunMTU               int
+	ProxyFwmark          uint32
+	ConfigEncPassword    string
+	ProxyMode            string
+	RulesFile            string
+	NftBin               string
+	ClashIONice          string
+	Instance             string
+	AutoFixMode          string
+	LogFormat            string
+	VerifyKey            string
+
+	ForceExtract            bool
+	ForceExtractUI          bool
+	ForceImportState        bool
+	PreCommit               bool
+	ValidateStaged          bool
+	ValidateNoResolve       bool
+	ServiceUser             bool
+	ServiceInstall          bool
+	Takeover                bool
+	FeaturesJSON            bool
+	EnableTracing           bool
+	PrintVersion            bool
+	UpgradeWithGhProxy      bool
+	AllowStandardDNSPort    bool
+	DesktopNotify           bool
+	FetchViaProxy           bool
+	CheckIntervalFixed      bool
+	AutoFixStrict           bool
+	VerifyAutoFix           bool
+	CanonicalOutput         bool
+	AutoRollback            bool
+	StrictProxy             bool
+	Frozen                  bool
+	StaleWhileRevalidate    bool
+	ReloadOnInterfaceChange bool
+	NoValidateCache         bool
+	ValidateLocalEdits      bool
+	DryRunReload            bool
+	ResolveServers          bool
+	RequireHealthyProxy     bool
+	WatchCoreBinary         bool
+	CrashDump               bool
+	RedactFifo              bool
+	InMemory                bool
+	Notrack                 bool
+	ClampMSS                bool
 
 	Test  bool
 	Debug bool
@@ -68,6 +162,8 @@ type ClashConf struct {
 		AutoRedir           bool     `yaml:"auto-redir"`
 		AutoRoute           bool     `yaml:"auto-route"`
 		AutoDetectInterface bool     `yaml:"auto-detect-interface"`
+		Device              string   `yaml:"device"`
+		IPRoute2TableIndex  uint32   `yaml:"iproute2-table-index"`
 	} `yaml:"tun"`
 	DNS struct {
 		Enable            bool     `yaml:"enable"`
@@ -80,12 +176,161 @@ type ClashConf struct {
 		Nameserver        []string `yaml:"nameserver"`
 	} `yaml:"dns"`
 
+	Proxies []struct {
+		Name   string `yaml:"name"`
+		Type   string `yaml:"type"`
+		Server string `yaml:"server"`
+	} `yaml:"proxies"`
+	ProxyGroups []struct {
+		Name    string   `yaml:"name"`
+		Type    string   `yaml:"type"`
+		Proxies []string `yaml:"proxies"`
+	} `yaml:"proxy-groups"`
+	Rules []string `yaml:"rules"`
+
 	// Meta
 	IPTables struct {
 		Enable bool `yaml:"enable"`
 	} `yaml:"iptables"`
 }
 
+// RoutePort is a destination port routed to a specific proxy group(--route-port)
+type RoutePort struct {
+	Port  int
+	Group string
+}
+
+func parseRoutePorts() ([]RoutePort, error) {
+	var routes []RoutePort
+	for _, kv := range conf.RoutePorts {
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 || ss[1] == "" {
+			return nil, fmt.Errorf("[config] failed to parse route port(<port>=<group>): %s", kv)
+		}
+		port, err := strconv.Atoi(ss[0])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("[config] invalid route port: %s", kv)
+		}
+		routes = append(routes, RoutePort{Port: port, Group: ss[1]})
+	}
+	return routes, nil
+}
+
+// GroupDefault is the proxy a select group is pinned to after each reload(--group-default)
+type GroupDefault struct {
+	Group string
+	Proxy string
+}
+
+func parseGroupDefaults() ([]GroupDefault, error) {
+	var defaults []GroupDefault
+	for _, kv := range conf.GroupDefaults {
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			return nil, fmt.Errorf("[config] failed to parse group default(<group>=<proxy>): %s", kv)
+		}
+		defaults = append(defaults, GroupDefault{Group: ss[0], Proxy: ss[1]})
+	}
+	return defaults, nil
+}
+
+// GroupTestOverride replaces the test url and interval of a proxy group(--group-test-url,
+// --group-test-interval), the zero values keep the ones of the config.
+type GroupTestOverride struct {
+	Group    string
+	URL      string
+	Interval time.Duration
+}
+
+func parseGroupTestOverrides() ([]GroupTestOverride, error) {
+	var overrides []GroupTestOverride
+	override := func(group string) *GroupTestOverride {
+		for i := range overrides {
+			if overrides[i].Group == group {
+				return &overrides[i]
+			}
+		}
+		overrides = append(overrides, GroupTestOverride{Group: group})
+		return &overrides[len(overrides)-1]
+	}
+
+	for _, kv := range conf.GroupTestURLs {
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			return nil, fmt.Errorf("[config] failed to parse group test url(<group>=<url>): %s", kv)
+		}
+		if u, err := url.Parse(ss[1]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("[config] invalid group test url: %s", kv)
+		}
+		override(ss[0]).URL = ss[1]
+	}
+	for _, kv := range conf.GroupTestIntervals {
+		ss := strings.SplitN(kv, "=", 2)
+		if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+			return nil, fmt.Errorf("[config] failed to parse group test interval(<group>=<duration>): %s", kv)
+		}
+		// clash takes the interval in seconds
+		d, err := time.ParseDuration(ss[1])
+		if err != nil || d < time.Second || d%time.Second != 0 {
+			return nil, fmt.Errorf("[config] invalid group test interval, whole seconds required(e.g. 300s/5m): %s", kv)
+		}
+		override(ss[0]).Interval = d
+	}
+	return overrides, nil
+}
+
+// hasProxyTarget checks whether the name is a proxy group, a proxy or a built-in policy
+func (cc *ClashConf) hasProxyTarget(name string) bool {
+	switch name {
+	case "DIRECT", "REJECT", "REJECT-DROP", "PASS", "COMPATIBLE":
+		return true
+	}
+	for _, g := range cc.ProxyGroups {
+		if g.Name == name {
+			return true
+		}
+	}
+	for _, p := range cc.Proxies {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGroupDefault checks that the group is a select group containing the proxy
+func (cc *ClashConf) checkGroupDefault(d GroupDefault) error {
+	for _, g := range cc.ProxyGroups {
+		if g.Name != d.Group {
+			continue
+		}
+		if g.Type != "select" {
+			return fmt.Errorf("[config] group default %s is not a select group(proxy-groups)", d.Group)
+		}
+		for _, p := range g.Proxies {
+			if p == d.Proxy {
+				return nil
+			}
+		}
+		return fmt.Errorf("[config] group default %s does not contain proxy %s(proxy-groups)", d.Group, d.Proxy)
+	}
+	return fmt.Errorf("[config] group default %s does not exist(proxy-groups)", d.Group)
+}
+
+func (cc *ClashConf) checkGroupTestOverride(o GroupTestOverride) error {
+	for _, g := range cc.ProxyGroups {
+		if g.Name != o.Group {
+			continue
+		}
+		switch g.Type {
+		case "url-test", "fallback", "load-balance":
+			return nil
+		}
+		return fmt.Errorf("[config] group test override %s is a %s group, only url-test/fallback/load-balance groups are tested(proxy-groups)", o.Group, g.Type)
+	}
+	return fmt.Errorf("[config] group test override %s does not exist(proxy-groups)", o.Group)
+}
+
 func CheckConfig(c string) (*ClashConf, error) {
 	var cc ClashConf
 	if err := yaml.Unmarshal([]byte(c), &cc); err != nil {
@@ -110,7 +355,7 @@ func CheckConfig(c string) (*ClashConf, error) {
 		return nil, fmt.Errorf("[config] dns port in clash config is missing(dns.listen)")
 	}
 	if !conf.AllowStandardDNSPort && dport == 53 {
-		return nil, fmt.Errorf("[config] please do not set DNS to listen on port 53(dns.listen), see also: https://github.com/mritd/tpclash/wiki/Clash-DNS-%E7%A7%91%E6%99%AE")
+		return nil, errors.New("[config] please do not set DNS to listen on port 53(dns.listen), see also: https://github.com/mritd/tpclash/wiki/Clash-DNS-%E7%A7%91%E6%99%AE")
 	}
 
 	dhost := net.ParseIP(dnsHost)
@@ -146,59 +391,204 @@ func CheckConfig(c string) (*ClashConf, error) {
 		return nil, fmt.Errorf("[config] meta kernel must turn off iptables(iptables.enable)")
 	}
 
+	if isUnixController(&cc) {
+		return nil, fmt.Errorf("[config] unix socket clash api is not supported(external-controller), use a loopback address")
+	}
+
+	routes, err := parseRoutePorts()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if !cc.hasProxyTarget(r.Group) {
+			return nil, fmt.Errorf("[config] route port %d target %s does not exist(proxy-groups)", r.Port, r.Group)
+		}
+	}
+
+	defaults, err := parseGroupDefaults()
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range defaults {
+		if err = cc.checkGroupDefault(d); err != nil {
+			return nil, err
+		}
+	}
+
+	overrides, err := parseGroupTestOverrides()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range overrides {
+		if err = cc.checkGroupTestOverride(o); err != nil {
+			return nil, err
+		}
+	}
+
 	return &cc, nil
 }
 
+func isRemoteConfig() bool {
+	return conf.ConfigBundle != "" || strings.HasPrefix(conf.ClashConfig, "http://") || strings.HasPrefix(conf.ClashConfig, "https://") || isSFTPConfig()
+}
+
+func isSFTPConfig() bool {
+	return strings.HasPrefix(conf.ClashConfig, "sftp://")
+}
+
 func WatchConfig(ctx context.Context) chan string {
 	buffer := ""
 	updateCh := make(chan string, 3)
-
-	if strings.HasPrefix(conf.ClashConfig, "http://") || strings.HasPrefix(conf.ClashConfig, "https://") {
-		ccStr, err := loadRemoteConfig()
+	// a changed override dir and a changed default route send the current config again
+	reapplyCh := mergeTriggers(ctx, WatchOverrideDir(ctx), routeChangeCh)
+	triggerCh := mergeTriggers(ctx, WatchTriggerFile(ctx), controlReloadCh)
+	scheduleCh := WatchSchedule(ctx)
+
+	// scheduled is the config file activated by --schedule, it replaces the config of --config
+	// until the schedule switches back, buffer keeps tracking --config meanwhile
+	scheduled := ActiveSchedule()
+	active := func() (string, error) {
+		if scheduled == "" {
+			return autoFix(buffer)
+		}
+		c, err := loadScheduledConfig(scheduled)
 		if err != nil {
-			logrus.Fatal(err)
+			return "", err
+		}
+		return autoFix(c)
+	}
+	if scheduled != "" {
+		logrus.Infof("[schedule] scheduled config %s is active", scheduled)
+	}
+
+	if isRemoteConfig() {
+		var (
+			ccStr            string
+			providerInterval time.Duration
+			err              error
+			revalidate       bool
+		)
+
+		// Serve the cached config immediately, and revalidate it in background
+		if conf.StaleWhileRevalidate {
+			if bs, err := os.ReadFile(filepath.Join(conf.ClashHome, InternalRemoteCacheName)); err == nil {
+				logrus.Info("[config] stale-while-revalidate: applying cached remote config immediately...")
+				ccStr, revalidate = string(bs), true
+			} else {
+				logrus.Warnf("[config] stale-while-revalidate: no cached remote config available: %v", err)
+			}
+		}
+		if !revalidate {
+			ccStr, providerInterval, err = loadRemoteConfig()
+			if err != nil {
+				// sftp sources fall back to the cached config if the ssh server is unreachable
+				bs, cerr := os.ReadFile(filepath.Join(conf.ClashHome, InternalRemoteCacheName))
+				if !isSFTPConfig() || cerr != nil {
+					fatal(ExitConfigFetch, err)
+				}
+				logrus.Warnf("%v, falling back to the cached remote config...", err)
+				ccStr = string(bs)
+			} else {
+				saveRemoteCache(ccStr)
+			}
 		}
 		buffer = ccStr
-		updateCh <- autoFix(ccStr)
+		fixed, err := active()
+		if err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		updateCh <- fixed
 
 		go func() {
-			tick := time.Tick(conf.CheckInterval)
+			interval := checkInterval(providerInterval)
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			check := func(force bool) {
+				ccStr, providerInterval, err := loadRemoteConfig()
+				if err != nil {
+					logrus.Error(err)
+					return
+				}
+				saveRemoteCache(ccStr)
+				if d := checkInterval(providerInterval); d != interval {
+					logrus.Infof("[config] remote config check interval changed: %s -> %s", interval, d)
+					interval = d
+					ticker.Reset(interval)
+				}
+				// a config bundle may only change its assets
+				changed := configChanged(buffer, ccStr) || bundleAssetsPending()
+				if !changed && ccStr != buffer && !force {
+					logrus.Info("[config] remote config is equivalent to the current one(reordered/reformatted), skip reloading")
+				}
+				if force || changed {
+					buffer = ccStr
+					if scheduled != "" {
+						logrus.Infof("[schedule] scheduled config %s is active, the remote config change is applied once the schedule switches back", scheduled)
+						return
+					}
+					fixed, err := autoFix(ccStr)
+					if err != nil {
+						logrus.Error(err)
+						return
+					}
+					updateCh <- fixed
+				}
+			}
+
+			if revalidate {
+				logrus.Info("[config] stale-while-revalidate: fetching the fresh remote config...")
+				check(false)
+			}
+
 			for {
 				select {
 				case <-ctx.Done():
 					close(updateCh)
 					logrus.Warnf("[config] stop config watching...")
 					return
-				case <-tick:
-					ccStr, err = loadRemoteConfig()
+				case <-ticker.C:
+					check(false)
+				case <-triggerCh:
+					check(true)
+				case <-reapplyCh:
+					fixed, err := active()
 					if err != nil {
 						logrus.Error(err)
 						continue
 					}
-					if ccStr != buffer {
-						buffer = ccStr
-						updateCh <- autoFix(ccStr)
+					updateCh <- fixed
+				case scheduled = <-scheduleCh:
+					fixed, err := active()
+					if err != nil {
+						logrus.Error(err)
+						continue
 					}
+					updateCh <- fixed
 				}
 			}
 		}()
 	} else {
 		ccStr, err := loadLocalConfig()
 		if err != nil {
-			logrus.Fatal(err)
+			fatal(ExitConfigFetch, err)
 		}
 		buffer = ccStr
-		updateCh <- autoFix(ccStr)
+		fixed, err := active()
+		if err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		updateCh <- fixed
 
 		go func() {
 			watcher, err := fsnotify.NewWatcher()
 			if err != nil {
-				logrus.Fatalf("[config] failed to create fs watcher: %v", err)
+				fatalf(ExitConfigFetch, "[config] failed to create fs watcher: %v", err)
 			}
 			defer func() { _ = watcher.Close() }()
 
 			if err = watcher.Add(filepath.Dir(conf.ClashConfig)); err != nil {
-				logrus.Fatalf("[config] failed add %s to fs watcher: %v", conf.ClashConfig, err)
+				fatalf(ExitConfigFetch, "[config] failed add %s to fs watcher: %v", conf.ClashConfig, err)
 			}
 
 			for {
@@ -222,9 +612,45 @@ func WatchConfig(ctx context.Context) chan string {
 						}
 						if ccStr != buffer {
 							buffer = ccStr
-							updateCh <- autoFix(ccStr)
+							if scheduled != "" {
+								logrus.Infof("[schedule] scheduled config %s is active, the config change is applied once the schedule switches back", scheduled)
+								continue
+							}
+							fixed, err := autoFix(ccStr)
+							if err != nil {
+								logrus.Error(err)
+								continue
+							}
+							updateCh <- fixed
 						}
 					}
+				case <-reapplyCh:
+					fixed, err := active()
+					if err != nil {
+						logrus.Error(err)
+						continue
+					}
+					updateCh <- fixed
+				case scheduled = <-scheduleCh:
+					fixed, err := active()
+					if err != nil {
+						logrus.Error(err)
+						continue
+					}
+					updateCh <- fixed
+				case <-triggerCh:
+					ccStr, err = loadLocalConfig()
+					if err != nil {
+						logrus.Error(err)
+						continue
+					}
+					buffer = ccStr
+					fixed, err := active()
+					if err != nil {
+						logrus.Error(err)
+						continue
+					}
+					updateCh <- fixed
 				case err, ok := <-watcher.Errors:
 					if !ok {
 						return
@@ -239,51 +665,250 @@ func WatchConfig(ctx context.Context) chan string {
 	return updateCh
 }
 
+// reloadMu guards the single in-flight reload of the running clash, all change sources
+// (config watcher, control socket, rollback) are serialized by it.
+var reloadMu sync.Mutex
+
+// coalesceUpdates drains the updates queued while the previous reload was in flight, every
+// update carries the full latest state of all sources so only the last one is applied.
+func coalesceUpdates(updateCh chan string, ccStr string) (string, bool) {
+	coalesced := 0
+	for {
+		select {
+		case next, ok := <-updateCh:
+			if !ok {
+				return ccStr, false
+			}
+			ccStr = next
+			coalesced++
+		default:
+			if coalesced > 0 {
+				logrus.Infof("[config] %d queued config changes coalesced into one reload", coalesced)
+			}
+			return ccStr, true
+		}
+	}
+}
+
 func AutoReload(updateCh chan string, writePath string) {
+	autoReload(updateCh, func(ccStr string) error { return applyReload(ccStr, writePath) })
+}
+
+// autoReload is the reload loop of AutoReload, reload applies a single(coalesced) update
+func autoReload(updateCh chan string, reload func(string) error) {
 	for ccStr := range updateCh {
-		logrus.Info("[config] clash config changed, reloading...")
+		ccStr, ok := coalesceUpdates(updateCh, ccStr)
+		if !ok {
+			return
+		}
+		reloadMu.Lock()
+		setServiceState(StateReloading, "")
+		if err := reload(ccStr); err != nil {
+			metricReloadsFailed.Add(1)
+			setServiceState(StateDegraded, fmt.Sprintf("last reload failed: %v", err))
+		} else {
+			metricReloadsOK.Add(1)
+			if proxyPaused.Load() {
+				setServiceState(StateDegraded, proxyPausedReason)
+			} else {
+				setServiceState(StateReady, "")
+			}
+		}
+		reloadMu.Unlock()
+	}
+}
 
-		ccStr = autoFix(ccStr)
-		cc, err := CheckConfig(ccStr)
-		if err != nil {
-			logrus.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %v", err)
-			continue
+// applyReload validates and applies a config update to the running clash, the error
+// has already been logged and notified.
+func applyReload(ccStr, writePath string) (err error) {
+	logrus.Info("[config] clash config changed, reloading...")
+	// the staged assets of a config bundle are only applied together with the config
+	stage := takeBundleStage()
+	defer stage.discard()
+	trace := startTrace("reload", map[string]string{"config.remote": strconv.FormatBool(isRemoteConfig()), "dry_run": strconv.FormatBool(conf.DryRunReload)})
+	defer func() { trace.End(err) }()
+
+	end := trace.Phase("autofix")
+	ccStr, err = autoFix(ccStr)
+	end(err)
+	if err != nil {
+		logrus.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
+	if conf.VerifyAutoFix {
+		if err = checkAutoFixIdempotent(ccStr); err != nil {
+			logrus.Warnf("%v", err)
 		}
+	}
 
-		if err := os.WriteFile(writePath, []byte(ccStr), 0644); err != nil {
-			logrus.Errorf("[config] failed to copy clash config: %v", err)
-			continue
+	end = trace.Phase("check")
+	cc, err := ValidateConfig(ccStr)
+	end(err)
+	if err != nil {
+		logrus.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
+
+	if conf.ValidateLocalEdits && (conf.DryRunReload || !isRemoteConfig()) {
+		end = trace.Phase("core-verify")
+		err = VerifyConfigWithCore(ccStr)
+		end(err)
+		if err != nil {
+			logrus.Errorf("[config] local config edit failed core validation, keep running the current config:\n %v", err)
+			DesktopNotify("TPClash local config invalid", "%v", err)
+			return err
 		}
+	}
+
+	if err = checkLanBind(cc); err != nil {
+		logrus.Errorf("[config] an error was detected in the clash config, skipping automatic reload:\n %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
+
+	if err = CheckProxyConflicts(); err != nil {
+		logrus.Errorf("[config] skipping automatic reload(--strict-proxy):\n %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
+
+	if conf.ResolveServers {
+		end = trace.Phase("resolve")
+		warnUnresolvedServers(cc)
+		end(nil)
+	}
+
+	if conf.DryRunReload {
+		added, removed := diffConfigLines(loadAppliedConfig(writePath), ccStr)
+		logrus.Infof("[config] dry-run: clash config validated, not applied(+%d/-%d lines)", added, removed)
+		DesktopNotify("TPClash reload validated", "clash config validated, not applied(+%d/-%d lines)", added, removed)
+		return nil
+	}
+
+	if err = stage.commit(); err != nil {
+		logrus.Errorf("[config] failed to apply the assets of the config bundle, skipping automatic reload: %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
 
-		apiAddr := cc.ExternalController
-		if apiAddr == "" {
-			apiAddr = "127.0.0.1:9090"
+	previous := loadAppliedConfig(writePath)
+	end = trace.Phase("write")
+	if conf.InMemory {
+		inMemoryConfig.Store(&ccStr)
+	} else {
+		err = WriteFileAtomic(writePath, []byte(ccStr), 0644)
+	}
+	end(err)
+	if err != nil {
+		// Never reload a partially written config, the previous one is kept on error
+		logrus.Errorf("[config] failed to copy clash config, skipping automatic reload: %v", err)
+		DesktopNotify("TPClash reload failed", "failed to copy clash config: %v", err)
+		return err
+	}
+
+	end = trace.Phase("reload")
+	err = reloadClashConfig(cc, writePath)
+	end(err)
+	if err != nil {
+		logrus.Errorf("[config] failed to reload config: %v", err)
+		DesktopNotify("TPClash reload failed", "%v", err)
+		return err
+	}
+
+	currentClashConf.Store(cc)
+	logrus.Info("[config] clash config reload success...")
+	end = trace.Phase("group-defaults")
+	ApplyGroupDefaults(cc)
+	end(nil)
+	reloadGeneration.Add(1)
+	if previous != "" && previous != ccStr {
+		previousConfig.Store(&previous)
+	}
+	if clashErrors != nil && previous != "" && previous != ccStr {
+		go watchReload(previous, writePath, time.Now())
+	}
+	DesktopNotify("TPClash reload success", "clash config has been reloaded")
+	return nil
+}
+
+// loadAppliedConfig returns the config clash is currently running with
+func loadAppliedConfig(writePath string) string {
+	if conf.InMemory {
+		if s := inMemoryConfig.Load(); s != nil {
+			return *s
 		}
-		secret := cc.Secret
+		return ""
+	}
+	bs, _ := os.ReadFile(writePath)
+	return string(bs)
+}
 
-		req, err := http.NewRequest("PUT", "http://"+apiAddr+"/configs", bytes.NewReader([]byte(fmt.Sprintf(`{"path": "%s"}`, writePath))))
-		if err != nil {
-			logrus.Errorf("[config] failed to create reload req: %v", err)
-			continue
+// diffConfigLines counts the lines only present in the new or the old config
+func diffConfigLines(old, new string) (added, removed int) {
+	count := map[string]int{}
+	for _, l := range strings.Split(old, "\n") {
+		count[l]++
+	}
+	for _, l := range strings.Split(new, "\n") {
+		if count[l] > 0 {
+			count[l]--
+		} else {
+			added++
 		}
-		req.Header.Set("Authorization", "Bearer "+secret)
-		cli := &http.Client{Timeout: 5 * time.Second}
+	}
+	for _, n := range count {
+		removed += n
+	}
+	return added, removed
+}
 
-		resp, err := cli.Do(req)
-		if err != nil {
-			logrus.Errorf("[config] failed to reload config: %v", err)
+// configChanged reports whether the config changed semantically, configs that only differ in
+// formatting, comments, key order or the order of proxies/proxy-groups are the same, so that
+// providers returning reordered but equivalent configs do not cause a reload on every fetch.
+// The order of rules and of the proxies inside a group matters and is kept.
+func configChanged(old, new string) bool {
+	if old == new {
+		return false
+	}
+	oh, err := canonicalConfigHash(old)
+	if err != nil {
+		return true
+	}
+	nh, err := canonicalConfigHash(new)
+	if err != nil {
+		return true
+	}
+	return oh != nh
+}
+
+// canonicalConfigHash hashes the config with the proxies and proxy-groups sorted by name, it
+// is only used for change detection, clash always gets the config in its original order.
+func canonicalConfigHash(c string) ([sha256.Size]byte, error) {
+	var m map[string]any
+	if err := yaml.Unmarshal([]byte(c), &m); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	for _, key := range []string{"proxies", "proxy-groups"} {
+		list, ok := m[key].([]any)
+		if !ok {
 			continue
 		}
-		defer func() { _ = resp.Body.Close() }()
-
-		if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-			var msg bytes.Buffer
-			_, _ = io.Copy(&msg, resp.Body)
-			logrus.Errorf("[config] failed to reload config: status %d: %s", resp.StatusCode, msg.String())
+		name := func(i int) string {
+			if p, ok := list[i].(map[string]any); ok {
+				return fmt.Sprint(p["name"])
+			}
+			return ""
 		}
+		sort.SliceStable(list, func(i, j int) bool { return name(i) < name(j) })
+	}
 
-		logrus.Info("[config] clash config reload success...")
+	bs, err := yaml.Marshal(m)
+	if err != nil {
+		return [sha256.Size]byte{}, err
 	}
+	return sha256.Sum256(bs), nil
 }
 
 func Encrypt(plaintext []byte, password string) []byte {
@@ -318,46 +943,382 @@ func tplRendering(c string) string {
 	return buf.String()
 }
 
-func loadRemoteConfig() (string, error) {
+// saveRemoteCache stores the latest remote config, it is used by stale-while-revalidate
+func saveRemoteCache(c string) {
+	if conf.InMemory {
+		return
+	}
+	if err := WriteFileAtomic(filepath.Join(conf.ClashHome, InternalRemoteCacheName), []byte(c), 0600); err != nil {
+		logrus.Warnf("[config] failed to cache remote config: %v", err)
+	}
+}
+
+// loadRemoteConfig downloads the remote config, it also returns the refresh
+// interval recommended by the subscription provider (zero if not present).
+func loadRemoteConfig() (string, time.Duration, error) {
 	logrus.Debugf("[config] checking remote config...")
 
-	req, err := http.NewRequest("GET", conf.ClashConfig, nil)
-	if err != nil {
-		return "", fmt.Errorf("[config] failed to create remote config req: %w", err)
+	if conf.ConfigBundle != "" {
+		c, err := loadConfigBundle()
+		return c, 0, err
 	}
 
-	for _, kv := range conf.HttpHeader {
-		ss := strings.Split(kv, "=")
-		if len(ss) != 2 {
-			return "", fmt.Errorf("[config] failed to parse http header: %s", kv)
+	if isSFTPConfig() {
+		u, err := url.Parse(conf.ClashConfig)
+		if err != nil {
+			return "", 0, fmt.Errorf("[config] failed to parse sftp config url: %w", err)
 		}
-		req.Header.Set(ss[0], ss[1])
+		bs, err := loadSFTPConfig(u)
+		if err != nil {
+			return "", 0, err
+		}
+		if conf.ConfigEncPassword != "" {
+			plaintext, err := Decrypt(bs, conf.ConfigEncPassword)
+			return string(plaintext), parseProviderInterval(nil, string(plaintext)), err
+		}
+		return string(bs), parseProviderInterval(nil, string(bs)), nil
 	}
 
-	req.Header.Set("User-Agent", fmt.Sprintf("TPClash %s %s", version, commit))
+	req, err := newRemoteConfigRequest(conf.ClashConfig)
+	if err != nil {
+		return "", 0, err
+	}
 
-	cli := &http.Client{Timeout: conf.HttpTimeout}
-	resp, err := cli.Do(req)
+	resp, err := newFetchClient().Do(req)
 	if err != nil {
-		return "", fmt.Errorf("[config] failed to download remote config: %v", err)
+		return "", 0, fmt.Errorf("[config] failed to download remote config: %v", err)
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
-		return "", fmt.Errorf("[config] failed to get remote config: status code %d", resp.StatusCode)
+		return "", 0, fmt.Errorf("[config] failed to get remote config: status code %d", resp.StatusCode)
 	}
 
 	bs, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("[config] failed to copy resp: %w", err)
+		return "", 0, fmt.Errorf("[config] failed to copy resp: %w", err)
 	}
 
 	if conf.ConfigEncPassword != "" {
 		plaintext, err := Decrypt(bs, conf.ConfigEncPassword)
-		return string(plaintext), err
+		return string(plaintext), parseProviderInterval(resp.Header, string(plaintext)), err
 	}
 
-	return string(bs), nil
+	return string(bs), parseProviderInterval(resp.Header, string(bs)), nil
+}
+
+// newRemoteConfigRequest creates the request of a remote config with the --http-header headers
+func newRemoteConfigRequest(addr string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", addr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("[config] failed to create remote config req: %w", err)
+	}
+
+	for _, kv := range conf.HttpHeader {
+		ss := strings.Split(kv, "=")
+		if len(ss) != 2 {
+			return nil, fmt.Errorf("[config] failed to parse http header: %s", kv)
+		}
+		req.Header.Set(ss[0], ss[1])
+	}
+
+	req.Header.Set("User-Agent", fmt.Sprintf("TPClash %s %s", version, commit))
+	return req, nil
+}
+
+// fetchProxy is the clash http proxy used by remote config fetching, it is
+// only set after clash is up, so the first fetch is always direct.
+var fetchProxy atomic.Pointer[url.URL]
+
+// SetFetchProxy routes subsequent remote config fetches through the clash mixed/http port
+func SetFetchProxy(cc *ClashConf) {
+	if !conf.FetchViaProxy {
+		return
+	}
+
+	port := cc.MixedPort
+	if port == 0 {
+		port = cc.Port
+	}
+	if port == 0 {
+		logrus.Warn("[config] clash mixed-port/port is not set, remote config will still be fetched directly")
+		return
+	}
+
+	u := &url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))}
+	logrus.Infof("[config] remote config will be fetched via clash proxy %s", u)
+	fetchProxy.Store(u)
+}
+
+// newFetchClient creates the remote config http client, the config host can be pinned to
+// an IP(--fetch-host-ip) or resolved by a specific DNS server(--fetch-resolver), the pinned
+// IP takes precedence over the resolver.
+func newFetchClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if conf.FetchResolver != "" {
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, fetchResolverAddr())
+			},
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if conf.FetchHostIP != "" {
+			host, port, err := net.SplitHostPort(addr)
+			if err == nil && host == fetchHost() {
+				addr = net.JoinHostPort(conf.FetchHostIP, port)
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	if u := fetchProxy.Load(); u != nil {
+		transport.Proxy = http.ProxyURL(u)
+	}
+	return &http.Client{Timeout: conf.HttpTimeout, Transport: transport}
+}
+
+func fetchHost() string {
+	addr := conf.ClashConfig
+	if conf.ConfigBundle != "" {
+		addr = conf.ConfigBundle
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+func fetchResolverAddr() string {
+	if _, _, err := net.SplitHostPort(conf.FetchResolver); err == nil {
+		return conf.FetchResolver
+	}
+	return net.JoinHostPort(conf.FetchResolver, "53")
+}
+
+// validateFlags checks the flags that can not be validated by the flag parser
+func validateFlags() error {
+	if _, err := parseRoutePorts(); err != nil {
+		return err
+	}
+	if _, err := parseGroupDefaults(); err != nil {
+		return err
+	}
+	if _, err := parseGroupTestOverrides(); err != nil {
+		return err
+	}
+	if _, err := parseSchedules(); err != nil {
+		return err
+	}
+
+	if conf.APIProxyAddr != "" && conf.APIProxyToken == "" && (conf.APIProxyUser == "" || conf.APIProxyPassword == "") {
+		return errors.New("[config] api proxy requires a token(--api-proxy-token) or basic auth(--api-proxy-user/--api-proxy-password)")
+	}
+
+	if conf.Once < 0 {
+		return fmt.Errorf("[config] invalid once duration: %s", conf.Once)
+	}
+
+	if conf.StartupTimeout <= 0 || conf.ProbeTimeout <= 0 || conf.ProbeInterval <= 0 {
+		return errors.New("[config] --startup-timeout, --probe-timeout and --probe-interval must be positive")
+	}
+	if conf.ProbeTimeout > conf.StartupTimeout {
+		return fmt.Errorf("[config] probe timeout %s exceeds the startup timeout %s", conf.ProbeTimeout, conf.StartupTimeout)
+	}
+
+	if conf.ClashNice < -20 || conf.ClashNice > 19 {
+		return fmt.Errorf("[config] invalid clash nice(-20 to 19): %d", conf.ClashNice)
+	}
+	if _, err := parseIONice(conf.ClashIONice); err != nil {
+		return err
+	}
+
+	if conf.Instance != "" && !instanceNameRe.MatchString(conf.Instance) {
+		return fmt.Errorf("[config] invalid instance name(letters, digits, '_', '.' and '-'): %s", conf.Instance)
+	}
+
+	if conf.Confirm && !isTerminal(int(os.Stdin.Fd())) {
+		return errors.New("[config] --confirm requires an interactive terminal(stdin)")
+	}
+
+	if conf.InMemory && (conf.StaleWhileRevalidate || conf.Frozen) {
+		return errors.New("[config] in-memory mode can not be used with --stale-while-revalidate/--frozen, they require persistence")
+	}
+
+	if conf.AutoRollback && (conf.RollbackWindow <= 0 || conf.RollbackFactor < 1 || conf.RollbackMinErrors < 1) {
+		return fmt.Errorf("[config] invalid auto-rollback settings: window %s(>0), factor %.1f(>=1), min errors %d(>=1)",
+			conf.RollbackWindow, conf.RollbackFactor, conf.RollbackMinErrors)
+	}
+
+	if conf.ProxyFwmark != 0 && conf.AutoFixMode == "ebpf" {
+		return errors.New("[config] --proxy-fwmark can not be used with the ebpf auto-fix mode, ebpf redirects all traffic of the nic")
+	}
+
+	if conf.CacheFile != "" {
+		if conf.InMemory {
+			return errors.New("[config] in-memory mode can not be used with --cache-file, clash does not persist its cache in that mode")
+		}
+		if err := checkCacheFile(conf.CacheFile); err != nil {
+			return err
+		}
+	}
+
+	if conf.RulesFile != "" {
+		bs, err := os.ReadFile(conf.RulesFile)
+		if err != nil {
+			return fmt.Errorf("[config] failed to read rules file: %w", err)
+		}
+		if err = checkRulesFile(bs); err != nil {
+			return err
+		}
+	}
+
+	switch conf.RulesPosition {
+	case "replace", "prepend", "append":
+	default:
+		return fmt.Errorf("[config] invalid rules position(replace/prepend/append): %s", conf.RulesPosition)
+	}
+
+	switch conf.ReloadBody {
+	case "path", "inline":
+	default:
+		return fmt.Errorf("[config] invalid reload body(path/inline): %s", conf.ReloadBody)
+	}
+
+	switch conf.OnDuplicate {
+	case "rename", "skip", "replace", "error":
+	default:
+		return fmt.Errorf("[config] invalid on-duplicate mode(rename/skip/replace/error): %s", conf.OnDuplicate)
+	}
+
+	if err := checkConfigBundle(); err != nil {
+		return err
+	}
+
+	switch conf.LanBindCheck {
+	case "warn", "fix", "strict", "off":
+	default:
+		return fmt.Errorf("[config] invalid lan bind check mode(warn/fix/strict/off): %s", conf.LanBindCheck)
+	}
+
+	if conf.ConfigOverrideDir != "" {
+		if fi, err := os.Stat(conf.ConfigOverrideDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("[config] config override dir is not a directory: %s", conf.ConfigOverrideDir)
+		}
+	}
+
+	if conf.AssetOverlay != "" {
+		if fi, err := os.Stat(conf.AssetOverlay); err != nil || !fi.IsDir() {
+			return fmt.Errorf("[config] asset overlay dir is not a directory: %s", conf.AssetOverlay)
+		}
+	}
+
+	if conf.MetricsTextfile != "" {
+		if fi, err := os.Stat(filepath.Dir(conf.MetricsTextfile)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("[config] metrics textfile dir does not exist: %s", filepath.Dir(conf.MetricsTextfile))
+		}
+		if conf.MetricsInterval <= 0 {
+			return fmt.Errorf("[config] metrics interval must be positive: %s", conf.MetricsInterval)
+		}
+	}
+
+	if conf.ReloadTriggerFile != "" {
+		if fi, err := os.Stat(filepath.Dir(conf.ReloadTriggerFile)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("[config] reload trigger file dir does not exist: %s", filepath.Dir(conf.ReloadTriggerFile))
+		}
+	}
+
+	if conf.ControlSocket != "" {
+		if fi, err := os.Stat(filepath.Dir(conf.ControlSocket)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("[config] control socket dir does not exist: %s", filepath.Dir(conf.ControlSocket))
+		}
+	}
+
+	if conf.TunMTU != 0 && (conf.TunMTU < 576 || conf.TunMTU > 9000) {
+		return fmt.Errorf("[config] invalid tun mtu(576-9000): %d", conf.TunMTU)
+	}
+
+	if conf.ClashInterface != "" {
+		if _, err := net.InterfaceByName(conf.ClashInterface); err != nil {
+			return fmt.Errorf("[config] clash interface %s not found: %w", conf.ClashInterface, err)
+		}
+	}
+
+	if conf.RestartOnLog != "" {
+		if _, err := regexp.Compile(conf.RestartOnLog); err != nil {
+			return fmt.Errorf("[config] invalid restart-on-log pattern: %w", err)
+		}
+		if conf.RestartOnLogCooldown <= 0 {
+			return fmt.Errorf("[config] restart-on-log cooldown must be positive: %s", conf.RestartOnLogCooldown)
+		}
+	}
+
+	if conf.FetchHostIP != "" && net.ParseIP(conf.FetchHostIP) == nil {
+		return fmt.Errorf("[config] invalid fetch host ip: %s", conf.FetchHostIP)
+	}
+	if conf.FetchResolver != "" {
+		host, _, err := net.SplitHostPort(fetchResolverAddr())
+		if err != nil || net.ParseIP(host) == nil {
+			return fmt.Errorf("[config] invalid fetch resolver(ip or ip:port): %s", conf.FetchResolver)
+		}
+	}
+
+	return nil
+}
+
+var (
+	managedConfigRegx  = regexp.MustCompile(`^#!MANAGED-CONFIG\s+\S+.*\binterval=(\d+)`)
+	updateIntervalRegx = regexp.MustCompile(`^#\s*profile-update-interval:\s*(\d+(?:\.\d+)?)`)
+)
+
+// parseProviderInterval parses the refresh interval recommended by the subscription provider.
+// The `profile-update-interval` header and comment marker are in hours, the
+// `#!MANAGED-CONFIG` marker is in seconds.
+func parseProviderInterval(header http.Header, c string) time.Duration {
+	if v := header.Get("profile-update-interval"); v != "" {
+		hours, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil && hours > 0 {
+			return time.Duration(hours * float64(time.Hour))
+		}
+		logrus.Warnf("[config] failed to parse profile-update-interval header: %s", v)
+	}
+
+	// markers are only recognized in the leading comment lines
+	for _, line := range strings.Split(c, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if ss := managedConfigRegx.FindStringSubmatch(line); ss != nil {
+			seconds, _ := strconv.Atoi(ss[1])
+			return time.Duration(seconds) * time.Second
+		}
+		if ss := updateIntervalRegx.FindStringSubmatch(line); ss != nil {
+			hours, _ := strconv.ParseFloat(ss[1], 64)
+			return time.Duration(hours * float64(time.Hour))
+		}
+	}
+
+	return 0
+}
+
+// checkInterval returns the effective remote config check interval, the interval
+// recommended by the provider is only used when --check-interval is not explicitly set.
+func checkInterval(providerInterval time.Duration) time.Duration {
+	if providerInterval <= 0 || conf.CheckIntervalFixed {
+		return conf.CheckInterval
+	}
+	if providerInterval < minProviderInterval {
+		return minProviderInterval
+	}
+	return providerInterval
 }
 
 func loadLocalConfig() (string, error) {
@@ -376,93 +1337,361 @@ func loadLocalConfig() (string, error) {
 	return string(bs), nil
 }
 
-func autoFix(c string) string {
+// autoFix renders the config template and patches the config according to the auto-fix mode,
+// in strict mode an error describing the required changes is returned instead.
+func autoFix(c string) (string, error) {
 	c = tplRendering(c)
 
-	if conf.AutoFixMode == "" {
-		return c
+	if conf.ConfigOverrideDir != "" {
+		var err error
+		if c, err = applyOverrides(c); err != nil {
+			return c, err
+		}
+	}
+
+	if conf.InMemory {
+		var err error
+		if c, err = disableClashPersistence(c); err != nil {
+			return c, err
+		}
 	}
 
-	logrus.Infof("[autofix] enable config auto fix...")
+	if conf.AutoFixMode == "" && len(conf.RoutePorts) == 0 && conf.ClashInterface == "" && conf.TunMTU == 0 &&
+		len(conf.GroupTestURLs) == 0 && len(conf.GroupTestIntervals) == 0 && !conf.CanonicalOutput && conf.LanBindCheck != "fix" {
+		return c, nil
+	}
 
 	var rootNode yaml.Node
 	if err := yaml.Unmarshal([]byte(c), &rootNode); err != nil {
 		logrus.Errorf("[autofix] failed to unmarshal yaml config: %v", err)
-		return c
+		return c, nil
 	}
 
+	if conf.AutoFixMode != "" {
+		logrus.Infof("[autofix] enable config auto fix...")
+		if !autoFixMode(&rootNode) {
+			return c, nil
+		}
+
+		if conf.AutoFixStrict {
+			bs, err := marshalYamlNode(&rootNode)
+			if err != nil {
+				return c, fmt.Errorf("[autofix] failed to marshal yaml config: %w", err)
+			}
+			diff, err := autoFixDiff(c, string(bs))
+			if err != nil {
+				return c, err
+			}
+			if diff != "" {
+				return c, fmt.Errorf("[autofix] strict mode: the config is not clean, apply the following changes to the source config:\n%s", diff)
+			}
+		}
+	}
+
+	if len(conf.RoutePorts) > 0 {
+		if err := autoFixRoutePorts(&rootNode); err != nil {
+			return c, err
+		}
+	}
+
+	if conf.ClashInterface != "" {
+		autoFixInterface(&rootNode)
+	}
+
+	if conf.LanBindCheck == "fix" {
+		autoFixLanBind(&rootNode)
+	}
+
+	if len(conf.GroupTestURLs) > 0 || len(conf.GroupTestIntervals) > 0 {
+		if err := autoFixGroupTests(&rootNode); err != nil {
+			return c, err
+		}
+	}
+
+	// sort last, so that the injected rules are sorted as well
+	if conf.CanonicalOutput {
+		canonicalizeConfig(&rootNode)
+	}
+
+	if conf.TunMTU > 0 {
+		var mtuNode yaml.Node
+		_ = yaml.Unmarshal([]byte(fmt.Sprintf("mtu: %d\n", conf.TunMTU)), &mtuNode)
+		if !setYamlNode(&rootNode, "tun.mtu", mtuNode.Content[0]) {
+			logrus.Error("[autofix] failed to patch tun.mtu config")
+		}
+	}
+
+	bs, err := marshalYamlNode(&rootNode)
+	if err != nil {
+		logrus.Errorf("[autofix] failed to marshal yaml config: %v", err)
+		return c, nil
+	}
+
+	return string(bs), nil
+}
+
+// autoFixMode patches the config according to the auto-fix mode(tun/ebpf)
+func autoFixMode(rootNode *yaml.Node) bool {
 	var bindAddressNode yaml.Node
 	_ = yaml.Unmarshal([]byte(tplRendering(bindAddressPatch)), &bindAddressNode)
-	if !setYamlNode(&rootNode, "bind-address", bindAddressNode.Content[0]) {
+	if !setYamlNode(rootNode, "bind-address", bindAddressNode.Content[0]) {
 		logrus.Error("[autofix] failed to patch bind-address config")
-		return c
+		return false
 	}
 
+	// keep the clash api on loopback, external access goes through the api proxy
+	ecPatch := externalControllerPatch
+	if conf.APIProxyAddr != "" {
+		ecPatch = loopbackExternalControllerPatch
+	}
 	var externalControllerNode yaml.Node
-	_ = yaml.Unmarshal([]byte(tplRendering(externalControllerPatch)), &externalControllerNode)
-	if !setYamlNode(&rootNode, "external-controller", externalControllerNode.Content[0]) {
+	_ = yaml.Unmarshal([]byte(tplRendering(ecPatch)), &externalControllerNode)
+	if !setYamlNode(rootNode, "external-controller", externalControllerNode.Content[0]) {
 		logrus.Error("[autofix] failed to patch external-controller config")
-		return c
+		return false
 	}
 
 	var secretNode yaml.Node
 	_ = yaml.Unmarshal([]byte(tplRendering(secretPatch)), &secretNode)
-	if !setYamlNode(&rootNode, "secret", secretNode.Content[0]) {
+	if !setYamlNode(rootNode, "secret", secretNode.Content[0]) {
 		logrus.Error("[autofix] failed to patch secret config")
-		return c
+		return false
 	}
 
 	var nicNode yaml.Node
 	_ = yaml.Unmarshal([]byte(tplRendering(nicPatch)), &nicNode)
-	if !setYamlNode(&rootNode, "interface-name", nicNode.Content[0]) {
+	if !setYamlNode(rootNode, "interface-name", nicNode.Content[0]) {
 		logrus.Error("[autofix] failed to patch nic config")
-		return c
+		return false
 	}
 
 	var dnsNode yaml.Node
 	_ = yaml.Unmarshal([]byte(tplRendering(dnsPatch)), &dnsNode)
-	if !setYamlNode(&rootNode, "dns", dnsNode.Content[0]) {
+	if !setYamlNode(rootNode, "dns", dnsNode.Content[0]) {
 		logrus.Error("[autofix] failed to patch dns config")
-		return c
+		return false
 	}
 
 	if conf.AutoFixMode == "ebpf" {
 		var tunNode yaml.Node
 		_ = yaml.Unmarshal([]byte(tplRendering(tunEBPFPatch)), &tunNode)
-		if !setYamlNode(&rootNode, "tun", tunNode.Content[0]) {
+		if !setYamlNode(rootNode, "tun", tunNode.Content[0]) {
 			logrus.Error("[autofix] failed to patch tun config")
-			return c
+			return false
 		}
 
 		var ebpfNode yaml.Node
 		_ = yaml.Unmarshal([]byte(tplRendering(ebpfPatch)), &ebpfNode)
-		if !setYamlNode(&rootNode, "ebpf", ebpfNode.Content[0]) {
+		if !setYamlNode(rootNode, "ebpf", ebpfNode.Content[0]) {
 			logrus.Error("[autofix] failed to patch ebpf config")
-			return c
+			return false
 		}
 
 		var routingMarkNode yaml.Node
 		_ = yaml.Unmarshal([]byte(tplRendering(routingMarkPatch)), &routingMarkNode)
-		if !setYamlNode(&rootNode, "routing-mark", routingMarkNode.Content[0]) {
+		if !setYamlNode(rootNode, "routing-mark", routingMarkNode.Content[0]) {
 			logrus.Error("[autofix] failed to patch routing-mark config")
-			return c
+			return false
 		}
 	} else {
+		// only the marked packets are routed to the tun(--proxy-fwmark), clash must not own the routing
+		tunPatch := tunStandardPatch
+		if conf.ProxyFwmark != 0 {
+			tunPatch = tunFwmarkPatch
+		}
 		var tunNode yaml.Node
-		_ = yaml.Unmarshal([]byte(tplRendering(tunStandardPatch)), &tunNode)
-		if !setYamlNode(&rootNode, "tun", tunNode.Content[0]) {
+		_ = yaml.Unmarshal([]byte(tplRendering(tunPatch)), &tunNode)
+		if !setYamlNode(rootNode, "tun", tunNode.Content[0]) {
 			logrus.Error("[autofix] failed to patch tun config")
-			return c
+			return false
 		}
 	}
 
-	bs, err := yaml.Marshal(&rootNode)
+	return true
+}
+
+// autoFixRoutePorts prepends the DST-PORT rules of --route-port to the config rules,
+// existing identical rules are removed first so that it can be applied repeatedly.
+func autoFixRoutePorts(rootNode *yaml.Node) error {
+	routes, err := parseRoutePorts()
 	if err != nil {
-		logrus.Errorf("[autofix] failed to marshal yaml config: %v", err)
-		return c
+		return err
 	}
 
-	return string(bs)
+	doc := rootNode
+	if doc.Kind == yaml.DocumentNode {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return errors.New("[autofix] failed to patch rules: config root is not a mapping")
+	}
+
+	var rulesNode *yaml.Node
+	for i := 0; i < len(doc.Content)-1; i += 2 {
+		if doc.Content[i].Value == "rules" {
+			rulesNode = doc.Content[i+1]
+			break
+		}
+	}
+	if rulesNode == nil {
+		rulesNode = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "rules"}, rulesNode)
+	}
+	if rulesNode.Kind != yaml.SequenceNode {
+		return errors.New("[autofix] failed to patch rules: rules is not a list")
+	}
+
+	var prepend []*yaml.Node
+	injected := map[string]bool{}
+	for _, r := range routes {
+		rule := fmt.Sprintf("DST-PORT,%d,%s", r.Port, r.Group)
+		injected[rule] = true
+		prepend = append(prepend, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: rule})
+		logrus.Debugf("[autofix] route port %d to %s", r.Port, r.Group)
+	}
+	for _, n := range rulesNode.Content {
+		if !injected[n.Value] {
+			prepend = append(prepend, n)
+		}
+	}
+	rulesNode.Content = prepend
+
+	return nil
+}
+
+// autoFixGroupTests applies the test url and interval overrides to the proxy groups, missing
+// groups are left to the config validation.
+func autoFixGroupTests(rootNode *yaml.Node) error {
+	overrides, err := parseGroupTestOverrides()
+	if err != nil {
+		return err
+	}
+	if len(rootNode.Content) == 0 {
+		return nil
+	}
+
+	groups := yamlMapValue(rootNode.Content[0], "proxy-groups")
+	if groups == nil || groups.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, o := range overrides {
+		for _, g := range groups.Content {
+			if name := yamlMapValue(g, "name"); name == nil || name.Value != o.Group {
+				continue
+			}
+			patch := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			if o.URL != "" {
+				patch.Content = append(patch.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "url"},
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: o.URL})
+				logrus.Debugf("[autofix] group %s test url: %s", o.Group, o.URL)
+			}
+			if o.Interval > 0 {
+				patch.Content = append(patch.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "interval"},
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(int(o.Interval / time.Second))})
+				logrus.Debugf("[autofix] group %s test interval: %s", o.Group, o.Interval)
+			}
+			mergeYamlNode(g, patch)
+		}
+	}
+	return nil
+}
+
+// autoFixInterface binds the clash outbound to the given interface(--clash-interface),
+// it overrides the nic detected by the auto-fix mode.
+func autoFixInterface(rootNode *yaml.Node) {
+	if !coreSupportsInterfaceName() {
+		logrus.Warnf("[autofix] clash core does not support interface-name, skip binding to %s", conf.ClashInterface)
+		return
+	}
+
+	var nicNode yaml.Node
+	_ = yaml.Unmarshal([]byte(fmt.Sprintf("interface-name: %s\n", conf.ClashInterface)), &nicNode)
+	if !setYamlNode(rootNode, "interface-name", nicNode.Content[0]) {
+		logrus.Error("[autofix] failed to patch interface-name config")
+	}
+}
+
+var coreInterfaceNameOnce = sync.OnceValue(func() bool {
+	ver, err := ProbeCoreBinary(filepath.Join(conf.ClashHome, InternalClashBinName))
+	if err != nil {
+		// the embedded core is clash meta, assume it is used if the binary can not be probed
+		logrus.Debugf("[autofix] failed to probe clash core: %v", err)
+		return true
+	}
+	ver = strings.ToLower(ver)
+	return strings.Contains(ver, "meta") || strings.Contains(ver, "mihomo")
+})
+
+// coreSupportsInterfaceName checks whether the clash core supports interface-name(clash meta)
+func coreSupportsInterfaceName() bool {
+	return coreInterfaceNameOnce()
+}
+
+// autoFixDiff compares the top-level keys of the source and the fixed config, and
+// returns the changes made by autoFix in a diff-like format.
+func autoFixDiff(origin, fixed string) (string, error) {
+	var o, f map[string]any
+	if err := yaml.Unmarshal([]byte(origin), &o); err != nil {
+		return "", fmt.Errorf("[autofix] failed to unmarshal source config: %w", err)
+	}
+	if err := yaml.Unmarshal([]byte(fixed), &f); err != nil {
+		return "", fmt.Errorf("[autofix] failed to unmarshal fixed config: %w", err)
+	}
+
+	var keys []string
+	for k := range o {
+		keys = append(keys, k)
+	}
+	for k := range f {
+		if _, ok := o[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf strings.Builder
+	for _, k := range keys {
+		ov, ook := o[k]
+		fv, fok := f[k]
+		if ook == fok && reflect.DeepEqual(ov, fv) {
+			continue
+		}
+
+		buf.WriteString(fmt.Sprintf("@@ %s @@\n", k))
+		if ook {
+			bs, _ := yaml.Marshal(map[string]any{k: ov})
+			for _, line := range strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n") {
+				buf.WriteString("-" + line + "\n")
+			}
+		}
+		if fok {
+			bs, _ := yaml.Marshal(map[string]any{k: fv})
+			for _, line := range strings.Split(strings.TrimSuffix(string(bs), "\n"), "\n") {
+				buf.WriteString("+" + line + "\n")
+			}
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// checkAutoFixIdempotent runs autoFix again on its own output, a second pass must not
+// change the config any further, otherwise autoFix has a bug.
+func checkAutoFixIdempotent(fixed string) error {
+	again, err := autoFix(fixed)
+	if err != nil {
+		return fmt.Errorf("[autofix] second pass failed on the fixed config: %w", err)
+	}
+	diff, err := autoFixDiff(fixed, again)
+	if err != nil {
+		return err
+	}
+	if diff != "" {
+		return fmt.Errorf("[autofix] not idempotent, a second pass changed the fixed config:\n%s", diff)
+	}
+	return nil
 }
 
 func setYamlNode(node *yaml.Node, key string, value *yaml.Node) bool {
@@ -479,7 +1708,7 @@ func setYamlNode(node *yaml.Node, key string, value *yaml.Node) bool {
 				if len(keys) == 2 {
 					return setYamlNode(node.Content[i+1], keys[1], value)
 				} else {
-					node.Content[i+1] = value.Content[1]
+					node.Content[i+1] = keepYamlAnchor(node.Content[i+1], value.Content[1])
 					return true
 				}
 			}
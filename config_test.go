@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCoalesceUpdates(t *testing.T) {
+	// the watcher queues the changes of all sources while a reload is in flight, each update
+	// carries the full latest state so only the last one must be applied
+	updateCh := make(chan string, 3)
+	first := "remote-1"
+	for i, u := range []string{"override-1", "local-1", "remote-2"} {
+		updateCh <- fmt.Sprintf("%s(%d)", u, i)
+	}
+
+	got, ok := coalesceUpdates(updateCh, first)
+	if !ok {
+		t.Fatal("unexpected closed update chan")
+	}
+	if got != "remote-2(2)" {
+		t.Fatalf("expected the last update to be applied, got %s", got)
+	}
+	if len(updateCh) != 0 {
+		t.Fatalf("%d updates left in the chan", len(updateCh))
+	}
+
+	// nothing queued, the update is applied as is
+	if got, ok = coalesceUpdates(updateCh, "local-2"); !ok || got != "local-2" {
+		t.Fatalf("unexpected update: %s %v", got, ok)
+	}
+
+	close(updateCh)
+	if _, ok = coalesceUpdates(updateCh, "remote-3"); ok {
+		t.Fatal("expected the closed update chan to stop the reload loop")
+	}
+}
+
+func TestCoalesceUpdatesBurst(t *testing.T) {
+	updateCh := make(chan string, 3)
+	applied := make(chan string, 100)
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	// the first reload is held in flight until the burst has been queued
+	go func() {
+		defer close(done)
+		autoReload(updateCh, func(ccStr string) error {
+			applied <- ccStr
+			if ccStr == "update-0" {
+				<-release
+			}
+			return nil
+		})
+	}()
+
+	updateCh <- "update-0"
+	if got := <-applied; got != "update-0" {
+		t.Fatalf("expected the first update to be applied, got %s", got)
+	}
+	const burst = 3
+	for i := 1; i <= burst; i++ {
+		updateCh <- fmt.Sprintf("update-%d", i)
+	}
+	close(release)
+
+	select {
+	case got := <-applied:
+		if got != fmt.Sprintf("update-%d", burst) {
+			t.Fatalf("expected the burst to be coalesced into the last update, got %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the burst was not applied")
+	}
+	close(updateCh)
+	<-done
+	if n := len(applied); n != 0 {
+		t.Fatalf("expected the burst to be coalesced into one reload, got %d more", n)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProxyPlanner is implemented by proxy modes that can describe the network changes of
+// EnableProxy before they are applied(--confirm).
+type ProxyPlanner interface {
+	Plan() []string
+}
+
+// isTerminal reports whether the fd is a terminal
+func isTerminal(fd int) bool {
+	_, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	return err == nil
+}
+
+// ConfirmProxy prints the changes EnableProxy is going to make and waits for the user to
+// confirm them on the terminal, false is returned if they were not confirmed.
+func ConfirmProxy(mode ProxyMode) (bool, error) {
+	if !isTerminal(int(os.Stdin.Fd())) {
+		return false, errors.New("[confirm] --confirm requires an interactive terminal")
+	}
+
+	w := os.Stderr
+	_, _ = fmt.Fprintln(w, "\nThe transparent proxy is going to apply the following changes:")
+	if p, ok := mode.(ProxyPlanner); ok {
+		for _, s := range p.Plan() {
+			_, _ = fmt.Fprintf(w, "  - %s\n", strings.ReplaceAll(s, "\n", "\n    "))
+		}
+	} else {
+		_, _ = fmt.Fprintf(w, "  - (proxy mode %s does not describe its changes)\n", conf.ProxyMode)
+	}
+
+	client, _ := sshSession()
+	if client != nil && conf.SSHSafe {
+		_, _ = fmt.Fprintf(w, "\nConnected over ssh from %s, the following bypass keeps the session out of the proxy:\n", client)
+		for _, r := range sshBypassRules() {
+			_, _ = fmt.Fprintf(w, "  - ip rule %s\n", r)
+		}
+	} else if client != nil {
+		_, _ = fmt.Fprintf(w, "\n!!! WARNING: you are connected over ssh from %s and no bypass for this connection will be installed(--ssh-safe=false).\n", client)
+		_, _ = fmt.Fprintln(w, "!!! If the changes route the ssh replies into the proxy, this session will be DROPPED and you may be locked out of the host.")
+	} else {
+		_, _ = fmt.Fprintln(w, "\nNo ssh session detected(SSH_CONNECTION is not set), no ssh bypass will be installed.")
+	}
+
+	_, _ = fmt.Fprint(w, "\nApply these changes? Type 'yes' to continue: ")
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false, fmt.Errorf("[confirm] failed to read the answer: %w", err)
+	}
+	return strings.TrimSpace(answer) == "yes", nil
+}
@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 const logo = `
 ████████╗██████╗  ██████╗██╗      █████╗ ███████╗██╗  ██╗
 ╚══██╔══╝██╔══██╗██╔════╝██║     ██╔══██╗██╔════╝██║  ██║
@@ -18,19 +20,134 @@ const (
 
 const (
 	ChainDockerUser = "DOCKER-USER" // https://docs.docker.com/network/packet-filtering-firewalls/#docker-on-a-router
+
+	ruleCommentPrefix = "tpclash:"
 )
 
 const (
 	InternalClashBinName = "xclash"
 	InternalConfigName   = "xclash.yaml"
+
+	InternalRemoteCacheName = "xclash.remote.yaml"
+	InternalBundleCacheName = "xclash.bundle.tar"
+
+	clashCacheName     = "cache.db"
+	extractMarkerName  = ".extract-version"
+	validateCacheName  = ".validate-cache"
+	coreTestConfigName = ".xclash.test.yaml"
+
+	// dockerMigrationMarkerName marks that the untagged DOCKER-USER rules of earlier versions are removed
+	dockerMigrationMarkerName = ".docker-user-migrated"
+)
+
+// bundleMaxSize bounds the size of a --config-bundle, including the geo databases
+const bundleMaxSize = 256 << 20
+
+// bundleStagePrefix names the dirs the assets of a bundle are staged in
+const bundleStagePrefix = ".tpclash-bundle-"
+
+const stateManifestName = "tpclash-state.json"
+
+const (
+	instanceLockDir         = "/run"
+	instanceTakeoverTimeout = time.Minute
+)
+
+const interfaceChangeDebounce = 3 * time.Second
+
+const overrideChangeDebounce = 500 * time.Millisecond
+
+const triggerFileDebounce = 500 * time.Millisecond
+
+// scheduleLookback bounds the search for the previous and the next --schedule boundary
+const scheduleLookback = 366 * 24 * time.Hour
+
+const NotrackTableName = "tpclash_notrack"
+
+const MSSTableName = "tpclash_mss"
+
+// --proxy-fwmark routes the marked packets to the clash tun through its own routing table
+const (
+	fwmarkRouteTable   = 2468
+	fwmarkRulePriority = 8900
+	tunDeviceWait      = 10 * time.Second
+)
+
+// sshBypassRulePriority is ahead of the rules of --proxy-fwmark and the clash tun(auto-route)
+const sshBypassRulePriority = 8800
+
+// clashTunRouteTable is the routing table of the clash tun(auto-route) unless it is set by
+// tun.iproute2-table-index
+const clashTunRouteTable = 2022
+
+// apiBypassRulePriority is ahead of the rules of --proxy-fwmark and the clash tun(auto-route)
+const apiBypassRulePriority = 8810
+
+const (
+	coreBackupName        = ".xclash.good"
+	coreBinarySettleDelay = 3 * time.Second
+	coreStopTimeout       = 5 * time.Second
+)
+
+// clashOutputQueue is the number of clash output writes queued for the stdout/stderr of tpclash,
+// writes are dropped while the queue is full
+const clashOutputQueue = 1024
+
+// restartOnLogMaxLine bounds the partial line buffered by --restart-on-log
+const restartOnLogMaxLine = 64 << 10
+
+const (
+	controlRequestTimeout = time.Minute
+	controlRequestMaxSize = 64 << 10
 )
 
+const otelExportTimeout = 5 * time.Second
+
+const (
+	diagnosticsDirName = "diagnostics"
+	diagnosticsKeep    = 10
+	diagnosticsLogSize = 256 << 10
+	diagnosticsTimeout = 3 * time.Second
+)
+
+// dnsLeakTestServers are public dns servers queried directly by test-dns, the
+// queries must be hijacked by clash as well
+var dnsLeakTestServers = []string{"8.8.8.8:53", "1.1.1.1:53", "223.5.5.5:53"}
+
+const (
+	healthCheckURL         = "https://www.gstatic.com/generate_204"
+	healthCheckTimeout     = 4 * time.Second
+	healthCheckConcurrency = 16
+)
+
+const (
+	resolveTimeout     = 3 * time.Second
+	resolveConcurrency = 32
+)
+
+const (
+	probeIntervalMax = 5 * time.Second
+	startupLogSize   = 16 << 10
+	startupLogLines  = 20
+)
+
+const (
+	frozenMarkerName    = ".frozen"
+	freezeCheckInterval = 5 * time.Second
+)
+
+// minProviderInterval is the lower bound of the check interval recommended by the subscription provider
+const minProviderInterval = 5 * time.Minute
+
 const (
 	bindAddressPatch = `# TPClash Common Config AutoFix
 bind-address: '*'
 `
 	externalControllerPatch = `# TPClash Common Config AutoFix
 external-controller: 0.0.0.0:9090
+`
+	loopbackExternalControllerPatch = `# TPClash Common Config AutoFix
+external-controller: 127.0.0.1:9090
 `
 	secretPatch = `# TPClash Common Config AutoFix
 secret: tpclash
@@ -43,6 +160,15 @@ tun:
     - any:53
   auto-route: true
   auto-redir: true
+`
+	tunFwmarkPatch = `# TPClash TUN fwmark AutoFix
+tun:
+  enable: true
+  stack: system
+  dns-hijack:
+    - any:53
+  auto-route: false
+  auto-redir: false
 `
 	tunEBPFPatch = `# TPClash TUN eBPF AutoFix
 tun:
@@ -90,6 +216,7 @@ After=network.target
 Type=simple
 User=root
 Restart=on-failure
+EnvironmentFile=-%s
 ExecStart=/usr/local/bin/tpclash%s
 
 RestartSec=10s
@@ -99,9 +226,37 @@ TimeoutStopSec=30s
 WantedBy=multi-user.target
 `
 
+// serviceUnitTpl is the unit generated by install-service, the [Service] section is filled in
+// according to the flags.
+const serviceUnitTpl = `[Unit]
+Description=Transparent proxy tool for Clash
+Documentation=https://github.com/mritd/tpclash
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+%s
+EnvironmentFile=-%s
+ExecStart=%s%s
+Restart=on-failure
+RestartSec=10s
+TimeoutStopSec=%d
+
+[Install]
+WantedBy=%s
+`
+
+// serviceCapabilities are the capabilities tpclash and clash need to set up the proxy
+const serviceCapabilities = "CAP_NET_ADMIN CAP_NET_BIND_SERVICE CAP_NET_RAW"
+
 const (
 	installDir = "/usr/local/bin"
 	systemdDir = "/etc/systemd/system"
+
+	// serviceEnvName is the EnvironmentFile of the systemd service in the home dir, it holds
+	// the secret flags that must not be written to the world-readable unit
+	serviceEnvName = "tpclash.env"
 )
 
 const (
@@ -148,6 +303,9 @@ const (
 	githubLatestApi   = "https://api.github.com/repos/mritd/tpclash/releases/latest"
 	githubUpgradeAddr = "https://github.com/mritd/tpclash/releases/download/v%s/%s"
 	ghProxyAddr       = "https://ghproxy.com/"
+
+	// upgradeSignatureTimeout bounds the download of the minisign signature(--verify-key)
+	upgradeSignatureTimeout = 30 * time.Second
 )
 
 const upgradedMessage = logo + `  👌 TPClash 已升级完成, 请重新启动以应用更改
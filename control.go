@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// ControlRequest is the single json line a client sends on a connection of the control
+// socket(--control-socket), e.g. {"command":"reload"}
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+// ControlResponse is the single json line replied to a ControlRequest, the connection is
+// closed afterwards
+type ControlResponse struct {
+	OK      bool           `json:"ok"`
+	Message string         `json:"message,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Status  *ControlStatus `json:"status,omitempty"`
+}
+
+// ControlStatus is the state of the running instance returned by the status command
+type ControlStatus struct {
+	ServiceStatus
+	PID               int    `json:"pid"`
+	Version           string `json:"version"`
+	Paused            bool   `json:"paused"`
+	Frozen            bool   `json:"frozen"`
+	HeldUpdates       int    `json:"held_updates"`
+	ListenAddress     string `json:"listen_address,omitempty"`
+	Generation        int64  `json:"generation"`
+	RollbackAvailable bool   `json:"rollback_available"`
+}
+
+// controlReloadCh triggers a forced fetch and reload of the config watcher(reload command)
+var controlReloadCh = make(chan struct{}, 1)
+
+// proxyPaused is set while the proxy rules of tpclash are torn down by the pause command, clash
+// and the routes of its tun(auto-route/ebpf) keep running
+var proxyPaused atomic.Bool
+
+const proxyPausedReason = "proxy paused via control socket"
+
+type controlServer struct {
+	// mu serializes pause and resume
+	mu        sync.Mutex
+	proxy     ProxyMode
+	writePath string
+}
+
+// ServeControlSocket serves the control api on the unix socket, the socket is only accessible
+// by its owner(0600). It is removed when ctx is done.
+func ServeControlSocket(ctx context.Context, path string, proxy ProxyMode, writePath string) error {
+	// the socket is created in a private(0700) dir and moved into place once it is 0600, so
+	// that it is never reachable with the permissions of the umask
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".tpclash-control-")
+	if err != nil {
+		return fmt.Errorf("[control] failed to create control socket dir: %w", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	tmp := filepath.Join(dir, "control.sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return fmt.Errorf("[control] failed to listen %s: %w", path, err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, 0600); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("[control] failed to chmod %s: %w", path, err)
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		_ = ln.Close()
+		return fmt.Errorf("[control] failed to move control socket to %s: %w", path, err)
+	}
+
+	s := &controlServer{proxy: proxy, writePath: writePath}
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+		_ = os.Remove(path)
+	}()
+	go func() {
+		logrus.Infof("[control] control socket listening on %s", path)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logrus.Errorf("[control] control socket stopped: %v", err)
+				}
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return nil
+}
+
+func (s *controlServer) serve(c net.Conn) {
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(controlRequestTimeout))
+
+	var req ControlRequest
+	if err := json.NewDecoder(io.LimitReader(c, controlRequestMaxSize)).Decode(&req); err != nil {
+		_ = json.NewEncoder(c).Encode(&ControlResponse{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	resp, err := s.handle(req.Command)
+	if err != nil {
+		logrus.Errorf("[control] %s failed: %v", req.Command, err)
+		resp = &ControlResponse{Error: err.Error()}
+	} else {
+		resp.OK = true
+	}
+	_ = json.NewEncoder(c).Encode(resp)
+}
+
+func (s *controlServer) handle(command string) (*ControlResponse, error) {
+	switch command {
+	case "status":
+		return &ControlResponse{Status: controlStatus()}, nil
+	case "reload":
+		logrus.Info("[control] reload triggered via control socket")
+		select {
+		case controlReloadCh <- struct{}{}:
+		default:
+		}
+		return &ControlResponse{Message: "reload triggered, the config is fetched and applied in the background"}, nil
+	case "pause":
+		return s.pause()
+	case "resume":
+		return s.resume()
+	case "freeze":
+		if err := Freeze(); err != nil {
+			return nil, err
+		}
+		logrus.Info("[control] config frozen via control socket")
+		return &ControlResponse{Message: "config frozen, updates will be held until unfreeze"}, nil
+	case "unfreeze":
+		if err := Unfreeze(); err != nil {
+			return nil, err
+		}
+		logrus.Info("[control] config unfrozen via control socket")
+		return &ControlResponse{Message: "config unfrozen, held updates will be applied shortly"}, nil
+	case "rollback":
+		return s.rollback()
+	default:
+		return nil, fmt.Errorf("unknown command: %q", command)
+	}
+}
+
+func (s *controlServer) pause() (*ControlResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if proxyPaused.Load() {
+		return &ControlResponse{Message: "proxy is already paused"}, nil
+	}
+	if err := s.proxy.DisableProxy(); err != nil {
+		return nil, fmt.Errorf("failed to disable proxy: %w", err)
+	}
+	proxyPaused.Store(true)
+	setServiceState(StateDegraded, proxyPausedReason)
+
+	msg := "proxy rules of tpclash removed, clash keeps running"
+	// the routes of the clash tun belong to clash, they stay in place until clash stops
+	if cc := currentClashConf.Load(); cc != nil && cc.Tun.Enable && (cc.Tun.AutoRoute || len(cc.Ebpf.RedirectToTun) > 0) {
+		msg += ", the clash tun(auto-route/ebpf) still routes the traffic through clash"
+	}
+	logrus.Warnf("[control] %s", msg)
+	return &ControlResponse{Message: msg}, nil
+}
+
+func (s *controlServer) resume() (*ControlResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !proxyPaused.Load() {
+		return &ControlResponse{Message: "proxy is not paused"}, nil
+	}
+	// other tools may have been started while the proxy was paused
+	if err := CheckProxyConflicts(); err != nil {
+		return nil, err
+	}
+	if err := s.proxy.EnableProxy(); err != nil {
+		setServiceState(StateDegraded, fmt.Sprintf("failed to enable proxy: %v", err))
+		return nil, fmt.Errorf("failed to enable proxy: %w", err)
+	}
+	proxyPaused.Store(false)
+	setServiceState(StateReady, "")
+	logrus.Info("[control] proxy resumed via control socket")
+	return &ControlResponse{Message: "proxy resumed"}, nil
+}
+
+func (s *controlServer) rollback() (*ControlResponse, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	previous := previousConfig.Load()
+	if previous == nil {
+		return nil, errors.New("no previous config to roll back to")
+	}
+	logrus.Warn("[control] rolling back to the previous config via control socket...")
+	if err := rollbackConfig(*previous, s.writePath); err != nil {
+		DesktopNotify("TPClash rollback failed", "%v", err)
+		return nil, fmt.Errorf("failed to roll back clash config: %w", err)
+	}
+	metricRollbacks.Add(1)
+	reloadGeneration.Add(1)
+	logrus.Warn("[control] previous clash config restored, the new config stays inactive until it changes again")
+	DesktopNotify("TPClash config rolled back", "previous clash config restored via control socket")
+	return &ControlResponse{Message: "previous config restored, the replaced config stays inactive until it changes again"}, nil
+}
+
+func controlStatus() *ControlStatus {
+	serviceStatusMu.Lock()
+	st := ControlStatus{ServiceStatus: serviceStatus}
+	serviceStatusMu.Unlock()
+
+	st.PID = os.Getpid()
+	st.Version = version
+	st.Paused = proxyPaused.Load()
+	st.Frozen = IsFrozen()
+	st.HeldUpdates = int(heldUpdates.Load())
+	if cc := currentClashConf.Load(); cc != nil {
+		st.ListenAddress = clashListenAddress(cc)
+	}
+	st.Generation = reloadGeneration.Load()
+	st.RollbackAvailable = previousConfig.Load() != nil
+	return &st
+}
+
+// SendControl sends the command to the control socket of the running instance
+func SendControl(path, command string) (*ControlResponse, error) {
+	c, err := net.DialTimeout("unix", path, controlRequestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("[control] failed to connect %s: %w", path, err)
+	}
+	defer func() { _ = c.Close() }()
+	_ = c.SetDeadline(time.Now().Add(controlRequestTimeout))
+
+	if err = json.NewEncoder(c).Encode(&ControlRequest{Command: command}); err != nil {
+		return nil, fmt.Errorf("[control] failed to send %s: %w", command, err)
+	}
+	var resp ControlResponse
+	if err = json.NewDecoder(c).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("[control] failed to read %s response: %w", command, err)
+	}
+	if !resp.OK {
+		return &resp, fmt.Errorf("[control] %s failed: %s", command, resp.Error)
+	}
+	return &resp, nil
+}
+
+// controlCmd builds a subcommand that sends the command to --control-socket
+func controlCmd(command, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   command,
+		Short: short,
+		Run: func(cmd *cobra.Command, args []string) {
+			if conf.ControlSocket == "" {
+				logrus.Fatalf("[control] %s requires the control socket of the running instance(--control-socket)", command)
+			}
+			resp, err := SendControl(conf.ControlSocket, command)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			if resp.Status != nil {
+				bs, _ := json.MarshalIndent(resp.Status, "", "  ")
+				fmt.Println(string(bs))
+				return
+			}
+			logrus.Infof("[control] %s", resp.Message)
+		},
+	}
+}
+
+var (
+	reloadCmd   = controlCmd("reload", "Fetch and reload the config of the running instance")
+	pauseCmd    = controlCmd("pause", "Remove the proxy rules of the running instance, clash and its tun routes keep running")
+	resumeCmd   = controlCmd("resume", "Set up the proxy rules paused by pause again")
+	statusCmd   = controlCmd("status", "Print the state of the running instance")
+	rollbackCmd = controlCmd("rollback", "Restore the config replaced by the last reload of the running instance")
+)
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// ClashCore supervises the clash child process, so that it can be restarted(e.g. after
+// the core binary is replaced) without restarting tpclash.
+type ClashCore struct {
+	bin  string
+	args []string
+
+	// PreStart is called before each start, e.g. to refresh the config clash is started with
+	PreStart func() error
+	// OnCrash is called after the clash process exited unexpectedly
+	OnCrash func(err error)
+	// Output receives a copy of the clash stdout/stderr
+	Output io.Writer
+	// Nice and IOPrio are the scheduling priorities of the clash process, 0 inherits them
+	Nice   int
+	IOPrio int
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	done    chan struct{}
+	stopped *exec.Cmd
+}
+
+func NewClashCore(bin string, args ...string) *ClashCore {
+	return &ClashCore{bin: bin, args: args}
+}
+
+// Start starts the clash process, an unexpected exit is logged and notified
+func (c *ClashCore) Start() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.PreStart != nil {
+		if err := c.PreStart(); err != nil {
+			return fmt.Errorf("[core] failed to prepare clash process: %w", err)
+		}
+	}
+
+	// clash writes to a pipe that is drained until it exits, so that a closed, failing or
+	// blocked stdout/stderr of tpclash never makes clash fail with EPIPE/SIGPIPE or stall
+	cmd := exec.Command(c.bin, c.args...)
+	cmd.Stdout = drainWriter{clashStdout(), c.Output}
+	cmd.Stderr = drainWriter{clashStderr(), c.Output}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		AmbientCaps: []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW},
+	}
+	logrus.Infof("[core] running cmds: %v", cmd.Args)
+
+	if err := startWithPriority(cmd, c.Nice, c.IOPrio); err != nil {
+		return fmt.Errorf("[core] failed to start clash process: %v: %v", err, cmd.Args)
+	}
+	if c.Nice != 0 || c.IOPrio != 0 {
+		logrus.Infof("[core] clash process(pid %d) started with nice %d, io priority %s", cmd.Process.Pid, c.Nice, ioniceString(c.IOPrio))
+	}
+
+	done := make(chan struct{})
+	c.cmd, c.done = cmd, done
+	go func() {
+		err := cmd.Wait()
+		c.mu.Lock()
+		stopping := c.stopped == cmd
+		c.mu.Unlock()
+		if !stopping {
+			logrus.Errorf("[core] clash process exited unexpectedly: %v", err)
+			DesktopNotify("TPClash clash crashed", "clash process exited unexpectedly: %v", err)
+			if c.OnCrash != nil {
+				c.OnCrash(err)
+			}
+		}
+		close(done)
+	}()
+
+	return nil
+}
+
+// drainWriter writes to all non-nil writers and never fails, unlike io.MultiWriter it keeps
+// writing to the others after an error and always reports the whole write as successful.
+type drainWriter []io.Writer
+
+func (dw drainWriter) Write(p []byte) (int, error) {
+	for _, w := range dw {
+		if w != nil {
+			_, _ = w.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// nonBlockingWriter queues the writes for a goroutine writing them to the underlying writer, so
+// that a blocked writer(e.g. a pipe nobody reads) never blocks the caller. Writes are dropped
+// while the queue is full.
+type nonBlockingWriter struct {
+	ch chan []byte
+}
+
+func newNonBlockingWriter(w io.Writer, queue int) *nonBlockingWriter {
+	nw := &nonBlockingWriter{ch: make(chan []byte, queue)}
+	go func() {
+		for p := range nw.ch {
+			_, _ = w.Write(p)
+		}
+	}()
+	return nw
+}
+
+func (nw *nonBlockingWriter) Write(p []byte) (int, error) {
+	select {
+	case nw.ch <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+// clashStdout and clashStderr are shared by all starts of the clash process
+var (
+	clashStdout = sync.OnceValue(func() io.Writer { return newNonBlockingWriter(os.Stdout, clashOutputQueue) })
+	clashStderr = sync.OnceValue(func() io.Writer { return newNonBlockingWriter(os.Stderr, clashOutputQueue) })
+)
+
+// Stop sends SIGINT to the clash process and waits for it to exit, it is killed after the timeout
+func (c *ClashCore) Stop(timeout time.Duration) error {
+	c.mu.Lock()
+	cmd, done := c.cmd, c.done
+	c.stopped = cmd
+	c.mu.Unlock()
+
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	if err := cmd.Process.Signal(syscall.SIGINT); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("[core] failed to stop clash process: %w", err)
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		logrus.Warnf("[core] clash process did not exit after %s, killing...", timeout)
+		_ = cmd.Process.Kill()
+		<-done
+		return nil
+	}
+}
+
+// Kill kills the clash process immediately without waiting for it to exit
+func (c *ClashCore) Kill() {
+	c.mu.Lock()
+	cmd := c.cmd
+	c.stopped = cmd
+	c.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+// Restart stops the running clash process and starts a new one
+func (c *ClashCore) Restart() error {
+	if err := c.Stop(coreStopTimeout); err != nil {
+		return err
+	}
+	return c.Start()
+}
+
+// ProbeCoreBinary checks that the binary is executable and prints its version
+func ProbeCoreBinary(bin string) (string, error) {
+	info, err := os.Stat(bin)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("%s is not executable", bin)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, bin, "-v").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("version probe failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func fileChecksum(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// WatchCoreBinary restarts the clash core after its binary is replaced(--watch-core-binary),
+// the new binary must pass the version probe, otherwise the last good binary is restored.
+func WatchCoreBinary(ctx context.Context, core *ClashCore) error {
+	bin := core.bin
+	backup := filepath.Join(filepath.Dir(bin), coreBackupName)
+
+	sum, err := fileChecksum(bin)
+	if err != nil {
+		return fmt.Errorf("[core] failed to checksum clash binary: %w", err)
+	}
+	if err = copyFileMode(bin, backup, 0755); err != nil {
+		return fmt.Errorf("[core] failed to back up clash binary: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("[core] failed to create fs watcher: %w", err)
+	}
+	// watch the dir, updaters usually replace the binary by renaming
+	if err = watcher.Add(filepath.Dir(bin)); err != nil {
+		_ = watcher.Close()
+		return fmt.Errorf("[core] failed add %s to fs watcher: %w", filepath.Dir(bin), err)
+	}
+
+	go func() {
+		defer func() { _ = watcher.Close() }()
+
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name != bin || event.Has(fsnotify.Remove) {
+					continue
+				}
+				// wait for the updater to finish writing
+				timer.Reset(coreBinarySettleDelay)
+			case <-timer.C:
+				newSum, err := fileChecksum(bin)
+				if err != nil {
+					logrus.Errorf("[core] failed to checksum clash binary: %v", err)
+					continue
+				}
+				if string(newSum) == string(sum) {
+					continue
+				}
+
+				ver, err := ProbeCoreBinary(bin)
+				if err != nil {
+					logrus.Errorf("[core] new clash binary is invalid, restoring the previous one: %v", err)
+					DesktopNotify("TPClash core update failed", "new clash binary is invalid: %v", err)
+					if err = copyFileMode(backup, bin, 0755); err != nil {
+						logrus.Errorf("[core] failed to restore clash binary: %v", err)
+					} else if sum, err = fileChecksum(bin); err != nil {
+						logrus.Errorf("[core] failed to checksum clash binary: %v", err)
+					}
+					continue
+				}
+
+				logrus.Infof("[core] clash binary replaced(%s), restarting clash...", ver)
+				sum = newSum
+				if err = copyFileMode(bin, backup, 0755); err != nil {
+					logrus.Warnf("[core] failed to back up clash binary: %v", err)
+				}
+				if err = core.Restart(); err != nil {
+					logrus.Errorf("[core] failed to restart clash: %v", err)
+					DesktopNotify("TPClash core update failed", "failed to restart clash: %v", err)
+					continue
+				}
+				setServiceState(StateReady, "")
+				DesktopNotify("TPClash core updated", "clash restarted with the new binary: %s", ver)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if err != nil {
+					logrus.Errorf("[core] fs watcher error: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
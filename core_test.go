@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockedWriter blocks every write until unblock is closed
+type blockedWriter struct {
+	unblock chan struct{}
+}
+
+func (w blockedWriter) Write(p []byte) (int, error) {
+	<-w.unblock
+	return len(p), nil
+}
+
+func TestDrainWriterClosedWriter(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reader is gone, writes to the pipe fail with EPIPE
+	_ = r.Close()
+	closed, _ := os.Create(os.DevNull)
+	_ = closed.Close()
+
+	var buf bytes.Buffer
+	dw := drainWriter{w, closed, nil, &buf}
+	for i := 0; i < 3; i++ {
+		n, err := dw.Write([]byte("line\n"))
+		if err != nil || n != 5 {
+			t.Fatalf("expected the write to succeed, got %d %v", n, err)
+		}
+	}
+	if buf.String() != strings.Repeat("line\n", 3) {
+		t.Fatalf("the other writers missed output: %q", buf.String())
+	}
+}
+
+func TestDrainWriterBlockedWriter(t *testing.T) {
+	blocked := blockedWriter{unblock: make(chan struct{})}
+	defer close(blocked.unblock)
+
+	var buf bytes.Buffer
+	dw := drainWriter{newNonBlockingWriter(blocked, 4), &buf}
+
+	// far more output than the queue holds, the clash side must never block
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			_, _ = dw.Write([]byte("line\n"))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by the blocked writer")
+	}
+	if buf.Len() != 1000*5 {
+		t.Fatalf("the other writers missed output: %d bytes", buf.Len())
+	}
+}
+
+func TestDrainWriterProcessNotBlocked(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("sh not found")
+	}
+	blocked := blockedWriter{unblock: make(chan struct{})}
+	defer close(blocked.unblock)
+
+	// the child writes far more than a pipe buffer(64KiB) while stdout is blocked
+	var buf bytes.Buffer
+	cmd := exec.Command(sh, "-c", "i=0; while [ $i -lt 20000 ]; do echo 0123456789; i=$((i+1)); done")
+	cmd.Stdout = drainWriter{newNonBlockingWriter(blocked, clashOutputQueue), &buf}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(30 * time.Second):
+		_ = cmd.Process.Kill()
+		t.Fatal("the process is blocked by its output")
+	}
+	if buf.Len() != 20000*11 {
+		t.Fatalf("the other writers missed output: %d bytes", buf.Len())
+	}
+}
+
+func TestNonBlockingWriter(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = r.Close() }()
+
+	nw := newNonBlockingWriter(w, 4)
+	_, _ = nw.Write([]byte("hello\n"))
+	bs := make([]byte, 6)
+	_ = r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = r.Read(bs); err != nil || string(bs) != "hello\n" {
+		t.Fatalf("expected the queued write to reach the writer, got %q %v", bs, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logRing keeps the tail of the clash output for diagnostics(--crash-dump)
+type logRing struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func newLogRing(max int) *logRing {
+	return &logRing{max: max}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+	if len(r.buf) > r.max {
+		r.buf = append([]byte{}, r.buf[len(r.buf)-r.max:]...)
+	}
+	return len(p), nil
+}
+
+func (r *logRing) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return string(r.buf)
+}
+
+// Diagnostics is the crash dump written to ClashHome/diagnostics
+type Diagnostics struct {
+	Time        time.Time       `json:"time"`
+	Reason      string          `json:"reason"`
+	Version     string          `json:"version"`
+	Clash       string          `json:"clash"`
+	Connections json.RawMessage `json:"connections,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	Logs        []string        `json:"logs"`
+}
+
+// WriteDiagnostics dumps the clash connections and the recent clash logs, it is best-effort
+// and gives up after diagnosticsTimeout so that it never delays shutdown significantly.
+func WriteDiagnostics(reason string, logs *logRing) {
+	if conf.InMemory {
+		logrus.Debug("[diagnostics] in-memory mode, skip crash dump")
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		d := Diagnostics{Time: time.Now(), Reason: reason, Version: version, Clash: clash}
+		if cc := currentClashConf.Load(); cc != nil {
+			bs, err := clashAPIRequest(cc, "GET", "/connections", nil)
+			if err != nil {
+				d.Error = fmt.Sprintf("failed to get clash connections: %v", err)
+			} else {
+				d.Connections = bs
+			}
+		}
+		if logs != nil {
+			d.Logs = strings.Split(strings.TrimRight(logs.String(), "\n"), "\n")
+		}
+
+		if err := saveDiagnostics(&d); err != nil {
+			logrus.Errorf("[diagnostics] failed to write crash dump: %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(diagnosticsTimeout):
+		logrus.Warnf("[diagnostics] crash dump did not finish in %s, skipping...", diagnosticsTimeout)
+	}
+}
+
+func saveDiagnostics(d *Diagnostics) error {
+	dir := filepath.Join(conf.ClashHome, diagnosticsDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(dir, fmt.Sprintf("%s-%s.json", d.Time.Format("20060102150405"), d.Reason))
+	if err = WriteFileAtomic(name, bs, 0600); err != nil {
+		return err
+	}
+	logrus.Infof("[diagnostics] crash dump storage location %s", name)
+
+	// only keep the latest dumps, the names sort by time
+	entries, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(entries)
+	for len(entries) > diagnosticsKeep {
+		_ = os.Remove(entries[0])
+		entries = entries[1:]
+	}
+	return nil
+}
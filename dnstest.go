@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var testDNSCmd = &cobra.Command{
+	Use:   "test-dns [DOMAIN]",
+	Short: "Check that dns queries are hijacked by clash(no dns leak)",
+	Run: func(cmd *cobra.Command, args []string) {
+		domain := "example.com"
+		if len(args) == 1 {
+			domain = args[0]
+		}
+
+		cc, err := loadInternalConfig()
+		if err != nil {
+			fatalf(ExitGeneral, "[test-dns] failed to load clash config, is tpclash running? %v", err)
+		}
+		if !cc.Tun.Enable || len(cc.Tun.DNSHijack) == 0 {
+			logrus.Warn("[test-dns] dns hijack is not enabled(tun.dns-hijack), nothing to test")
+			return
+		}
+
+		prefix, err := netip.ParsePrefix(cc.DNS.FakeIPRange)
+		if err != nil {
+			fatalf(ExitGeneral, "[test-dns] failed to parse clash fake-ip range(dns.fake-ip-range): %v", err)
+		}
+
+		failed := false
+		for _, server := range append([]string{""}, dnsLeakTestServers...) {
+			name := server
+			if name == "" {
+				name = "system resolver"
+			}
+
+			addrs, err := lookupVia(server, domain)
+			if err != nil {
+				logrus.Errorf("[test-dns] FAIL %s: failed to resolve %s: %v", name, domain, err)
+				failed = true
+				continue
+			}
+			leaked := false
+			for _, addr := range addrs {
+				if !prefix.Contains(addr.Unmap()) {
+					leaked = true
+				}
+			}
+			if leaked {
+				logrus.Errorf("[test-dns] FAIL %s: %s resolved to %v, outside of the fake-ip range %s, the query was not answered by clash", name, domain, addrs, prefix)
+				failed = true
+				continue
+			}
+			logrus.Infof("[test-dns] PASS %s: %s resolved to fake-ip %v", name, domain, addrs)
+		}
+
+		if failed {
+			logrus.Warnf("[test-dns] if %s is listed in dns.fake-ip-filter, try another domain", domain)
+			logrus.Exit(ExitProxySetup)
+		}
+	},
+}
+
+// lookupVia resolves the domain with the given dns server(ip:port), or the system resolver if empty
+func lookupVia(server, domain string) ([]netip.Addr, error) {
+	resolver := net.DefaultResolver
+	if server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip4", domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address")
+	}
+	return addrs, nil
+}
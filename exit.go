@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of tpclash, so that wrappers(systemd/cron) can react to specific failures,
+// all other fatal errors exit with 1.
+const (
+	ExitGeneral       = 1
+	ExitConfigFetch   = 2 // failed to fetch/read the clash config
+	ExitConfigInvalid = 3 // flags or clash config validation failed
+	ExitProxySetup    = 4 // failed to set up the transparent proxy
+	ExitPermission    = 5 // missing capabilities/permissions
+	ExitCoreStart     = 6 // failed to start the clash core
+)
+
+// fatal logs at error level and exits with the given code, it mirrors logrus.Fatal
+func fatal(code int, args ...any) {
+	logrus.Error(args...)
+	logrus.Exit(code)
+}
+
+// fatalf logs at error level and exits with the given code, it mirrors logrus.Fatalf
+func fatalf(code int, format string, args ...any) {
+	logrus.Errorf(format, args...)
+	logrus.Exit(code)
+}
+
+// forceShutdownOnSignal kills clash and exits immediately if another SIGINT/SIGTERM arrives
+// within the grace window(--shutdown-grace) while the graceful shutdown is still running.
+func forceShutdownOnSignal(core *ClashCore, grace time.Duration) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	logrus.Infof("[main] graceful shutdown started, send SIGINT/SIGTERM again(e.g. Ctrl-C) within %s to force an immediate exit", grace)
+
+	go func() {
+		defer signal.Stop(sigCh)
+		select {
+		case sig := <-sigCh:
+			logrus.Warnf("[main] received %s again, killing clash and exiting immediately, proxy rules may be left behind...", sig)
+			core.Kill()
+			logrus.Exit(ExitGeneral)
+		case <-time.After(grace):
+		}
+	}()
+}
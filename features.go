@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// Features describes the compiled-in and the detected runtime capabilities
+type Features struct {
+	Version  string          `json:"version"`
+	Clash    string          `json:"clash"`
+	Compiled map[string]bool `json:"compiled"`
+	Embedded EmbeddedAssets  `json:"embedded"`
+	Runtime  []FeatureCheck  `json:"runtime"`
+}
+
+type EmbeddedAssets struct {
+	Core       bool     `json:"core"`
+	Dashboards []string `json:"dashboards"`
+	GeoAssets  []string `json:"geo_assets"`
+}
+
+// FeatureCheck is a runtime check, privileged checks are skipped when not running as root
+type FeatureCheck struct {
+	Name       string `json:"name"`
+	Available  bool   `json:"available"`
+	Privileged bool   `json:"privileged"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	Detail     string `json:"detail,omitempty"`
+}
+
+var featuresCmd = &cobra.Command{
+	Use:   "features",
+	Short: "Show the compiled-in and runtime capabilities",
+	Run: func(cmd *cobra.Command, args []string) {
+		f := DetectFeatures()
+		if conf.FeaturesJSON {
+			bs, err := json.MarshalIndent(f, "", "  ")
+			if err != nil {
+				logrus.Fatalf("[features] failed to marshal features: %v", err)
+			}
+			fmt.Println(string(bs))
+			return
+		}
+
+		fmt.Printf("TPClash %s, clash %s\n\n", f.Version, f.Clash)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "compiled:")
+		for _, name := range []string{"dbus-notify", "sftp"} {
+			_, _ = fmt.Fprintf(w, "  %s\t%s\n", name, featureMark(f.Compiled[name]))
+		}
+		_, _ = fmt.Fprintln(w, "embedded:")
+		_, _ = fmt.Fprintf(w, "  core\t%s\n", featureMark(f.Embedded.Core))
+		_, _ = fmt.Fprintf(w, "  dashboards\t%s\n", strings.Join(f.Embedded.Dashboards, ", "))
+		_, _ = fmt.Fprintf(w, "  geo assets\t%s\n", strings.Join(f.Embedded.GeoAssets, ", "))
+		_, _ = fmt.Fprintln(w, "runtime:")
+		for _, c := range f.Runtime {
+			mark := featureMark(c.Available)
+			if c.Skipped {
+				mark = "skipped(requires root)"
+			}
+			_, _ = fmt.Fprintf(w, "  %s\t%s\t%s\n", c.Name, mark, c.Detail)
+		}
+		_ = w.Flush()
+	},
+}
+
+func featureMark(ok bool) string {
+	if ok {
+		return "yes"
+	}
+	return "no"
+}
+
+// DetectFeatures collects the capabilities, it does not require root
+func DetectFeatures() *Features {
+	f := &Features{
+		Version: version,
+		Clash:   clash,
+		Compiled: map[string]bool{
+			"dbus-notify": featureDBusNotify,
+			"sftp":        featureSFTP,
+		},
+	}
+
+	if _, err := fs.Stat(static, "static/"+InternalClashBinName); err == nil {
+		f.Embedded.Core = true
+	}
+	if entries, err := static.ReadDir("static"); err == nil {
+		for _, e := range entries {
+			if e.IsDir() {
+				f.Embedded.Dashboards = append(f.Embedded.Dashboards, e.Name())
+			}
+		}
+	}
+	for _, name := range geoAssets {
+		if _, err := fs.Stat(static, "static/"+name); err == nil {
+			f.Embedded.GeoAssets = append(f.Embedded.GeoAssets, name)
+		}
+	}
+
+	root := os.Geteuid() == 0
+	f.Runtime = append(f.Runtime, FeatureCheck{Name: "root", Available: root})
+	f.Runtime = append(f.Runtime, capabilitiesCheck())
+	f.Runtime = append(f.Runtime, pathCheck("tun-device", "/dev/net/tun"))
+	f.Runtime = append(f.Runtime, pathCheck("tun-module", "/sys/module/tun"))
+	f.Runtime = append(f.Runtime, pathCheck("bpf-fs", "/sys/fs/bpf"))
+	f.Runtime = append(f.Runtime, nftablesCheck(root))
+	f.Runtime = append(f.Runtime, binaryCheck("nft", conf.NftBin))
+	for _, bin := range []string{"iptables", "git"} {
+		f.Runtime = append(f.Runtime, binaryCheck(bin, ""))
+	}
+	return f
+}
+
+func pathCheck(name, path string) FeatureCheck {
+	_, err := os.Stat(path)
+	return FeatureCheck{Name: name, Available: err == nil, Detail: path}
+}
+
+func binaryCheck(name, configured string) FeatureCheck {
+	path, err := resolveTool(name, configured)
+	if err != nil {
+		detail := "not found in PATH"
+		if configured != "" {
+			detail = err.Error()
+		}
+		return FeatureCheck{Name: name + "-cli", Detail: detail}
+	}
+	return FeatureCheck{Name: name + "-cli", Available: true, Detail: path}
+}
+
+// capabilitiesCheck reports whether the effective capabilities include those passed to clash
+func capabilitiesCheck() FeatureCheck {
+	c := FeatureCheck{Name: "capabilities"}
+	bs, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	for _, line := range strings.Split(string(bs), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		eff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		if err != nil {
+			c.Detail = err.Error()
+			return c
+		}
+		var missing []string
+		caps := []struct {
+			name string
+			bit  uint
+		}{{"CAP_NET_BIND_SERVICE", CAP_NET_BIND_SERVICE}, {"CAP_NET_ADMIN", CAP_NET_ADMIN}, {"CAP_NET_RAW", CAP_NET_RAW}}
+		for _, capability := range caps {
+			if eff&(1<<capability.bit) == 0 {
+				missing = append(missing, capability.name)
+			}
+		}
+		c.Available = len(missing) == 0
+		if !c.Available {
+			c.Detail = "missing " + strings.Join(missing, ",")
+		}
+		return c
+	}
+	c.Detail = "CapEff not found"
+	return c
+}
+
+// nftablesCheck lists the nftables tables, it requires root(CAP_NET_ADMIN)
+func nftablesCheck(root bool) FeatureCheck {
+	c := FeatureCheck{Name: "nftables", Privileged: true}
+	if !root {
+		c.Skipped = true
+		return c
+	}
+	nft, err := nftables.New()
+	if err == nil {
+		_, err = nft.ListTables()
+	}
+	if err != nil {
+		c.Detail = err.Error()
+		return c
+	}
+	c.Available = true
+	return c
+}
+
+func init() {
+	featuresCmd.PersistentFlags().BoolVar(&conf.FeaturesJSON, "json", false, "print the features as json")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedKeys are the config keys whose values are replaced by redactConfig
+var redactedKeys = map[string]bool{
+	"secret":         true,
+	"password":       true,
+	"username":       true,
+	"uuid":           true,
+	"private-key":    true,
+	"public-key":     true,
+	"pre-shared-key": true,
+	"short-id":       true,
+	"psk":            true,
+	"auth":           true,
+	"auth-str":       true,
+	"token":          true,
+	"obfs-param":     true,
+	"obfs-password":  true,
+	"protocol-param": true,
+	"authentication": true,
+}
+
+// ServeConfigFifo writes the effective clash config to a named pipe(--config-fifo) each time
+// a reader opens it, e.g. `cat /run/tpclash.fifo`. The fifo is removed when ctx is done.
+func ServeConfigFifo(ctx context.Context, path, writePath string) error {
+	_ = os.Remove(path)
+	if err := unix.Mkfifo(path, 0600); err != nil {
+		return fmt.Errorf("[fifo] failed to create config fifo: %w", err)
+	}
+
+	go func() {
+		<-ctx.Done()
+		// unblock the pending open of the writer
+		if f, err := os.OpenFile(path, os.O_RDONLY|unix.O_NONBLOCK, 0); err == nil {
+			_ = f.Close()
+		}
+		_ = os.Remove(path)
+	}()
+
+	go func() {
+		for {
+			// blocks until a reader opens the fifo
+			f, err := os.OpenFile(path, os.O_WRONLY, 0)
+			if ctx.Err() != nil {
+				if f != nil {
+					_ = f.Close()
+				}
+				return
+			}
+			if err != nil {
+				logrus.Errorf("[fifo] failed to open config fifo: %v", err)
+				return
+			}
+
+			c := loadAppliedConfig(writePath)
+			if conf.RedactFifo {
+				c = redactConfig(c)
+			}
+			if _, err = f.WriteString(c); err != nil {
+				logrus.Debugf("[fifo] failed to write config fifo: %v", err)
+			}
+			_ = f.Close()
+
+			// let the reader see EOF before the next open, so it gets exactly one dump
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	logrus.Infof("[fifo] effective config is available at %s", path)
+	return nil
+}
+
+// redactConfig replaces the secrets in the config(api secret, proxy credentials) with "<redacted>"
+func redactConfig(c string) string {
+	var rootNode yaml.Node
+	if err := yaml.Unmarshal([]byte(c), &rootNode); err != nil {
+		return fmt.Sprintf("# failed to redact config: %v\n", err)
+	}
+	redactYamlNode(&rootNode)
+
+	bs, err := marshalYamlNode(&rootNode)
+	if err != nil {
+		return fmt.Sprintf("# failed to redact config: %v\n", err)
+	}
+	return string(bs)
+}
+
+func redactYamlNode(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i < len(n.Content)-1; i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if redactedKeys[strings.ToLower(k.Value)] {
+				// authentication is a list of "user:pass"
+				for _, s := range append([]*yaml.Node{v}, v.Content...) {
+					if s.Kind == yaml.ScalarNode && s.Value != "" {
+						s.Value, s.Tag, s.Style = "<redacted>", "!!str", 0
+					}
+				}
+				continue
+			}
+			redactYamlNode(v)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			redactYamlNode(c)
+		}
+	}
+}
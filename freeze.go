@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var freezeCmd = &cobra.Command{
+	Use:   "freeze",
+	Short: "Hold remote config updates until unfreeze",
+	Run: func(cmd *cobra.Command, args []string) {
+		if conf.ControlSocket != "" {
+			controlCmd("freeze", "").Run(cmd, args)
+			return
+		}
+		if err := Freeze(); err != nil {
+			logrus.Fatalf("[freeze] failed to freeze config: %v", err)
+		}
+		logrus.Info("[freeze] config frozen, updates will be held until unfreeze")
+	},
+}
+
+var unfreezeCmd = &cobra.Command{
+	Use:   "unfreeze",
+	Short: "Apply held config updates and resume",
+	Run: func(cmd *cobra.Command, args []string) {
+		if conf.ControlSocket != "" {
+			controlCmd("unfreeze", "").Run(cmd, args)
+			return
+		}
+		if err := Unfreeze(); err != nil {
+			logrus.Fatalf("[freeze] failed to unfreeze config: %v", err)
+		}
+		logrus.Info("[freeze] config unfrozen, held updates will be applied shortly")
+	},
+}
+
+func frozenMarkerPath() string {
+	return filepath.Join(conf.ClashHome, frozenMarkerName)
+}
+
+func IsFrozen() bool {
+	_, err := os.Stat(frozenMarkerPath())
+	return err == nil
+}
+
+func Freeze() error {
+	if err := os.MkdirAll(conf.ClashHome, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(frozenMarkerPath(), []byte(time.Now().Format(time.RFC3339)), 0644)
+}
+
+func Unfreeze() error {
+	err := os.Remove(frozenMarkerPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// heldUpdates counts the updates held since the config was frozen, it is reported by the
+// status command
+var heldUpdates atomic.Int64
+
+// HoldUpdates forwards config updates to the returned chan, while the config is frozen
+// the latest update is held(the watcher keeps polling) and applied after unfreeze.
+func HoldUpdates(ctx context.Context, updateCh chan string, pending string) chan string {
+	outCh := make(chan string, 3)
+
+	go func() {
+		defer close(outCh)
+
+		heldUpdates.Store(0)
+		if pending != "" {
+			heldUpdates.Store(1)
+		}
+
+		tick := time.NewTicker(freezeCheckInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ccStr, ok := <-updateCh:
+				if !ok {
+					return
+				}
+				if IsFrozen() {
+					pending = ccStr
+					logrus.Warnf("[freeze] config is frozen, update held(%d pending)...", heldUpdates.Add(1))
+					continue
+				}
+				pending = ""
+				heldUpdates.Store(0)
+				outCh <- ccStr
+			case <-tick.C:
+				if pending != "" && !IsFrozen() {
+					logrus.Infof("[freeze] config unfrozen, applying the latest of %d held updates...", heldUpdates.Load())
+					outCh <- pending
+					pending = ""
+					heldUpdates.Store(0)
+				}
+			}
+		}
+	}()
+
+	return outCh
+}
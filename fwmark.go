@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// EnableFwmarkRoute routes only the packets carrying the mark(--proxy-fwmark, set by another
+// tool) to the clash tun: a rule sends them to a dedicated table whose default route is the
+// tun device. It returns the tun device so that the routes can be removed later.
+func EnableFwmarkRoute(cc *ClashConf, mark uint32) (string, error) {
+	if !cc.Tun.Enable {
+		return "", errors.New("[fwmark] --proxy-fwmark requires the clash tun(tun.enable)")
+	}
+	if cc.Tun.AutoRoute {
+		return "", errors.New("[fwmark] --proxy-fwmark requires tun.auto-route: false, otherwise clash routes all traffic to the tun")
+	}
+	if cc.RoutingMark != 0 && uint32(cc.RoutingMark) == mark {
+		return "", fmt.Errorf("[fwmark] proxy fwmark %#x equals the clash routing-mark, the outgoing traffic of clash would loop back to the tun", mark)
+	}
+
+	dev, err := waitTunDevice(cc.Tun.Device, tunDeviceWait)
+	if err != nil {
+		return "", err
+	}
+
+	logrus.Infof("[fwmark] routing packets with fwmark %#x to the clash tun %s(table %d)", mark, dev, fwmarkRouteTable)
+	for _, family := range fwmarkFamilies(cc) {
+		if err = AddDeviceRoute(family, fwmarkRouteTable, dev); err != nil {
+			return dev, fmt.Errorf("[fwmark] %w", err)
+		}
+		if err = AddIPRule(IPRule{Family: family, Priority: fwmarkRulePriority, Table: fwmarkRouteTable, Mark: mark}); err != nil {
+			return dev, fmt.Errorf("[fwmark] %w", err)
+		}
+	}
+	return dev, nil
+}
+
+// DisableFwmarkRoute removes the rules and routes of EnableFwmarkRoute, the routes are also
+// removed by the kernel once clash closes the tun device.
+func DisableFwmarkRoute(mark uint32, dev string) error {
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		if err := DelIPRule(IPRule{Family: family, Priority: fwmarkRulePriority, Table: fwmarkRouteTable, Mark: mark}); err != nil {
+			return fmt.Errorf("[fwmark] %w", err)
+		}
+		if dev == "" {
+			continue
+		}
+		if err := DelDeviceRoute(family, fwmarkRouteTable, dev); err != nil {
+			return fmt.Errorf("[fwmark] %w", err)
+		}
+	}
+	return nil
+}
+
+func fwmarkFamilies(cc *ClashConf) []int {
+	if cc.Ipv6 {
+		return []int{unix.AF_INET, unix.AF_INET6}
+	}
+	return []int{unix.AF_INET}
+}
+
+// waitTunDevice waits for clash to create its tun device, without tun.device in the config
+// the only tun device of the host is used.
+func waitTunDevice(name string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if name != "" {
+			if _, err := os.Stat(filepath.Join("/sys/class/net", name)); err == nil {
+				return name, nil
+			}
+		} else {
+			devs, _ := filepath.Glob("/sys/class/net/*/tun_flags")
+			if len(devs) == 1 {
+				return filepath.Base(filepath.Dir(devs[0])), nil
+			}
+			if len(devs) > 1 {
+				return "", fmt.Errorf("[fwmark] found %d tun devices, set tun.device in the clash config to select one", len(devs))
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("[fwmark] clash tun device was not created within %s", timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WaitClashAPI waits until the clash api is ready(--startup-timeout), each probe is bounded by
+// --probe-timeout. A refused connection means clash is not listening yet and is retried at
+// --probe-interval, a timeout or reset means clash accepts connections but does not respond,
+// the interval is doubled for each such probe so that a hanging core is not flooded. The last
+// clash logs are printed if clash never becomes ready.
+func WaitClashAPI(cc *ClashConf, logs *logRing) error {
+	deadline := time.Now().Add(conf.StartupTimeout)
+	interval := conf.ProbeInterval
+	for attempt := 1; ; attempt++ {
+		err := probeClashAPI(cc, conf.ProbeTimeout)
+		if err == nil {
+			return nil
+		}
+
+		var status probeStatusError
+		switch {
+		case errors.As(err, &status):
+			// clash is up but rejects the request(e.g. a wrong secret), retrying will not help
+			return fmt.Errorf("[health] clash api is not usable: %w", err)
+		case errors.Is(err, syscall.ECONNREFUSED):
+			logrus.Debugf("[health] clash api probe %d: not listening yet", attempt)
+			interval = conf.ProbeInterval
+		default:
+			logrus.Warnf("[health] clash api probe %d: clash accepts connections but does not respond: %v", attempt, err)
+			interval = min(2*interval, probeIntervalMax)
+		}
+
+		if time.Now().After(deadline) {
+			if logs != nil {
+				logrus.Errorf("[health] last clash logs:\n%s", lastLines(logs.String(), startupLogLines))
+			}
+			return fmt.Errorf("[health] clash api is not ready after %s: %w", conf.StartupTimeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// probeStatusError is an api probe answered with an unexpected status
+type probeStatusError struct {
+	code int
+	body string
+}
+
+func (e probeStatusError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.code, e.body)
+}
+
+func probeClashAPI(cc *ClashConf, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+clashAPIAddr(cc)+"/version", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cc.Secret)
+	resp, err := clashAPIClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	bs, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return probeStatusError{code: resp.StatusCode, body: strings.TrimSpace(string(bs))}
+	}
+	return nil
+}
+
+// lastLines returns the last n lines of s
+func lastLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckProxyHealth runs the clash delay test for the members of each proxy group, it
+// returns the groups without any working node and the number of healthy groups.
+func CheckProxyHealth(cc *ClashConf) (unhealthy []string, healthy int, err error) {
+	bs, err := clashAPIRequest(cc, "GET", "/proxies", nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("[health] failed to list clash proxies: %w", err)
+	}
+
+	var resp struct {
+		Proxies map[string]struct {
+			Type string   `json:"type"`
+			All  []string `json:"all"`
+		} `json:"proxies"`
+	}
+	if err = json.Unmarshal(bs, &resp); err != nil {
+		return nil, 0, fmt.Errorf("[health] failed to unmarshal clash proxies: %w", err)
+	}
+
+	// the built-in proxies always pass the delay test and a nested group is counted on its
+	// own, neither makes a group healthy
+	testable := func(member string) bool {
+		switch member {
+		case "DIRECT", "REJECT", "REJECT-DROP", "PASS", "COMPATIBLE":
+			return false
+		}
+		return len(resp.Proxies[member].All) == 0
+	}
+
+	// each member is only tested once, even if it belongs to multiple groups
+	delays := make(map[string]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, healthCheckConcurrency)
+	for name, p := range resp.Proxies {
+		if name == "GLOBAL" || len(p.All) == 0 {
+			continue
+		}
+		for _, member := range p.All {
+			if !testable(member) {
+				continue
+			}
+			mu.Lock()
+			_, ok := delays[member]
+			delays[member] = false
+			mu.Unlock()
+			if ok {
+				continue
+			}
+
+			wg.Add(1)
+			go func(member string) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				path := fmt.Sprintf("/proxies/%s/delay?timeout=%d&url=%s", url.PathEscape(member),
+					healthCheckTimeout.Milliseconds(), url.QueryEscape(healthCheckURL))
+				_, err := clashAPIRequest(cc, "GET", path, nil)
+				if err != nil {
+					logrus.Debugf("[health] proxy %s delay test failed: %v", member, err)
+				}
+				mu.Lock()
+				delays[member] = err == nil
+				mu.Unlock()
+			}(member)
+		}
+	}
+	wg.Wait()
+
+	for name, p := range resp.Proxies {
+		if name == "GLOBAL" || len(p.All) == 0 {
+			continue
+		}
+		ok := false
+		for _, member := range p.All {
+			if delays[member] {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			healthy++
+		} else {
+			unhealthy = append(unhealthy, name)
+		}
+	}
+	sort.Strings(unhealthy)
+
+	return unhealthy, healthy, nil
+}
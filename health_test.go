@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckProxyHealthBuiltins(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/proxies":
+			_, _ = w.Write([]byte(`{"proxies": {
+				"GLOBAL": {"type": "Selector", "all": ["Proxy", "Direct", "Mixed"]},
+				"Proxy": {"type": "Selector", "all": ["node-a", "node-b"]},
+				"Direct": {"type": "Selector", "all": ["DIRECT", "REJECT", "PASS", "node-a"]},
+				"Mixed": {"type": "Selector", "all": ["Proxy", "DIRECT", "node-c"]},
+				"node-a": {"type": "Shadowsocks"},
+				"node-b": {"type": "Shadowsocks"},
+				"node-c": {"type": "Vmess"},
+				"DIRECT": {"type": "Direct"},
+				"REJECT": {"type": "Reject"},
+				"PASS": {"type": "Pass"}
+			}}`))
+		case r.URL.Path == "/proxies/node-c/delay":
+			_, _ = w.Write([]byte(`{"delay": 100}`))
+		case strings.HasPrefix(r.URL.Path, "/proxies/node-"):
+			http.Error(w, `{"message": "timeout"}`, http.StatusGatewayTimeout)
+		case strings.HasSuffix(r.URL.Path, "/delay"):
+			// the built-in proxies and the groups always pass the delay test
+			_, _ = w.Write([]byte(`{"delay": 1}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	cc := &ClashConf{ExternalController: strings.TrimPrefix(srv.URL, "http://")}
+	unhealthy, healthy, err := CheckProxyHealth(cc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Direct only reaches DIRECT, Mixed is healthy by node-c and not by the Proxy group
+	if strings.Join(unhealthy, ",") != "Direct,Proxy" || healthy != 1 {
+		t.Fatalf("expected Direct and Proxy to be unhealthy and 1 healthy group, got %v %d", unhealthy, healthy)
+	}
+}
@@ -1,27 +1,139 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
 
 	"github.com/lorenzosaino/go-sysctl"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
 func Sysctl() {
 	logrus.Info("[helper/sysctl] enable net.ipv4.ip_forward...")
 	if err := sysctl.Set("net.ipv4.ip_forward", "1"); err != nil {
-		logrus.Fatalf("[helper] failed to set net.ipv4.ip_forward: %v", err)
+		fatalf(ExitPermission, "[helper] failed to set net.ipv4.ip_forward: %v", err)
 	}
 
 	logrus.Info("[helper/sysctl] enable net.ipv4.conf.all.route_localnet...")
 	if err := sysctl.Set("net.ipv4.conf.all.route_localnet", "1"); err != nil {
-		logrus.Fatalf("[helper/sysctl] failed to set net.ipv4.conf.all.route_localnet: %v", err)
+		fatalf(ExitPermission, "[helper/sysctl] failed to set net.ipv4.conf.all.route_localnet: %v", err)
 	}
 }
 
+// ruleGeneration tags all nftables rules installed by this run, rules of prior
+// generations are removed before installing the new set.
+var ruleGeneration = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// ruleComment encodes the generation token as a nftables rule comment(libnftnl udata TLV),
+// so it is also visible in `nft list ruleset`.
+func ruleComment() []byte {
+	comment := append([]byte(ruleCommentPrefix+ruleGeneration), 0)
+	return append([]byte{0, byte(len(comment))}, comment...)
+}
+
+// isTPClashRule checks whether the rule is tagged by tpclash(any generation)
+func isTPClashRule(rule *nftables.Rule) bool {
+	return strings.HasPrefix(ruleCommentText(rule), ruleCommentPrefix)
+}
+
+// ruleCommentText returns the comment of the rule, an empty string if it has none
+func ruleCommentText(rule *nftables.Rule) string {
+	ud := rule.UserData
+	for len(ud) >= 2 {
+		typ, l := ud[0], int(ud[1])
+		if len(ud) < 2+l {
+			return ""
+		}
+		if typ == 0 {
+			return strings.TrimRight(string(ud[2:2+l]), "\x00")
+		}
+		ud = ud[2+l:]
+	}
+	return ""
+}
+
+// isLegacyDockerRule checks whether the rule is the untagged bare accept rule tpclash inserted
+// into DOCKER-USER before the rules were tagged
+func isLegacyDockerRule(rule *nftables.Rule) bool {
+	if len(rule.Exprs) != 1 || len(rule.UserData) != 0 {
+		return false
+	}
+	v, ok := rule.Exprs[0].(*expr.Verdict)
+	return ok && v.Kind == expr.VerdictAccept
+}
+
+// deleteLegacyDockerRules removes the untagged accept rules of earlier versions from the chain,
+// it only runs once(until the migration marker is written), since a bare accept rule added by
+// the user looks the same.
+func deleteLegacyDockerRules(nft *nftables.Conn, chain *nftables.Chain) error {
+	if _, err := os.Stat(dockerMigrationMarkerPath()); err == nil {
+		return nil
+	}
+	rs, err := nft.GetRules(chain.Table, chain)
+	if err != nil {
+		return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
+	}
+	for _, rule := range rs {
+		if !isLegacyDockerRule(rule) {
+			continue
+		}
+		logrus.Warnf("[helper/nftables] removing the untagged accept rule of an earlier tpclash version from %s", chain.Name)
+		if err = nft.DelRule(rule); err != nil {
+			return fmt.Errorf("[helper/nftables] failed to delete nftables rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// dockerMigrationMarkerPath is the migration marker in the home dir, in in-memory mode nothing
+// is written to the home dir and the marker only lasts until the next boot
+func dockerMigrationMarkerPath() string {
+	if conf.InMemory {
+		return filepath.Join(inMemoryConfigDir(), "tpclash"+dockerMigrationMarkerName)
+	}
+	return filepath.Join(conf.ClashHome, dockerMigrationMarkerName)
+}
+
+// markDockerRulesMigrated records that the legacy DOCKER-USER rules have been removed
+func markDockerRulesMigrated() {
+	p := dockerMigrationMarkerPath()
+	if _, err := os.Stat(p); err == nil {
+		return
+	}
+	if err := os.WriteFile(p, []byte(version+"\n"), 0644); err != nil {
+		logrus.Warnf("[helper/nftables] failed to write docker rules migration marker: %v", err)
+	}
+}
+
+// deleteTPClashRules removes the rules tagged by tpclash from the chain
+func deleteTPClashRules(nft *nftables.Conn, chain *nftables.Chain) error {
+	rs, err := nft.GetRules(chain.Table, chain)
+	if err != nil {
+		return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
+	}
+	for _, rule := range rs {
+		if !isTPClashRule(rule) {
+			continue
+		}
+		if err = nft.DelRule(rule); err != nil {
+			return fmt.Errorf("[helper/nftables] failed to delete nftables rules: %w", err)
+		}
+	}
+	return nil
+}
+
 func EnableDockerCompatible() error {
 	nft, err := nftables.New()
 	if err != nil {
@@ -34,16 +146,24 @@ func EnableDockerCompatible() error {
 	}
 	for _, chain := range cs {
 		if chain.Name == ChainDockerUser {
+			if err = deleteTPClashRules(nft, chain); err != nil {
+				return err
+			}
+			if err = deleteLegacyDockerRules(nft, chain); err != nil {
+				return err
+			}
 			nft.InsertRule(&nftables.Rule{
 				Table: chain.Table,
 				Chain: chain,
 				Exprs: []expr.Any{&expr.Verdict{
 					Kind: expr.VerdictAccept,
 				}},
+				UserData: ruleComment(),
 			})
-			if err = nft.Flush(); err != nil {
+			if err = nftFlush(nft, "enable docker compatible"); err != nil {
 				return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
 			}
+			markDockerRulesMigrated()
 			return nil
 		}
 	}
@@ -62,25 +182,327 @@ func DisableDockerCompatible() error {
 	}
 	for _, chain := range cs {
 		if chain.Name == ChainDockerUser {
-			rs, err := nft.GetRules(chain.Table, chain)
-			if err != nil {
-				return fmt.Errorf("[helper/nftables] failed to get nftables rules: %w", err)
+			if err = deleteTPClashRules(nft, chain); err != nil {
+				return err
 			}
-			for _, rule := range rs {
-				if len(rule.Exprs) == 1 {
-					v, ok := rule.Exprs[0].(*expr.Verdict)
-					if ok && v.Kind == expr.VerdictAccept {
-						if err = nft.DelRule(rule); err != nil {
-							return fmt.Errorf("[helper/nftables] failed to delete nftables rules: %w", err)
-						}
-					}
-				}
+			if err = deleteLegacyDockerRules(nft, chain); err != nil {
+				return err
 			}
-			if err = nft.Flush(); err != nil {
+			if err = nftFlush(nft, "disable docker compatible"); err != nil {
 				return fmt.Errorf("[helper/nftables] failed to flush nftables: %v", err)
 			}
+			markDockerRulesMigrated()
 			return nil
 		}
 	}
 	return nil
 }
+
+// well-known transparent proxy tools, tpclash's own nftables objects are prefixed with "tpclash"
+var (
+	conflictKeywords  = []string{"clash", "mihomo", "v2ray", "xray", "sing-box", "singbox", "passwall", "ss-redir", "ss_spec", "trojan"}
+	conflictProcesses = []string{"clash", "clash-meta", "clash.meta", "mihomo", "v2ray", "xray", "sing-box", "ss-redir", "trojan", "trojan-go", InternalClashBinName}
+)
+
+// CheckConflicts scans nftables and running processes for other transparent proxy tools
+// (or leftover rules) that may conflict with tpclash.
+func CheckConflicts() ([]string, error) {
+	var found []string
+
+	nft, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("[helper/conflict] failed connect to nftables: %v", err)
+	}
+
+	tables, err := nft.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("[helper/conflict] failed to list nftables tables: %w", err)
+	}
+	for _, t := range tables {
+		if isConflictName(t.Name) {
+			found = append(found, fmt.Sprintf("nftables table %s %s", tableFamilyName(t.Family), t.Name))
+		}
+	}
+
+	chains, err := nft.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("[helper/conflict] failed to list nftables chains: %w", err)
+	}
+	for _, c := range chains {
+		if isConflictName(c.Name) {
+			found = append(found, fmt.Sprintf("nftables chain %s in table %s %s", c.Name, tableFamilyName(c.Table.Family), c.Table.Name))
+		}
+	}
+
+	rules, err := ListIPRules()
+	if err != nil {
+		return nil, fmt.Errorf("[helper/conflict] %w", err)
+	}
+	for _, r := range foreignIPRules(rules, currentClashConf.Load()) {
+		cmd := "ip rule"
+		if r.Family == unix.AF_INET6 {
+			cmd = "ip -6 rule"
+		}
+		found = append(found, fmt.Sprintf("%s %s", cmd, r))
+	}
+
+	found = append(found, conflictingProcesses()...)
+	return found, nil
+}
+
+// foreignIPRules returns the policy routing rules of other tools: rules matching a fwmark or
+// looking up another table than the default ones(local/main/default). The rules of tpclash
+// and those of the clash tun(auto-route) are not foreign.
+func foreignIPRules(rules []IPRule, cc *ClashConf) []IPRule {
+	clashTable := uint32(clashTunRouteTable)
+	if cc != nil && cc.Tun.IPRoute2TableIndex != 0 {
+		clashTable = cc.Tun.IPRoute2TableIndex
+	}
+
+	var foreign []IPRule
+	for _, r := range rules {
+		if r.Family != unix.AF_INET && r.Family != unix.AF_INET6 {
+			continue
+		}
+		switch {
+		case r.Priority == sshBypassRulePriority || r.Priority == apiBypassRulePriority:
+		case r.Priority == fwmarkRulePriority && r.Table == fwmarkRouteTable:
+		case r.Table == clashTable:
+		case r.Mark == 0 && (r.Table == unix.RT_TABLE_UNSPEC || r.Table == unix.RT_TABLE_LOCAL ||
+			r.Table == unix.RT_TABLE_MAIN || r.Table == unix.RT_TABLE_DEFAULT):
+		default:
+			foreign = append(foreign, r)
+		}
+	}
+	return foreign
+}
+
+// conflictingProcesses lists the running transparent proxy tools, the clash started by this
+// tpclash(a child process) is not a conflict
+func conflictingProcesses() []string {
+	var found []string
+	self := os.Getpid()
+	comms, _ := filepath.Glob("/proc/[0-9]*/comm")
+	for _, comm := range comms {
+		bs, err := os.ReadFile(comm)
+		if err != nil {
+			continue
+		}
+		if procParent(filepath.Dir(comm)) == self {
+			continue
+		}
+		name := strings.TrimSpace(string(bs))
+		for _, p := range conflictProcesses {
+			if name == p {
+				found = append(found, fmt.Sprintf("process %s(pid %s)", name, filepath.Base(filepath.Dir(comm))))
+			}
+		}
+	}
+	return found
+}
+
+// CheckProxyConflicts reports the conflicting transparent proxy tools, an error is only returned
+// with --strict-proxy. The tools may be started while tpclash is running, so it runs at startup,
+// on resume and on reload.
+func CheckProxyConflicts() error {
+	conflicts, err := CheckConflicts()
+	if err != nil {
+		logrus.Warnf("[helper/conflict] failed to detect conflicting transparent proxy tools: %v", err)
+	}
+	if len(conflicts) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("[helper/conflict] detected conflicting transparent proxy tools, some traffic may not be proxied:\n  - %s\n"+
+		"  please stop these tools or remove their rules(e.g. nft delete table <family> <name>) before starting tpclash",
+		strings.Join(conflicts, "\n  - "))
+	if conf.StrictProxy {
+		return errors.New(msg)
+	}
+	logrus.Warn(msg)
+	return nil
+}
+
+// procParent returns the parent pid of the process(/proc/<pid> dir), 0 if it is unknown
+func procParent(dir string) int {
+	bs, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return 0
+	}
+	// the comm field may contain spaces and parentheses, the fields after it are fixed
+	s := string(bs)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	if len(fields) < 2 {
+		return 0
+	}
+	ppid, _ := strconv.Atoi(fields[1])
+	return ppid
+}
+
+func isConflictName(name string) bool {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "tpclash") {
+		return false
+	}
+	for _, k := range conflictKeywords {
+		if strings.Contains(name, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func tableFamilyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	default:
+		return "unspec"
+	}
+}
+
+// WriteFileAtomic writes the data to a temp file in the same dir and renames it to the
+// target, so the previous file is kept intact on any write error(e.g. disk full).
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return diskError(fmt.Errorf("failed to create temp file: %w", err))
+	}
+	tmpName := f.Name()
+	defer func() { _ = os.Remove(tmpName) }()
+
+	// the data is never readable with other permissions than perm
+	if err = f.Chmod(perm); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("failed to chmod %s: %w", name, err)
+	}
+	n, err := f.Write(data)
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return diskError(fmt.Errorf("failed to write %s: %w", name, err))
+	}
+
+	if err = os.Rename(tmpName, name); err != nil {
+		return diskError(fmt.Errorf("failed to rename %s: %w", name, err))
+	}
+	return nil
+}
+
+func diskError(err error) error {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return fmt.Errorf("disk is full, the previous file is kept: %w", err)
+	}
+	return err
+}
+
+// nftFlush sends the nftables batch, the operation is logged with its duration at debug level
+func nftFlush(nft *nftables.Conn, op string) error {
+	start := time.Now()
+	err := nft.Flush()
+	fields := logrus.Fields{"cmd": "nftables", "op": op, "duration": time.Since(start).String(), "ok": err == nil}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logrus.WithFields(fields).Debug("[helper/nftables] batch applied")
+	return err
+}
+
+// resolveTool returns the absolute path of an external tool, the configured path(e.g. --nft-bin)
+// is used as is, otherwise the tool is looked up in PATH.
+func resolveTool(name, configured string) (string, error) {
+	if configured == "" {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			return "", fmt.Errorf("%s not found in PATH(%s), set its absolute path with --%s-bin", name, os.Getenv("PATH"), name)
+		}
+		return path, nil
+	}
+
+	if !filepath.IsAbs(configured) {
+		return "", fmt.Errorf("--%s-bin must be an absolute path: %s", name, configured)
+	}
+	info, err := os.Stat(configured)
+	if err != nil {
+		return "", fmt.Errorf("--%s-bin: %w", name, err)
+	}
+	if info.IsDir() || info.Mode().Perm()&0111 == 0 {
+		return "", fmt.Errorf("--%s-bin is not an executable file: %s", name, configured)
+	}
+	return configured, nil
+}
+
+// ResolveTools resolves the external tools required by the enabled features at startup, so
+// that a missing tool fails early with all missing tools listed. The resolved paths replace
+// the configured ones. nft(--rules-file) is the only external tool the proxy runs, the other
+// firewall rules, the ip rules, routes and sysctls are set through netlink and procfs, so
+// there is no --ip-bin or --sysctl-bin.
+func ResolveTools() error {
+	tools := []struct {
+		name     string
+		path     *string
+		required bool
+	}{
+		{"nft", &conf.NftBin, conf.RulesFile != ""},
+	}
+
+	var missing []string
+	for _, t := range tools {
+		if !t.required {
+			continue
+		}
+		path, err := resolveTool(t.name, *t.path)
+		if err != nil {
+			missing = append(missing, err.Error())
+			continue
+		}
+		logrus.Debugf("[helper] resolved %s: %s", t.name, path)
+		*t.path = path
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("[helper] required tools are missing:\n  - %s", strings.Join(missing, "\n  - "))
+	}
+	return nil
+}
+
+// runFirewallCmd runs a firewall command(e.g. nft -f), the command is logged with its
+// duration and exit status at debug level
+func runFirewallCmd(name string, args ...string) ([]byte, error) {
+	start := time.Now()
+	cmd := exec.Command(name, args...)
+	out, err := cmd.CombinedOutput()
+	fields := logrus.Fields{"cmd": strings.Join(cmd.Args, " "), "duration": time.Since(start).String(), "exit": -1}
+	if cmd.ProcessState != nil {
+		fields["exit"] = cmd.ProcessState.ExitCode()
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logrus.WithFields(fields).Debug("[helper/firewall] command executed")
+	return out, err
+}
+
+// copyFileMode copies the file atomically(WriteFileAtomic) with the given permission
+func copyFileMode(src, dst string, perm os.FileMode) error {
+	bs, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(dst, bs, perm)
+}
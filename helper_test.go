@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, InternalConfigName)
+
+	if err := WriteFileAtomic(name, []byte("secret: old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected perm: %s", fi.Mode().Perm())
+	}
+
+	// replacing the file applies the new perm
+	if err = WriteFileAtomic(name, []byte("secret: new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ = os.Stat(name); fi.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected perm: %s", fi.Mode().Perm())
+	}
+}
+
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, InternalConfigName)
+	if err := WriteFileAtomic(name, []byte("secret: old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// limit the file size of the process, the write fails like on a full disk(EFBIG)
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_FSIZE, &limit); err != nil {
+		t.Fatal(err)
+	}
+	small := limit
+	small.Cur = 4
+	if err := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &small); err != nil {
+		t.Skipf("failed to limit the file size: %v", err)
+	}
+	err := WriteFileAtomic(name, bytes.Repeat([]byte("x"), 4096), 0600)
+	if err2 := syscall.Setrlimit(syscall.RLIMIT_FSIZE, &limit); err2 != nil {
+		t.Fatal(err2)
+	}
+	if err == nil {
+		t.Fatal("expected the write to fail")
+	}
+
+	bs, err := os.ReadFile(name)
+	if err != nil || string(bs) != "secret: old\n" {
+		t.Fatalf("the previous file was not kept: %q %v", bs, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			t.Fatalf("temp file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestRuleComment(t *testing.T) {
+	accept := []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}
+	// the udata nft writes for comment "tpclash:rules-file", after another(non-comment) tlv
+	rulesFile := append([]byte{1, 1, 0}, 0, byte(len(rulesFileComment)+1))
+	rulesFile = append(append(rulesFile, rulesFileComment...), 0)
+
+	tests := []struct {
+		name     string
+		rule     *nftables.Rule
+		comment  string
+		tagged   bool
+		legacy   bool
+		fromFile bool
+	}{
+		{name: "tagged", rule: &nftables.Rule{Exprs: accept, UserData: ruleComment()}, comment: ruleCommentPrefix + ruleGeneration, tagged: true},
+		{name: "rules file", rule: &nftables.Rule{Exprs: accept, UserData: rulesFile}, comment: rulesFileComment, tagged: true, fromFile: true},
+		{name: "legacy accept", rule: &nftables.Rule{Exprs: accept}, legacy: true},
+		{name: "other comment", rule: &nftables.Rule{Exprs: accept, UserData: []byte{0, 6, 'd', 'o', 'c', 'k', 'e', 'r'}}, comment: "docker"},
+		{name: "drop", rule: &nftables.Rule{Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}}},
+		{name: "matching accept", rule: &nftables.Rule{Exprs: append([]expr.Any{&expr.Counter{}}, accept...)}},
+		{name: "truncated", rule: &nftables.Rule{Exprs: accept, UserData: []byte{0, 20, 't'}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if c := ruleCommentText(tt.rule); c != tt.comment {
+				t.Errorf("unexpected comment %q", c)
+			}
+			if isTPClashRule(tt.rule) != tt.tagged {
+				t.Errorf("expected tagged %v", tt.tagged)
+			}
+			if isLegacyDockerRule(tt.rule) != tt.legacy {
+				t.Errorf("expected legacy %v", tt.legacy)
+			}
+			if (ruleCommentText(tt.rule) == rulesFileComment) != tt.fromFile {
+				t.Errorf("expected rules file rule %v", tt.fromFile)
+			}
+		})
+	}
+}
+
+func TestProcParent(t *testing.T) {
+	if ppid := procParent("/proc/self"); ppid != os.Getppid() {
+		t.Fatalf("expected parent pid %d, got %d", os.Getppid(), ppid)
+	}
+	if ppid := procParent("/proc/0"); ppid != 0 {
+		t.Fatalf("expected 0 for a missing process, got %d", ppid)
+	}
+}
+
+func TestConflictingProcesses(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	// a copy of sleep named like a conflicting tool
+	bin := filepath.Join(t.TempDir(), "xray")
+	bs, err := os.ReadFile(sleep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(bin, bs, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	hasPid := func(pid int) bool {
+		for _, p := range conflictingProcesses() {
+			if strings.HasSuffix(p, fmt.Sprintf("(pid %d)", pid)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// a child process, like the clash started by tpclash, is not a conflict
+	child := exec.Command(bin, "30")
+	if err = child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = child.Process.Kill(); _ = child.Wait() }()
+	if hasPid(child.Process.Pid) {
+		t.Fatal("the child process is reported as a conflict")
+	}
+
+	// the same tool started by someone else is
+	out, err := exec.Command("sh", "-c", bin+" 30 >/dev/null 2>&1 & echo $!").Output()
+	if err != nil {
+		t.Skipf("failed to start a detached process: %v", err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(out)))
+	defer func() { _ = syscall.Kill(pid, syscall.SIGKILL) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !hasPid(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("process %d is not reported as a conflict: %v", pid, conflictingProcesses())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestParseIPRule(t *testing.T) {
+	rules := []IPRule{
+		{Family: unix.AF_INET, Priority: fwmarkRulePriority, Table: fwmarkRouteTable, Mark: 0x162},
+		{Family: unix.AF_INET6, Priority: sshBypassRulePriority, Table: unix.RT_TABLE_MAIN, TCPSport: 22,
+			Dst: &net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(128, 128)}},
+		{Family: unix.AF_INET, Priority: apiBypassRulePriority, Table: unix.RT_TABLE_MAIN,
+			Dst: &net.IPNet{IP: net.ParseIP("127.0.0.1").To4(), Mask: net.CIDRMask(32, 32)}},
+	}
+	for _, want := range rules {
+		got, ok := parseIPRule(want.message())
+		if !ok || got.String() != want.String() || got.Family != want.Family {
+			t.Errorf("expected %s to round trip, got %s(%v)", want, got, ok)
+		}
+	}
+	if _, ok := parseIPRule([]byte{unix.AF_INET}); ok {
+		t.Error("expected a truncated rule to be rejected")
+	}
+}
+
+func TestForeignIPRules(t *testing.T) {
+	rules := []IPRule{
+		{Family: unix.AF_INET, Priority: 0, Table: unix.RT_TABLE_LOCAL},
+		{Family: unix.AF_INET, Priority: 32766, Table: unix.RT_TABLE_MAIN},
+		{Family: unix.AF_INET6, Priority: 32767, Table: unix.RT_TABLE_DEFAULT},
+		// multicast routing(RTNL_FAMILY_IPMR)
+		{Family: 128, Priority: 32767, Table: unix.RT_TABLE_DEFAULT},
+		// tpclash
+		{Family: unix.AF_INET, Priority: sshBypassRulePriority, Table: unix.RT_TABLE_MAIN, TCPSport: 22},
+		{Family: unix.AF_INET6, Priority: apiBypassRulePriority, Table: unix.RT_TABLE_MAIN},
+		{Family: unix.AF_INET, Priority: fwmarkRulePriority, Table: fwmarkRouteTable, Mark: 0x162},
+		// clash tun(auto-route)
+		{Family: unix.AF_INET, Priority: 9000, Table: clashTunRouteTable},
+		{Family: unix.AF_INET, Priority: 9001, Table: unix.RT_TABLE_MAIN},
+		// other tools
+		{Family: unix.AF_INET, Priority: 100, Table: 100, Mark: 1},
+		{Family: unix.AF_INET6, Priority: 9000, Table: unix.RT_TABLE_MAIN, Mark: 0xff},
+		{Family: unix.AF_INET, Priority: 200, Table: 233},
+	}
+
+	var got []string
+	for _, r := range foreignIPRules(rules, nil) {
+		got = append(got, r.String())
+	}
+	want := "pref 100 fwmark 0x1 lookup 100,pref 9000 fwmark 0xff lookup 254,pref 200 lookup 233"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("expected the foreign rules %s, got %s", want, strings.Join(got, ","))
+	}
+
+	// a custom clash tun table(tun.iproute2-table-index) is not foreign, the default one is
+	cc := &ClashConf{}
+	cc.Tun.IPRoute2TableIndex = 233
+	got = got[:0]
+	for _, r := range foreignIPRules(rules, cc) {
+		got = append(got, r.String())
+	}
+	want = "pref 9000 lookup 2022,pref 100 fwmark 0x1 lookup 100,pref 9000 fwmark 0xff lookup 254"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("expected the foreign rules %s, got %s", want, strings.Join(got, ","))
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -52,44 +54,12 @@ var installCmd = &cobra.Command{
 			logrus.Fatalf("[install] failed to copy executable file: %v", err)
 		}
 
-		opts := ""
-		if conf.Debug {
-			opts += " --debug"
-		}
-		if conf.ClashHome != "" {
-			opts += fmt.Sprintf(" %s %s", "--home", conf.ClashHome)
-		}
-		if conf.ClashConfig != "" {
-			opts += fmt.Sprintf(" %s %s", "--config", conf.ClashConfig)
-		}
-		if conf.ClashUI != "" {
-			opts += fmt.Sprintf(" %s %s", "--ui", conf.ClashUI)
-		}
-		if conf.CheckInterval > 0 {
-			opts += fmt.Sprintf(" %s %s", "--check-interval", conf.CheckInterval.String())
-		}
-		if len(conf.HttpHeader) > 0 {
-			for _, h := range conf.HttpHeader {
-				opts += fmt.Sprintf(" %s '%s'", "--http-header", h)
-			}
-		}
-		if conf.ConfigEncPassword != "" {
-			opts += fmt.Sprintf(" %s %s", "--config-password", conf.ConfigEncPassword)
-		}
-		if conf.ForceExtract {
-			opts += " --force-extract"
-		}
-		if conf.EnableTracing {
-			opts += " --enable-tracing"
-		}
-		if conf.AllowStandardDNSPort {
-			opts += " --allow-standard-dns"
-		}
-		if conf.AutoFixMode != "" {
-			opts += fmt.Sprintf(" %s %s", "--auto-fix", conf.AutoFixMode)
-		}
+		opts := serviceOpts(cmd)
 
-		err = os.WriteFile(filepath.Join(systemdDir, "tpclash.service"), []byte(fmt.Sprintf(systemdTpl, opts)), 0644)
+		if err = writeServiceEnv(); err != nil {
+			logrus.Fatalf("[install] failed to create service environment file: %v", err)
+		}
+		err = os.WriteFile(filepath.Join(systemdDir, "tpclash.service"), []byte(fmt.Sprintf(systemdTpl, serviceEnvPath(), opts)), 0644)
 		if err != nil {
 			logrus.Fatalf("[install] failed to create systemd service: %v", err)
 		}
@@ -123,3 +93,395 @@ var uninstallCmd = &cobra.Command{
 		fmt.Print(uninstalledMessage)
 	},
 }
+
+var installServiceCmd = &cobra.Command{
+	Use:   "install-service",
+	Short: "Print a systemd unit running the current binary with the given flags, --install writes it",
+	Run: func(cmd *cobra.Command, args []string) {
+		exePath, err := os.Executable()
+		if err != nil {
+			fatalf(ExitGeneral, "[install] unable to get executable file path: %v", err)
+		}
+		// systemd starts the service in /, relative paths would no longer resolve
+		if !isRemoteConfig() {
+			if conf.ClashConfig, err = filepath.Abs(conf.ClashConfig); err != nil {
+				fatal(ExitGeneral, err)
+			}
+		}
+		if conf.ConfigBundle != "" && !isRemoteBundle() {
+			if conf.ConfigBundle, err = filepath.Abs(conf.ConfigBundle); err != nil {
+				fatal(ExitGeneral, err)
+			}
+		}
+		if conf.ClashHome, err = filepath.Abs(conf.ClashHome); err != nil {
+			fatal(ExitGeneral, err)
+		}
+
+		unit := serviceUnit(exePath, serviceOpts(cmd), conf.ServiceUser)
+		if !conf.ServiceInstall {
+			if names := serviceSecretNames(); len(names) > 0 {
+				logrus.Warnf("[install] secret flags are not part of the unit, set %s in %s(0600) or use --install",
+					strings.Join(names, "/"), serviceEnvPath())
+			}
+			fmt.Print(unit)
+			return
+		}
+
+		dir, systemctl := systemdDir, []string{"daemon-reload"}
+		if conf.ServiceUser {
+			configDir, err := os.UserConfigDir()
+			if err != nil {
+				fatal(ExitGeneral, err)
+			}
+			dir, systemctl = filepath.Join(configDir, "systemd", "user"), []string{"--user", "daemon-reload"}
+		}
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			fatalf(ExitGeneral, "[install] failed to create directory: %v", err)
+		}
+		if err = writeServiceEnv(); err != nil {
+			fatalf(ExitGeneral, "[install] failed to create service environment file: %v", err)
+		}
+		unitPath := filepath.Join(dir, "tpclash.service")
+		if err = WriteFileAtomic(unitPath, []byte(unit), 0644); err != nil {
+			fatalf(ExitGeneral, "[install] failed to create systemd service: %v", err)
+		}
+		logrus.Infof("[install] systemd service written to %s", unitPath)
+
+		if out, err := exec.Command("systemctl", systemctl...).CombinedOutput(); err != nil {
+			logrus.Warnf("[install] failed to reload systemd(systemctl %s): %v %s", strings.Join(systemctl, " "), err, out)
+		}
+		if conf.ServiceUser {
+			fmt.Print(strings.ReplaceAll(installedMessage, "systemctl ", "systemctl --user "))
+		} else {
+			fmt.Print(installedMessage)
+		}
+	},
+}
+
+// serviceUnit renders the systemd unit of install-service, a user unit cannot grant
+// capabilities, they have to be set on the binary instead.
+func serviceUnit(exePath, opts string, user bool) string {
+	service := "User=root\nAmbientCapabilities=" + serviceCapabilities
+	wantedBy := "multi-user.target"
+	if user {
+		service = fmt.Sprintf("# user units cannot grant capabilities, set them on the binary:\n# setcap '%s+ep' %s",
+			strings.ToLower(strings.ReplaceAll(serviceCapabilities, " ", ",")), exePath)
+		wantedBy = "default.target"
+	}
+
+	// clash is stopped after the graceful shutdown, systemd must not kill tpclash before that
+	stopTimeout := 30 * time.Second
+	if t := conf.ShutdownGrace + coreStopTimeout; t > stopTimeout {
+		stopTimeout = t
+	}
+	return fmt.Sprintf(serviceUnitTpl, service, serviceEnvPath(), exePath, opts, int(stopTimeout/time.Second), wantedBy)
+}
+
+// serviceSecrets are the flags kept out of the unit, which is readable by every user. They are
+// written to the EnvironmentFile of the unit and read back from the environment on start.
+var serviceSecrets = []struct {
+	flag  string
+	env   string
+	value *string
+}{
+	{"api-proxy-token", "TPCLASH_API_PROXY_TOKEN", &conf.APIProxyToken},
+	{"api-proxy-password", "TPCLASH_API_PROXY_PASSWORD", &conf.APIProxyPassword},
+	{"config-password", "TPCLASH_CONFIG_PASSWORD", &conf.ConfigEncPassword},
+}
+
+// loadServiceSecrets fills the secret flags that are not set on the command line from the
+// environment
+func loadServiceSecrets() {
+	for _, s := range serviceSecrets {
+		if *s.value == "" {
+			*s.value = os.Getenv(s.env)
+		}
+	}
+}
+
+// serviceSecretNames returns the environment variables of the secret flags that are set
+func serviceSecretNames() []string {
+	var names []string
+	for _, s := range serviceSecrets {
+		if *s.value != "" {
+			names = append(names, s.env)
+		}
+	}
+	return names
+}
+
+func serviceEnvPath() string {
+	home, err := filepath.Abs(conf.ClashHome)
+	if err != nil {
+		home = conf.ClashHome
+	}
+	return filepath.Join(home, serviceEnvName)
+}
+
+// writeServiceEnv writes the secret flags to the EnvironmentFile of the unit, it is only
+// readable by its owner(0600)
+func writeServiceEnv() error {
+	env := ""
+	for _, s := range serviceSecrets {
+		if *s.value != "" {
+			env += fmt.Sprintf("%s=%s\n", s.env, strconv.Quote(*s.value))
+		}
+	}
+	if env == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(serviceEnvPath()), 0755); err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(serviceEnvPath(), []byte(env), 0600); err != nil {
+		return err
+	}
+	logrus.Infof("[install] secret flags written to %s", serviceEnvPath())
+	return nil
+}
+
+// serviceOpts returns the flags of the command line that differ from their defaults, they
+// are passed to tpclash in the systemd service.
+func serviceOpts(cmd *cobra.Command) string {
+	opts := ""
+	if conf.Debug {
+		opts += " --debug"
+	}
+	if conf.ClashHome != "" {
+		opts += fmt.Sprintf(" %s %s", "--home", conf.ClashHome)
+	}
+	if conf.ClashAssetDir != "" {
+		opts += fmt.Sprintf(" %s %s", "--clash-asset-dir", conf.ClashAssetDir)
+	}
+	if conf.CacheFile != "" {
+		opts += fmt.Sprintf(" %s %s", "--cache-file", conf.CacheFile)
+	}
+	if conf.HealthAddr != "" {
+		opts += fmt.Sprintf(" %s %s", "--health-addr", conf.HealthAddr)
+	}
+	if conf.MetricsTextfile != "" {
+		opts += fmt.Sprintf(" %s %s", "--metrics-textfile", conf.MetricsTextfile)
+	}
+	if conf.MetricsInterval != 15*time.Second {
+		opts += fmt.Sprintf(" %s %s", "--metrics-interval", conf.MetricsInterval)
+	}
+	if conf.OtelEndpoint != "" {
+		opts += fmt.Sprintf(" %s %s", "--otel-endpoint", conf.OtelEndpoint)
+	}
+	if conf.ReloadTriggerFile != "" {
+		opts += fmt.Sprintf(" %s %s", "--reload-trigger-file", conf.ReloadTriggerFile)
+	}
+	if conf.ControlSocket != "" {
+		opts += fmt.Sprintf(" %s %s", "--control-socket", conf.ControlSocket)
+	}
+	if conf.ConfigFifo != "" {
+		opts += fmt.Sprintf(" %s %s", "--config-fifo", conf.ConfigFifo)
+	}
+	if conf.RedactFifo {
+		opts += " --redact-fifo"
+	}
+	if conf.ShutdownGrace != 30*time.Second {
+		opts += fmt.Sprintf(" %s %s", "--shutdown-grace", conf.ShutdownGrace)
+	}
+	if conf.StartupTimeout != 30*time.Second {
+		opts += fmt.Sprintf(" %s %s", "--startup-timeout", conf.StartupTimeout)
+	}
+	if conf.ProbeTimeout != 2*time.Second {
+		opts += fmt.Sprintf(" %s %s", "--probe-timeout", conf.ProbeTimeout)
+	}
+	if conf.ProbeInterval != 500*time.Millisecond {
+		opts += fmt.Sprintf(" %s %s", "--probe-interval", conf.ProbeInterval)
+	}
+	if conf.AssetOverlay != "" {
+		opts += fmt.Sprintf(" %s %s", "--asset-overlay", conf.AssetOverlay)
+	}
+	if conf.ClashInterface != "" {
+		opts += fmt.Sprintf(" %s %s", "--clash-interface", conf.ClashInterface)
+	}
+	if conf.ClashConfig != "" {
+		opts += fmt.Sprintf(" %s %s", "--config", conf.ClashConfig)
+	}
+	if conf.ConfigBundle != "" {
+		opts += fmt.Sprintf(" %s %s", "--config-bundle", conf.ConfigBundle)
+	}
+	if conf.VerifyKey != "" {
+		opts += fmt.Sprintf(" %s %s", "--verify-key", conf.VerifyKey)
+	}
+	if conf.ConfigOverrideDir != "" {
+		opts += fmt.Sprintf(" %s %s", "--config-override-dir", conf.ConfigOverrideDir)
+	}
+	if conf.RulesPosition != "replace" {
+		opts += fmt.Sprintf(" %s %s", "--rules-position", conf.RulesPosition)
+	}
+	if conf.OnDuplicate != "rename" {
+		opts += fmt.Sprintf(" %s %s", "--on-duplicate", conf.OnDuplicate)
+	}
+	if conf.LanBindCheck != "warn" {
+		opts += fmt.Sprintf(" %s %s", "--lan-bind-check", conf.LanBindCheck)
+	}
+	if conf.ClashUI != "" {
+		opts += fmt.Sprintf(" %s %s", "--ui", conf.ClashUI)
+	}
+	if conf.CheckInterval > 0 && cmd.Flags().Changed("check-interval") {
+		opts += fmt.Sprintf(" %s %s", "--check-interval", conf.CheckInterval.String())
+	}
+	if len(conf.HttpHeader) > 0 {
+		for _, h := range conf.HttpHeader {
+			opts += fmt.Sprintf(" %s '%s'", "--http-header", h)
+		}
+	}
+	if cmd.Flags().Changed("api-keepalive") {
+		opts += fmt.Sprintf(" %s %s", "--api-keepalive", conf.APIKeepAlive.String())
+	}
+	if cmd.Flags().Changed("api-idle-timeout") {
+		opts += fmt.Sprintf(" %s %s", "--api-idle-timeout", conf.APIIdleTimeout.String())
+	}
+	if conf.APIProxyAddr != "" {
+		opts += fmt.Sprintf(" %s %s", "--api-proxy-addr", conf.APIProxyAddr)
+	}
+	if conf.APIProxyUser != "" {
+		opts += fmt.Sprintf(" %s %s", "--api-proxy-user", conf.APIProxyUser)
+	}
+	if conf.SSHKey != "" {
+		opts += fmt.Sprintf(" %s %s", "--ssh-key", conf.SSHKey)
+	}
+	if conf.SSHKnownHosts != "/root/.ssh/known_hosts" {
+		opts += fmt.Sprintf(" %s %s", "--ssh-known-hosts", conf.SSHKnownHosts)
+	}
+	if conf.FetchResolver != "" {
+		opts += fmt.Sprintf(" %s %s", "--fetch-resolver", conf.FetchResolver)
+	}
+	if conf.FetchHostIP != "" {
+		opts += fmt.Sprintf(" %s %s", "--fetch-host-ip", conf.FetchHostIP)
+	}
+	if conf.StaleWhileRevalidate {
+		opts += " --swr"
+	}
+	if conf.FetchViaProxy {
+		opts += " --fetch-via-proxy"
+	}
+	if conf.WatchCoreBinary {
+		opts += " --watch-core-binary"
+	}
+	if conf.CrashDump {
+		opts += " --crash-dump"
+	}
+	if conf.AutoRollback {
+		opts += fmt.Sprintf(" --auto-rollback --rollback-window %s --rollback-factor %g --rollback-min-errors %d",
+			conf.RollbackWindow, conf.RollbackFactor, conf.RollbackMinErrors)
+	}
+	if conf.RestartOnLog != "" {
+		opts += fmt.Sprintf(" %s '%s'", "--restart-on-log", conf.RestartOnLog)
+	}
+	if conf.RestartOnLogCooldown != 10*time.Minute {
+		opts += fmt.Sprintf(" %s %s", "--restart-on-log-cooldown", conf.RestartOnLogCooldown)
+	}
+	if conf.RequireHealthyProxy {
+		opts += fmt.Sprintf(" --require-healthy-proxy --healthy-groups-min %d", conf.HealthyGroupsMin)
+	}
+	if conf.LogFormat != "text" {
+		opts += fmt.Sprintf(" %s %s", "--log-format", conf.LogFormat)
+	}
+	if conf.Notrack {
+		opts += " --notrack"
+	}
+	if conf.ClampMSS {
+		opts += " --clamp-mss"
+	}
+	if conf.TunMTU != 0 {
+		opts += fmt.Sprintf(" %s %d", "--tun-mtu", conf.TunMTU)
+	}
+	if conf.ClashNice != 0 {
+		opts += fmt.Sprintf(" %s %d", "--clash-nice", conf.ClashNice)
+	}
+	if conf.ClashIONice != "" {
+		opts += fmt.Sprintf(" %s %s", "--clash-ionice", conf.ClashIONice)
+	}
+	if conf.Instance != "" {
+		opts += fmt.Sprintf(" %s %s", "--instance", conf.Instance)
+	}
+	if conf.NftBin != "" {
+		opts += fmt.Sprintf(" %s %s", "--nft-bin", conf.NftBin)
+	}
+	if conf.RulesFile != "" {
+		opts += fmt.Sprintf(" %s %s", "--rules-file", conf.RulesFile)
+	}
+	if conf.ReloadBody != "path" {
+		opts += fmt.Sprintf(" %s %s", "--reload-body", conf.ReloadBody)
+	}
+	if conf.InMemory {
+		opts += " --in-memory"
+	}
+	if conf.ValidateLocalEdits {
+		opts += " --validate-local-edits"
+	}
+	if conf.DryRunReload {
+		opts += " --dry-run-reload"
+	}
+	if conf.NoValidateCache {
+		opts += " --no-validate-cache"
+	}
+	if conf.ForceExtract {
+		opts += " --force-extract"
+	}
+	if conf.ForceExtractUI {
+		opts += " --force-extract-ui"
+	}
+	if conf.EnableTracing {
+		opts += " --enable-tracing"
+	}
+	if conf.ReloadOnInterfaceChange {
+		opts += " --reload-on-interface-change"
+	}
+	if conf.StrictProxy {
+		opts += " --strict-proxy"
+	}
+	if conf.AllowStandardDNSPort {
+		opts += " --allow-standard-dns"
+	}
+	if conf.DesktopNotify {
+		opts += " --desktop-notify"
+	}
+	if conf.ProxyMode != "tun" {
+		opts += fmt.Sprintf(" %s %s", "--proxy-mode", conf.ProxyMode)
+	}
+	if conf.ProxyFwmark != 0 {
+		opts += fmt.Sprintf(" %s %d", "--proxy-fwmark", conf.ProxyFwmark)
+	}
+	if conf.AutoFixMode != "" {
+		opts += fmt.Sprintf(" %s %s", "--auto-fix", conf.AutoFixMode)
+	}
+	for _, r := range conf.RoutePorts {
+		opts += fmt.Sprintf(" %s '%s'", "--route-port", r)
+	}
+	for _, d := range conf.GroupDefaults {
+		opts += fmt.Sprintf(" %s '%s'", "--group-default", d)
+	}
+	for _, u := range conf.GroupTestURLs {
+		opts += fmt.Sprintf(" %s '%s'", "--group-test-url", u)
+	}
+	for _, i := range conf.GroupTestIntervals {
+		opts += fmt.Sprintf(" %s '%s'", "--group-test-interval", i)
+	}
+	for _, e := range conf.Schedules {
+		opts += fmt.Sprintf(" %s '%s'", "--schedule", e)
+	}
+	if conf.AutoFixStrict {
+		opts += " --autofix-strict"
+	}
+	if conf.VerifyAutoFix {
+		opts += " --verify-autofix"
+	}
+	if conf.CanonicalOutput {
+		opts += " --canonical-output"
+	}
+	if conf.ResolveServers {
+		opts += " --resolve-servers"
+	}
+	return opts
+}
+
+func init() {
+	installServiceCmd.PersistentFlags().BoolVar(&conf.ServiceUser, "user", false, "generate a systemd user unit instead of a system unit")
+	installServiceCmd.PersistentFlags().BoolVar(&conf.ServiceInstall, "install", false, "write the unit to the systemd unit dir and reload systemd instead of printing it")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestServiceSecrets(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.ClashHome = t.TempDir()
+	conf.APIProxyAddr, conf.APIProxyToken, conf.APIProxyPassword = "127.0.0.1:9091", "s3cret-token", `pa"ss`
+	conf.ConfigEncPassword = "s3cret-password"
+
+	opts := serviceOpts(&cobra.Command{})
+	unit := serviceUnit("/usr/local/bin/tpclash", opts, false)
+	for _, secret := range []string{conf.APIProxyToken, conf.APIProxyPassword, conf.ConfigEncPassword} {
+		if strings.Contains(unit, secret) {
+			t.Fatalf("secret %q written to the unit:\n%s", secret, unit)
+		}
+	}
+	envPath := filepath.Join(conf.ClashHome, serviceEnvName)
+	if !strings.Contains(unit, "EnvironmentFile=-"+envPath) {
+		t.Fatalf("expected the unit to load %s:\n%s", envPath, unit)
+	}
+
+	if err := writeServiceEnv(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(envPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the environment file to be 0600, got %v", info.Mode().Perm())
+	}
+	bs, _ := os.ReadFile(envPath)
+	want := "TPCLASH_API_PROXY_TOKEN=\"s3cret-token\"\nTPCLASH_API_PROXY_PASSWORD=\"pa\\\"ss\"\nTPCLASH_CONFIG_PASSWORD=\"s3cret-password\"\n"
+	if string(bs) != want {
+		t.Fatalf("unexpected environment file:\n%s", bs)
+	}
+
+	// the secrets are read back from the environment, the command line takes precedence
+	t.Setenv("TPCLASH_API_PROXY_TOKEN", "env-token")
+	t.Setenv("TPCLASH_CONFIG_PASSWORD", "env-password")
+	conf.APIProxyToken, conf.ConfigEncPassword = "", "flag-password"
+	loadServiceSecrets()
+	if conf.APIProxyToken != "env-token" || conf.ConfigEncPassword != "flag-password" {
+		t.Fatalf("unexpected secrets %q %q", conf.APIProxyToken, conf.ConfigEncPassword)
+	}
+}
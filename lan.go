@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// clashListenAddress returns the address the proxy ports(port/socks-port/mixed-port) of clash
+// listen on: loopback without allow-lan, otherwise bind-address('*' for all addresses)
+func clashListenAddress(cc *ClashConf) string {
+	if !cc.AllowLan {
+		return "127.0.0.1"
+	}
+	if cc.BindAddress == "" {
+		return "*"
+	}
+	return cc.BindAddress
+}
+
+// lanBindMismatch explains why lan clients of the gateway can not reach the proxy ports
+// of clash through the lan interface, an empty string is returned if they can or if lan
+// access is not wanted(allow-lan is off and bind-address is not set).
+func lanBindMismatch(cc *ClashConf, lanNic string) string {
+	if cc.Port == 0 && cc.SocksPort == 0 && cc.MixedPort == 0 {
+		return ""
+	}
+	if cc.BindAddress == "" || cc.BindAddress == "*" {
+		return ""
+	}
+	if !cc.AllowLan {
+		return fmt.Sprintf("bind-address %s has no effect without allow-lan, the proxy ports only listen on loopback", cc.BindAddress)
+	}
+
+	ip := net.ParseIP(cc.BindAddress)
+	if ip == nil {
+		return fmt.Sprintf("bind-address %s is not an ip address, clash fails to listen on the proxy ports", cc.BindAddress)
+	}
+	if ip.IsLoopback() {
+		return fmt.Sprintf("bind-address %s is a loopback address, lan clients can not reach the proxy ports although allow-lan is enabled", cc.BindAddress)
+	}
+	nic := interfaceOfIP(ip)
+	if nic == "" {
+		return fmt.Sprintf("bind-address %s is not assigned to any interface, clash fails to listen on the proxy ports", cc.BindAddress)
+	}
+	if lanNic != "" && nic != lanNic {
+		return fmt.Sprintf("bind-address %s is on %s instead of the lan interface %s, lan clients can not reach the proxy ports", cc.BindAddress, nic, lanNic)
+	}
+	return ""
+}
+
+// interfaceOfIP returns the name of the interface the ip is assigned to
+func interfaceOfIP(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logrus.Errorf("[lan] failed to list network interfaces: %v", err)
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// checkLanBind reports the allow-lan/bind-address mismatch according to --lan-bind-check,
+// an error is only returned in strict mode
+func checkLanBind(cc *ClashConf) error {
+	if conf.LanBindCheck == "off" {
+		return nil
+	}
+	logrus.Infof("[lan] clash proxy ports listen on %s", clashListenAddress(cc))
+
+	msg := lanBindMismatch(cc, getMainNic())
+	if msg == "" {
+		return nil
+	}
+	if conf.LanBindCheck == "strict" {
+		return fmt.Errorf("[lan] %s", msg)
+	}
+	logrus.Warnf("[lan] %s(use --lan-bind-check fix to listen on all addresses)", msg)
+	return nil
+}
+
+// autoFixLanBind rewrites a bind-address that lan clients can not reach to '*', the transparent
+// proxy does not depend on it and the gateway forward rules accept the forwarded traffic of
+// all addresses
+func autoFixLanBind(rootNode *yaml.Node) {
+	var cc ClashConf
+	if err := rootNode.Decode(&cc); err != nil {
+		logrus.Errorf("[autofix] failed to decode bind-address config: %v", err)
+		return
+	}
+	if !cc.AllowLan || lanBindMismatch(&cc, getMainNic()) == "" {
+		return
+	}
+
+	var bindAddressNode yaml.Node
+	_ = yaml.Unmarshal([]byte(bindAddressPatch), &bindAddressNode)
+	if !setYamlNode(rootNode, "bind-address", bindAddressNode.Content[0]) {
+		logrus.Error("[autofix] failed to patch bind-address config")
+		return
+	}
+	logrus.Infof("[autofix] bind-address %s is not reachable from the lan, listening on all addresses instead", cc.BindAddress)
+}
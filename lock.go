@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+var instanceNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// instanceLockPath returns the pidfile of the instance(--instance)
+func instanceLockPath() string {
+	if conf.Instance == "" {
+		return filepath.Join(instanceLockDir, "tpclash.pid")
+	}
+	return filepath.Join(instanceLockDir, fmt.Sprintf("tpclash-%s.pid", conf.Instance))
+}
+
+// AcquireInstanceLock makes sure only one tpclash manages the proxy: the pidfile of the
+// instance is locked(flock) for the lifetime of the process. If another instance holds it,
+// an error with its pid is returned, or with --takeover it is stopped first. The returned
+// func removes the pidfile and releases the lock.
+func AcquireInstanceLock() (func(), error) {
+	path := instanceLockPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("[lock] failed to create lock dir: %w", err)
+	}
+
+	var signaled bool
+	deadline := time.Now().Add(instanceTakeoverTimeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("[lock] failed to open %s: %w", path, err)
+		}
+
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// the previous owner may have removed the file between open and flock
+			if sameFile(f, path) {
+				return lockAcquired(f, path)
+			}
+			_ = f.Close()
+			continue
+		}
+		pid := readPidfile(f)
+		_ = f.Close()
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("[lock] failed to lock %s: %w", path, err)
+		}
+
+		if !conf.Takeover {
+			return nil, fmt.Errorf("[lock] another tpclash instance(pid %d) is running(%s), stop it first or use --takeover", pid, path)
+		}
+		if !signaled {
+			logrus.Warnf("[lock] another tpclash instance(pid %d) is running, stopping it(--takeover)...", pid)
+			if pid > 0 {
+				if err = syscall.Kill(pid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+					return nil, fmt.Errorf("[lock] failed to stop tpclash instance(pid %d): %w", pid, err)
+				}
+			}
+			signaled = true
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("[lock] tpclash instance(pid %d) did not exit within %s", pid, instanceTakeoverTimeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func lockAcquired(f *os.File, path string) (func(), error) {
+	if err := f.Truncate(0); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("[lock] failed to write %s: %w", path, err)
+	}
+	if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("[lock] failed to write %s: %w", path, err)
+	}
+
+	return func() {
+		// remove the file before unlocking, a waiting instance re-opens it after the lock
+		_ = os.Remove(path)
+		_ = f.Close()
+	}, nil
+}
+
+// sameFile checks whether the path still refers to the opened file
+func sameFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	pi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(fi, pi)
+}
+
+func readPidfile(f *os.File) int {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	return pid
+}
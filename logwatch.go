@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logPatternRestarter restarts clash when a line of its output matches --restart-on-log, it
+// works around core bugs that keep the process and api alive but log the same error forever.
+type logPatternRestarter struct {
+	core     *ClashCore
+	pattern  *regexp.Regexp
+	cooldown time.Duration
+
+	mu      sync.Mutex
+	line    []byte
+	last    time.Time
+	pending bool
+}
+
+func newLogPatternRestarter(core *ClashCore, pattern *regexp.Regexp, cooldown time.Duration) *logPatternRestarter {
+	return &logPatternRestarter{core: core, pattern: pattern, cooldown: cooldown}
+}
+
+// Write scans the complete lines of the clash output, it is called by the clash output
+// pipe so the restart itself runs in background.
+func (r *logPatternRestarter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.line = append(r.line, p...)
+	for {
+		i := bytes.IndexByte(r.line, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(r.line[:i], "\r"))
+		r.line = r.line[i+1:]
+		if r.pattern.MatchString(line) {
+			r.trigger(line)
+		}
+	}
+	// a core that never writes a newline must not grow the buffer forever
+	if len(r.line) > restartOnLogMaxLine {
+		r.line = r.line[:0]
+	}
+	return len(p), nil
+}
+
+func (r *logPatternRestarter) trigger(line string) {
+	if r.pending {
+		return
+	}
+	if wait := r.cooldown - time.Since(r.last); !r.last.IsZero() && wait > 0 {
+		logrus.Debugf("[core] clash log matched --restart-on-log, restart skipped(cooldown %s left): %s", wait.Round(time.Second), line)
+		return
+	}
+
+	r.last, r.pending = time.Now(), true
+	logrus.Warnf("[core] clash log matched --restart-on-log, restarting clash: %s", line)
+	go func() {
+		defer func() {
+			r.mu.Lock()
+			r.pending = false
+			r.mu.Unlock()
+		}()
+
+		if err := r.core.Restart(); err != nil {
+			logrus.Errorf("[core] failed to restart clash: %v", err)
+			DesktopNotify("TPClash core restart failed", "failed to restart clash: %v", err)
+			return
+		}
+		setServiceState(StateReady, "")
+		DesktopNotify("TPClash core restarted", "clash log matched --restart-on-log: %s", line)
+	}()
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -29,7 +32,7 @@ var conf TPClashConf
 var rootCmd = &cobra.Command{
 	Use:   "tpclash",
 	Short: "Transparent proxy tool for Clash",
-	Run: func(_ *cobra.Command, _ []string) {
+	Run: func(c *cobra.Command, _ []string) {
 		fmt.Printf("%s\nVersion: %s\nBuild: %s\nClash Core: %s\nCommit: %s\n\n", logo, version, build, clash, commit)
 
 		if conf.PrintVersion {
@@ -39,63 +42,319 @@ var rootCmd = &cobra.Command{
 		if conf.Debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		switch conf.LogFormat {
+		case "text":
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		default:
+			fatalf(ExitConfigInvalid, "[main] unsupported log format: %s(text|json)", conf.LogFormat)
+		}
 
 		logrus.Info("[main] starting tpclash...")
 
+		// An explicitly set check interval takes precedence over the provider recommendation
+		conf.CheckIntervalFixed = c.Flags().Changed("check-interval")
+
+		// Guard the ssh session of an administrator running tpclash by hand
+		if !c.Flags().Changed("ssh-safe") {
+			client, _ := sshSession()
+			conf.SSHSafe = client != nil && isTerminal(int(os.Stdin.Fd()))
+		}
+
 		// Initialize signal control Context
 		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 		defer cancel()
 
+		// A closed stdout/stderr must not kill tpclash with SIGPIPE, the failed writes are dropped
+		signal.Notify(make(chan os.Signal, 1), syscall.SIGPIPE)
+
+		loadServiceSecrets()
+		if err := validateFlags(); err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		if err := ResolveTools(); err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+
+		releaseLock, err := AcquireInstanceLock()
+		if err != nil {
+			fatal(ExitGeneral, err)
+		}
+		defer releaseLock()
+
+		if conf.HealthAddr != "" {
+			stopHealthServer, err := StartHealthServer(conf.HealthAddr)
+			if err != nil {
+				fatal(ExitGeneral, err)
+			}
+			defer stopHealthServer()
+		}
+		if conf.MetricsTextfile != "" {
+			defer StartMetricsTextfile(conf.MetricsTextfile, conf.MetricsInterval)()
+		}
+
+		proxyMode, err := NewProxyMode(&conf)
+		if err != nil {
+			fatal(ExitProxySetup, err)
+		}
+
 		// Configure Sysctl
 		Sysctl()
 
+		// Detect other transparent proxy tools before clash takes over the network
+		if err = CheckProxyConflicts(); err != nil {
+			fatal(ExitProxySetup, err)
+		}
+
 		// Extract Clash executable and built-in configuration files
 		ExtractFiles()
+		if err = PrepareAssetDir(); err != nil {
+			fatal(ExitCoreStart, err)
+		}
+		if err = PrepareCacheFile(); err != nil {
+			fatal(ExitCoreStart, err)
+		}
+
+		// The phases of the startup are exported as one trace(--otel-endpoint)
+		trace := startTrace("startup", map[string]string{"config.remote": strconv.FormatBool(isRemoteConfig())})
 
 		// Watch config file
 		updateCh := WatchConfig(ctx)
 
 		// Wait for the first config to return
+		end := trace.Phase("fetch")
 		clashConfStr := <-updateCh
+		end(nil)
+
+		// Keep the current internal config while frozen, the fetched config is held
+		var heldConfStr string
+		if conf.Frozen {
+			if err := Freeze(); err != nil {
+				fatalf(ExitGeneral, "[main] failed to freeze config: %v", err)
+			}
+		}
+		if IsFrozen() {
+			if bs, err := os.ReadFile(filepath.Join(conf.ClashHome, InternalConfigName)); err == nil {
+				logrus.Warn("[main] config is frozen, starting with the current internal config...")
+				heldConfStr, clashConfStr = clashConfStr, string(bs)
+			}
+		}
 
 		// Check clash config
-		cc, err := CheckConfig(clashConfStr)
+		end = trace.Phase("check")
+		cc, err := ValidateConfig(clashConfStr)
+		end(err)
 		if err != nil {
-			logrus.Fatal(err)
+			fatal(ExitConfigInvalid, err)
+		}
+		if err = checkLanBind(cc); err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		if conf.ResolveServers {
+			warnUnresolvedServers(cc)
+		}
+		// the staged assets of a config bundle belong to the fetched config, not to the
+		// internal config a frozen instance starts with
+		if heldConfStr == "" {
+			if err = takeBundleStage().commit(); err != nil {
+				fatal(ExitCoreStart, err)
+			}
+		}
+		if missing := CheckAssets(clashConfStr); len(missing) > 0 {
+			logrus.Warnf("[main] assets referenced by the config are missing in the clash asset dir %s:\n  - %s", clashAssetDir(), strings.Join(missing, "\n  - "))
 		}
 
-		// Copy remote or local clash config file to internal path
-		clashConfPath := filepath.Join(conf.ClashHome, InternalConfigName)
-		if err = os.WriteFile(clashConfPath, []byte(clashConfStr), 0644); err != nil {
-			logrus.Fatalf("[main] failed to copy clash config: %v", err)
+		// Copy remote or local clash config file to internal path, in in-memory mode
+		// clash is started with a tmpfs copy that is removed on exit
+		clashConfPath, clashConfPerm := filepath.Join(conf.ClashHome, InternalConfigName), os.FileMode(0644)
+		if conf.InMemory {
+			inMemoryConfig.Store(&clashConfStr)
+			clashConfPath = filepath.Join(inMemoryConfigDir(), fmt.Sprintf("tpclash-%d.yaml", os.Getpid()))
+			clashConfPerm = 0600
+			defer func() { _ = os.Remove(clashConfPath) }()
+			logrus.Infof("[main] in-memory mode enabled, nothing will be persisted to %s", conf.ClashHome)
+		}
+		end = trace.Phase("write")
+		err = WriteFileAtomic(clashConfPath, []byte(clashConfStr), clashConfPerm)
+		end(err)
+		if err != nil {
+			fatalf(ExitCoreStart, "[main] failed to copy clash config: %v", err)
 		}
 
 		// Create child process
 		clashBinPath := filepath.Join(conf.ClashHome, InternalClashBinName)
-		clashUIPath := filepath.Join(conf.ClashHome, conf.ClashUI)
-		cmd := exec.Command(clashBinPath, "-f", clashConfPath, "-d", conf.ClashHome, "-ext-ui", clashUIPath)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.SysProcAttr = &syscall.SysProcAttr{
-			AmbientCaps: []uintptr{CAP_NET_BIND_SERVICE, CAP_NET_ADMIN, CAP_NET_RAW},
+		clashArgs := []string{"-f", clashConfPath, "-d", clashAssetDir()}
+		if CheckUI() {
+			clashArgs = append(clashArgs, "-ext-ui", filepath.Join(conf.ClashHome, conf.ClashUI))
+		} else {
+			logrus.Warnf("[main] no valid dashboard available, starting clash without dashboard(-ext-ui)...")
+		}
+		// clash(auto-route) takes over the routing as soon as it starts, the bypass must be
+		// in place before that. It is kept until clash has stopped, fatal exits remove it as well.
+		if conf.SSHSafe {
+			if err = EnableSSHBypass(); err != nil {
+				logrus.Error(err)
+			} else {
+				disableSSHBypass := func() {
+					if err := DisableSSHBypass(); err != nil {
+						logrus.Error(err)
+					}
+				}
+				logrus.RegisterExitHandler(disableSSHBypass)
+				defer disableSSHBypass()
+			}
+		}
+		core := NewClashCore(clashBinPath, clashArgs...)
+		core.Nice = conf.ClashNice
+		core.IOPrio, _ = parseIONice(conf.ClashIONice)
+		if conf.InMemory {
+			// restarts must not fall back to the startup config
+			core.PreStart = func() error {
+				return WriteFileAtomic(clashConfPath, []byte(*inMemoryConfig.Load()), clashConfPerm)
+			}
+		}
+		// the recent clash logs are printed if clash never becomes ready, and dumped with --crash-dump
+		clashLogs := newLogRing(startupLogSize)
+		if conf.CrashDump {
+			clashLogs = newLogRing(diagnosticsLogSize)
+		}
+		clashOutput := drainWriter{clashLogs}
+		if conf.RestartOnLog != "" {
+			restarter := newLogPatternRestarter(core, regexp.MustCompile(conf.RestartOnLog), conf.RestartOnLogCooldown)
+			clashOutput = append(clashOutput, restarter)
+		}
+		if conf.AutoRollback {
+			// the window before the reload is compared with the window after it
+			clashErrors = newLogErrorCounter(2 * conf.RollbackWindow)
+			clashOutput = append(clashOutput, clashErrors)
+		}
+		core.Output = clashOutput
+		core.OnCrash = func(err error) {
+			metricCoreCrashes.Add(1)
+			setServiceState(StateDegraded, fmt.Sprintf("clash process exited unexpectedly: %v", err))
+			if conf.CrashDump {
+				WriteDiagnostics("crash", clashLogs)
+			}
+		}
+		end = trace.Phase("core-start")
+		err = core.Start()
+		end(err)
+		if err != nil {
+			fatal(ExitCoreStart, err)
+		}
+		if conf.WatchCoreBinary {
+			if err = WatchCoreBinary(ctx, core); err != nil {
+				logrus.Errorf("[main] failed to watch clash binary: %v", err)
+			}
 		}
-		logrus.Infof("[main] running cmds: %v", cmd.Args)
 
-		if err = cmd.Start(); err != nil {
-			logrus.Fatalf("[main] failed to start clash process: %v: %v", err, cmd.Args)
-			cancel()
+		currentClashConf.Store(cc)
+
+		// Subsequent remote config fetches can go through clash once it's up
+		SetFetchProxy(cc)
+
+		if len(conf.GroupDefaults) > 0 {
+			go func() {
+				if err := WaitClashAPI(cc, clashLogs); err != nil {
+					logrus.Errorf("[main] failed to apply group defaults: %v", err)
+					return
+				}
+				ApplyGroupDefaults(cc)
+			}()
 		}
-		if cmd.Process == nil {
-			logrus.Fatalf("[main] failed to start clash process: %v", cmd.Args)
-			cancel()
+
+		if conf.APIProxyAddr != "" {
+			if host, _, err := net.SplitHostPort(cc.ExternalController); err == nil && !net.ParseIP(host).IsLoopback() {
+				logrus.Warnf("[main] clash api(%s) is not bound to loopback, it is still directly accessible", cc.ExternalController)
+			}
+			if err = StartAPIProxy(ctx); err != nil {
+				logrus.Errorf("[main] failed to start api proxy: %v", err)
+			}
+		}
+
+		var unhealthyGroups, healthyGroups int
+		if conf.RequireHealthyProxy {
+			if err = WaitClashAPI(cc, clashLogs); err != nil {
+				_ = core.Stop(coreStopTimeout)
+				fatal(ExitCoreStart, err)
+			}
+			logrus.Info("[main] checking proxy health...")
+			end = trace.Phase("proxy-health")
+			unhealthy, healthy, err := CheckProxyHealth(cc)
+			unhealthyGroups, healthyGroups = len(unhealthy), healthy
+			end(err)
+			if err != nil {
+				_ = core.Stop(coreStopTimeout)
+				fatal(ExitCoreStart, err)
+			}
+			if len(unhealthy) > 0 {
+				logrus.Warnf("[main] proxy groups without any working node: %s", strings.Join(unhealthy, ", "))
+			}
+			if healthy < conf.HealthyGroupsMin {
+				_ = core.Stop(coreStopTimeout)
+				fatalf(ExitProxySetup, "[main] only %d proxy groups have a working node, at least %d required(--healthy-groups-min)", healthy, conf.HealthyGroupsMin)
+			}
+			logrus.Infof("[main] %d proxy groups have a working node", healthy)
+		}
+
+		if conf.Confirm {
+			ok, err := ConfirmProxy(proxyMode)
+			if err != nil {
+				_ = core.Stop(coreStopTimeout)
+				fatal(ExitProxySetup, err)
+			}
+			if !ok {
+				_ = core.Stop(coreStopTimeout)
+				fatal(ExitProxySetup, "[main] the proxy changes were not confirmed, exiting...")
+			}
 		}
 
-		if err = EnableDockerCompatible(); err != nil {
-			logrus.Errorf("[main] failed enable docker compatible: %v", err)
+		end = trace.Phase("enable-proxy")
+		err = proxyMode.EnableProxy()
+		end(err)
+		trace.End(err)
+		if err != nil {
+			logrus.Errorf("[main] failed to enable proxy: %v", err)
+			setServiceState(StateDegraded, fmt.Sprintf("failed to enable proxy: %v", err))
+		} else if unhealthyGroups > 0 && healthyGroups == 0 {
+			setServiceState(StateDegraded, "no proxy group has a working node")
+		} else {
+			setServiceState(StateReady, "")
 		}
 
 		// Watch clash config changes, and automatically reload the config
-		go AutoReload(updateCh, clashConfPath)
+		go AutoReload(HoldUpdates(ctx, updateCh, heldConfStr), clashConfPath)
+
+		if conf.ControlSocket != "" {
+			if err = ServeControlSocket(ctx, conf.ControlSocket, proxyMode, clashConfPath); err != nil {
+				logrus.Error(err)
+			} else {
+				defer func() { _ = os.Remove(conf.ControlSocket) }()
+			}
+		}
+
+		if conf.ConfigFifo != "" {
+			if err = ServeConfigFifo(ctx, conf.ConfigFifo, clashConfPath); err != nil {
+				logrus.Error(err)
+			} else {
+				defer func() { _ = os.Remove(conf.ConfigFifo) }()
+			}
+		}
+
+		if conf.ReloadOnInterfaceChange {
+			// the current config is sent through the reload loop like every other update, so the
+			// reload is serialized with them and passes freeze and the config checks
+			err = WatchDefaultRoute(ctx, interfaceChangeDebounce, func() {
+				logrus.Info("[main] default route changed, reloading clash config...")
+				select {
+				case routeChangeCh <- struct{}{}:
+				default:
+				}
+			})
+			if err != nil {
+				logrus.Errorf("[main] failed to watch interface changes: %v", err)
+			}
+		}
 
 		logrus.Info("[main] 🍄 提莫队长正在待命...")
 		if conf.Test {
@@ -105,6 +364,17 @@ var rootCmd = &cobra.Command{
 				cancel()
 			}()
 		}
+		if conf.Once > 0 {
+			logrus.Warnf("[main] once mode enabled, tpclash will tear down and exit after %s...", conf.Once)
+			go func() {
+				select {
+				case <-time.After(conf.Once):
+					logrus.Infof("[main] once mode: %s elapsed, stopping...", conf.Once)
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+		}
 
 		if conf.EnableTracing {
 			logrus.Infof("[main] 🔪 永远不要忘记, 吾等为何而战...")
@@ -119,8 +389,12 @@ var rootCmd = &cobra.Command{
 
 		<-ctx.Done()
 		logrus.Info("[main] 🛑 TPClash 正在停止...")
-		if err = DisableDockerCompatible(); err != nil {
-			logrus.Errorf("[main] failed disable docker compatible: %v", err)
+		setServiceState(StateStopping, "")
+		if conf.ShutdownGrace > 0 {
+			forceShutdownOnSignal(core, conf.ShutdownGrace)
+		}
+		if err = proxyMode.DisableProxy(); err != nil {
+			logrus.Errorf("[main] failed to disable proxy: %v", err)
 		}
 
 		if conf.EnableTracing {
@@ -134,10 +408,11 @@ var rootCmd = &cobra.Command{
 			}
 		}
 
-		if cmd.Process != nil {
-			if err := cmd.Process.Signal(syscall.SIGINT); err != nil {
-				logrus.Error(err)
-			}
+		if conf.CrashDump {
+			WriteDiagnostics("shutdown", clashLogs)
+		}
+		if err = core.Stop(coreStopTimeout); err != nil {
+			logrus.Error(err)
 		}
 
 		logrus.Info("[main] 🛑 TPClash 已关闭!")
@@ -147,20 +422,98 @@ var rootCmd = &cobra.Command{
 func init() {
 	cobra.EnableCommandSorting = false
 
-	rootCmd.AddCommand(encCmd, decCmd, installCmd, uninstallCmd, upgradeCmd)
+	rootCmd.AddCommand(encCmd, decCmd, installCmd, uninstallCmd, upgradeCmd, exportStateCmd, importStateCmd, freezeCmd, unfreezeCmd, exportRulesCmd, validateCmd, testDNSCmd, featuresCmd, topCmd, redactCmd, installServiceCmd, reloadCmd, pauseCmd, resumeCmd, statusCmd, rollbackCmd)
 
 	rootCmd.PersistentFlags().BoolVar(&conf.Debug, "debug", false, "enable debug log")
+	rootCmd.PersistentFlags().StringVar(&conf.LogFormat, "log-format", "text", "log format(text|json)")
+	rootCmd.PersistentFlags().BoolVar(&conf.WatchCoreBinary, "watch-core-binary", false, "restart clash when its binary is replaced by an external updater")
+	rootCmd.PersistentFlags().BoolVar(&conf.AutoRollback, "auto-rollback", false, "restore the previous config if clash errors spike after a reload")
+	rootCmd.PersistentFlags().DurationVar(&conf.RollbackWindow, "rollback-window", time.Minute, "window after a reload whose clash errors are compared with the same window before it(--auto-rollback)")
+	rootCmd.PersistentFlags().Float64Var(&conf.RollbackFactor, "rollback-factor", 3, "roll back if the errors after the reload exceed the errors before it by this factor(--auto-rollback)")
+	rootCmd.PersistentFlags().IntVar(&conf.RollbackMinErrors, "rollback-min-errors", 10, "minimum errors after the reload before a rollback is considered(--auto-rollback)")
+	rootCmd.PersistentFlags().StringVar(&conf.RestartOnLog, "restart-on-log", "", "restart clash when a line of its output matches the regexp(e.g. 'too many open files')")
+	rootCmd.PersistentFlags().DurationVar(&conf.RestartOnLogCooldown, "restart-on-log-cooldown", 10*time.Minute, "minimum interval between restarts triggered by --restart-on-log")
+	rootCmd.PersistentFlags().BoolVar(&conf.CrashDump, "crash-dump", false, "dump clash connections and recent logs to the diagnostics dir on shutdown or clash crash")
+	rootCmd.PersistentFlags().BoolVar(&conf.RequireHealthyProxy, "require-healthy-proxy", false, "delay test the proxy groups at startup, exit if not enough groups have a working node")
+	rootCmd.PersistentFlags().IntVar(&conf.HealthyGroupsMin, "healthy-groups-min", 1, "minimum number of proxy groups with a working node(--require-healthy-proxy)")
+	rootCmd.PersistentFlags().DurationVar(&conf.StartupTimeout, "startup-timeout", 30*time.Second, "total time to wait for the clash api to become ready after start")
+	rootCmd.PersistentFlags().DurationVar(&conf.ProbeTimeout, "probe-timeout", 2*time.Second, "timeout of each clash api readiness probe")
+	rootCmd.PersistentFlags().DurationVar(&conf.ProbeInterval, "probe-interval", 500*time.Millisecond, "interval between clash api readiness probes, doubled(up to 5s) while clash does not respond")
+	rootCmd.PersistentFlags().BoolVar(&conf.Confirm, "confirm", false, "print the network changes of the proxy mode and ask for confirmation before applying them")
+	rootCmd.PersistentFlags().BoolVar(&conf.SSHSafe, "ssh-safe", false, "keep the current ssh session(SSH_CONNECTION) out of the proxy, default to on when run interactively over ssh")
+	rootCmd.PersistentFlags().DurationVar(&conf.ShutdownGrace, "shutdown-grace", 30*time.Second, "a second SIGINT/SIGTERM within this window after the first forces an immediate exit, 0 to disable")
+	rootCmd.PersistentFlags().DurationVar(&conf.Once, "once", 0, "keep the proxy up for the duration, then tear down and exit(e.g. 30m)")
 	rootCmd.PersistentFlags().BoolVar(&conf.Test, "test", false, "enable test mode, tpclash will automatically exit after 5 minutes")
 	rootCmd.PersistentFlags().StringVarP(&conf.ClashHome, "home", "d", "/data/clash", "clash home dir")
+	rootCmd.PersistentFlags().StringVar(&conf.ClashAssetDir, "clash-asset-dir", "", "dir clash resolves relative assets(geo databases/providers/cache.db) against(clash -d), default to clash home dir")
+	rootCmd.PersistentFlags().StringVar(&conf.CacheFile, "cache-file", "", "pin the clash cache database(proxy selections/fake-ip) to this path, cache.db in the asset dir is linked to it")
+	rootCmd.PersistentFlags().StringVar(&conf.HealthAddr, "health-addr", "", "serve the service state(starting/ready/degraded/reloading/stopping) on http://<addr>/healthz")
+	rootCmd.PersistentFlags().StringVar(&conf.MetricsTextfile, "metrics-textfile", "", "periodically write prometheus metrics to the file for the node_exporter textfile collector(e.g. /var/lib/node_exporter/tpclash.prom)")
+	rootCmd.PersistentFlags().DurationVar(&conf.MetricsInterval, "metrics-interval", 15*time.Second, "interval of writing --metrics-textfile")
+	rootCmd.PersistentFlags().StringVar(&conf.OtelEndpoint, "otel-endpoint", "", "export traces of the startup/reload pipeline to the OTLP/HTTP endpoint(e.g. http://127.0.0.1:4318)")
+	rootCmd.PersistentFlags().StringVar(&conf.ReloadTriggerFile, "reload-trigger-file", "", "fetch and reload the config when the file is touched or written(e.g. /run/tpclash.reload)")
+	rootCmd.PersistentFlags().StringVar(&conf.ControlSocket, "control-socket", "", "unix socket of the control api(reload/pause/resume/freeze/status/rollback), also used by the subcommands(e.g. /run/tpclash.sock)")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigFifo, "config-fifo", "", "named pipe that serves the effective clash config to each reader(e.g. /run/tpclash.fifo)")
+	rootCmd.PersistentFlags().BoolVar(&conf.RedactFifo, "redact-fifo", false, "redact secrets and proxy credentials in the config served by --config-fifo")
+	rootCmd.PersistentFlags().StringVar(&conf.AssetOverlay, "asset-overlay", "", "dir whose files shadow the embedded assets with the same name during extraction")
+	rootCmd.PersistentFlags().StringVar(&conf.LanBindCheck, "lan-bind-check", "warn", "how a bind-address that lan clients can not reach(allow-lan) is handled(warn/fix/strict/off), fix rewrites it to '*'")
+	rootCmd.PersistentFlags().StringVar(&conf.ClashInterface, "clash-interface", "", "bind clash outbound connections to the interface(interface-name)")
 	rootCmd.PersistentFlags().StringVarP(&conf.ClashConfig, "config", "c", "/etc/clash.yaml", "clash config local path or remote url")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigBundle, "config-bundle", "", "signed bundle(tar url or file) of the clash config and its assets, replaces --config(requires --verify-key)")
+	rootCmd.PersistentFlags().StringVar(&conf.VerifyKey, "verify-key", "", "minisign public key(file or base64) to verify the upgrade files and the --config-bundle manifest")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigOverrideDir, "config-override-dir", "", "directory of yaml fragments deep-merged on top of the clash config")
+	rootCmd.PersistentFlags().StringVar(&conf.RulesPosition, "rules-position", "replace", "where rules of override fragments land(replace/prepend/append)")
+	rootCmd.PersistentFlags().StringVar(&conf.OnDuplicate, "on-duplicate", "rename", "how duplicate proxy names are resolved when merging override fragments(rename/skip/replace/error)")
 	rootCmd.PersistentFlags().StringVarP(&conf.ClashUI, "ui", "u", "yacd", "clash dashboard(official|yacd)")
-	rootCmd.PersistentFlags().DurationVarP(&conf.CheckInterval, "check-interval", "i", 120*time.Second, "remote config check interval")
+	rootCmd.PersistentFlags().DurationVarP(&conf.CheckInterval, "check-interval", "i", 120*time.Second, "remote config check interval, defaults to the interval recommended by the subscription provider")
 	rootCmd.PersistentFlags().StringSliceVar(&conf.HttpHeader, "http-header", []string{}, "http header when requesting a remote config(key=value)")
 	rootCmd.PersistentFlags().DurationVar(&conf.HttpTimeout, "http-timeout", 10*time.Second, "http request timeout when requesting a remote config")
-	rootCmd.PersistentFlags().StringVar(&conf.ConfigEncPassword, "config-password", "", "the password for encrypting the config file")
+	rootCmd.PersistentFlags().BoolVar(&conf.FetchViaProxy, "fetch-via-proxy", false, "fetch remote config through clash once it's up")
+	rootCmd.PersistentFlags().DurationVar(&conf.APIKeepAlive, "api-keepalive", 30*time.Second, "tcp keepalive period of the clash api connections")
+	rootCmd.PersistentFlags().DurationVar(&conf.APIIdleTimeout, "api-idle-timeout", 90*time.Second, "max idle time of the clash api connections before closing")
+	rootCmd.PersistentFlags().BoolVar(&conf.StaleWhileRevalidate, "swr", false, "start with the cached remote config, and reload after the fresh one is fetched")
+	rootCmd.PersistentFlags().StringVar(&conf.SSHKey, "ssh-key", "", "ssh private key of sftp config sources, ssh-agent is used if not set")
+	rootCmd.PersistentFlags().StringVar(&conf.SSHKnownHosts, "ssh-known-hosts", "/root/.ssh/known_hosts", "known hosts file used to verify sftp servers")
+	rootCmd.PersistentFlags().StringVar(&conf.FetchResolver, "fetch-resolver", "", "dns server used to resolve the remote config host(ip[:port])")
+	rootCmd.PersistentFlags().StringVar(&conf.FetchHostIP, "fetch-host-ip", "", "pin the remote config host to the ip, bypassing dns")
+	rootCmd.PersistentFlags().StringVar(&conf.APIProxyAddr, "api-proxy-addr", "", "expose clash api through an authenticated reverse proxy on this address")
+	rootCmd.PersistentFlags().StringVar(&conf.APIProxyToken, "api-proxy-token", "", "bearer token of the api reverse proxy(env TPCLASH_API_PROXY_TOKEN)")
+	rootCmd.PersistentFlags().StringVar(&conf.APIProxyUser, "api-proxy-user", "", "basic auth user of the api reverse proxy")
+	rootCmd.PersistentFlags().StringVar(&conf.APIProxyPassword, "api-proxy-password", "", "basic auth password of the api reverse proxy(env TPCLASH_API_PROXY_PASSWORD)")
+	rootCmd.PersistentFlags().StringVar(&conf.ConfigEncPassword, "config-password", "", "the password for encrypting the config file(env TPCLASH_CONFIG_PASSWORD)")
+	rootCmd.PersistentFlags().StringVar(&conf.ProxyMode, "proxy-mode", "tun", "transparent proxy mode")
+	rootCmd.PersistentFlags().Uint32Var(&conf.ProxyFwmark, "proxy-fwmark", 0, "only route packets carrying this fwmark(set by another tool) to the clash tun, 0 routes all traffic")
 	rootCmd.PersistentFlags().StringVar(&conf.AutoFixMode, "auto-fix", "", "automatically repair config(tun/ebpf)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.RoutePorts, "route-port", []string{}, "route destination port to a specific proxy group(port=group)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.GroupDefaults, "group-default", []string{}, "pin a select group to the proxy after each reload(group=proxy)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.GroupTestURLs, "group-test-url", []string{}, "override the test url of a url-test/fallback/load-balance group(group=url)")
+	rootCmd.PersistentFlags().StringSliceVar(&conf.GroupTestIntervals, "group-test-interval", []string{}, "override the test interval of a url-test/fallback/load-balance group(group=duration, e.g. 5m)")
+	rootCmd.PersistentFlags().StringArrayVar(&conf.Schedules, "schedule", []string{}, "switch to the config file at the times matching the cron expression, 'default' switches back to --config(\"0 22 * * *=>/etc/clash/night.yaml\")")
+	rootCmd.PersistentFlags().BoolVar(&conf.AutoFixStrict, "autofix-strict", false, "fail instead of applying auto-fix changes, and report the changes")
+	rootCmd.PersistentFlags().BoolVar(&conf.VerifyAutoFix, "verify-autofix", false, "re-run auto-fix on its own output on each reload and warn if it is not idempotent")
+	rootCmd.PersistentFlags().BoolVar(&conf.Frozen, "frozen", false, "start with config frozen, remote updates are held until unfreeze")
+	rootCmd.PersistentFlags().BoolVar(&conf.Notrack, "notrack", false, "disable connection tracking for traffic to the clash fake-ip range")
+	rootCmd.PersistentFlags().BoolVar(&conf.ClampMSS, "clamp-mss", false, "clamp the tcp mss of forwarded traffic to the route mtu")
+	rootCmd.PersistentFlags().IntVar(&conf.TunMTU, "tun-mtu", 0, "set the clash tun device mtu(tun.mtu), 0 keeps the config value")
+	rootCmd.PersistentFlags().StringVar(&conf.NftBin, "nft-bin", "", "absolute path of the nft command(--rules-file), default to the one in PATH")
+	rootCmd.PersistentFlags().IntVar(&conf.ClashNice, "clash-nice", 0, "niceness of the clash process(-20 to 19, negative values raise the priority)")
+	rootCmd.PersistentFlags().StringVar(&conf.ClashIONice, "clash-ionice", "", "io scheduling class of the clash process(idle|best-effort[:0-7]|realtime[:0-7])")
+	rootCmd.PersistentFlags().StringVar(&conf.Instance, "instance", "", "instance name, only one tpclash runs per instance(pidfile /run/tpclash-<instance>.pid)")
+	rootCmd.PersistentFlags().BoolVar(&conf.Takeover, "takeover", false, "stop the running tpclash instance instead of refusing to start")
+	rootCmd.PersistentFlags().StringVar(&conf.RulesFile, "rules-file", "", "apply a pre-generated nftables rules file(export-rules) instead of building rules")
+	rootCmd.PersistentFlags().StringVar(&conf.ReloadBody, "reload-body", "path", "how the config is passed to clash on reload(path/inline), inline sends the whole config in the request")
+	rootCmd.PersistentFlags().BoolVar(&conf.InMemory, "in-memory", false, "keep the config in memory only, nothing is persisted(no caches/backups/state)")
+	rootCmd.PersistentFlags().BoolVar(&conf.ValidateLocalEdits, "validate-local-edits", false, "test local config edits with the clash core before reloading")
+	rootCmd.PersistentFlags().BoolVar(&conf.CanonicalOutput, "canonical-output", false, "sort the proxies, proxy groups and(if provably safe) rules of the internal config into a stable order")
+	rootCmd.PersistentFlags().BoolVar(&conf.ResolveServers, "resolve-servers", false, "warn about proxy servers whose hostname does not resolve at startup and on each reload")
+	rootCmd.PersistentFlags().BoolVar(&conf.DryRunReload, "dry-run-reload", false, "validate config changes without applying them to the running clash")
+	rootCmd.PersistentFlags().BoolVar(&conf.NoValidateCache, "no-validate-cache", false, "always validate the config, ignoring the validation cache")
 	rootCmd.PersistentFlags().BoolVar(&conf.ForceExtract, "force-extract", false, "extract files force")
+	rootCmd.PersistentFlags().BoolVar(&conf.ForceExtractUI, "force-extract-ui", false, "extract the dashboards even if the embedded version is unchanged")
+	rootCmd.PersistentFlags().BoolVar(&conf.ReloadOnInterfaceChange, "reload-on-interface-change", false, "reload clash config when the default route changes")
+	rootCmd.PersistentFlags().BoolVar(&conf.StrictProxy, "strict-proxy", false, "refuse to start(or resume/reload) when conflicting transparent proxy tools are detected, only nftables tables/chains with known tool names, foreign fwmark/table ip rules and known proxy processes are checked")
 	rootCmd.PersistentFlags().BoolVar(&conf.AllowStandardDNSPort, "allow-standard-dns", false, "allow standard DNS port")
+	rootCmd.PersistentFlags().BoolVar(&conf.DesktopNotify, "desktop-notify", false, "send desktop notifications on reload/errors(requires build tag dbus)")
 	rootCmd.PersistentFlags().BoolVarP(&conf.PrintVersion, "version", "v", false, "version for tpclash")
 
 	if branch == "premium" {
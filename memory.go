@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inMemoryConfig is the running clash config in in-memory mode(--in-memory),
+// reloads pass it to clash inline instead of writing the internal config.
+var inMemoryConfig atomic.Pointer[string]
+
+// inMemoryConfigDir returns a tmpfs dir for the config file clash is started with
+func inMemoryConfigDir() string {
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// disableClashPersistence stops clash from storing the selected proxies and fake-ip mappings
+func disableClashPersistence(c string) (string, error) {
+	var rootNode, profile yaml.Node
+	if err := yaml.Unmarshal([]byte(c), &rootNode); err != nil {
+		return c, fmt.Errorf("[memory] failed to unmarshal yaml config: %w", err)
+	}
+	if len(rootNode.Content) == 0 || rootNode.Content[0].Kind != yaml.MappingNode {
+		return c, fmt.Errorf("[memory] clash config is not a yaml mapping")
+	}
+	if err := yaml.Unmarshal([]byte("profile: {store-selected: false, store-fake-ip: false}"), &profile); err != nil {
+		return c, err
+	}
+
+	mergeYamlNode(rootNode.Content[0], profile.Content[0])
+
+	bs, err := marshalYamlNode(&rootNode)
+	if err != nil {
+		return c, fmt.Errorf("[memory] failed to marshal yaml config: %w", err)
+	}
+	return string(bs), nil
+}
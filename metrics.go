@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tpclash counters, they are exported together with the live state by writeMetrics
+var (
+	metricReloadsOK     atomic.Int64
+	metricReloadsFailed atomic.Int64
+	metricCoreCrashes   atomic.Int64
+	metricRollbacks     atomic.Int64
+)
+
+// writeMetrics writes all metrics in the prometheus text exposition format, it is the single
+// registry shared by the /metrics endpoint(--health-addr) and the textfile(--metrics-textfile).
+func writeMetrics(w io.Writer) {
+	metric := func(name, typ, help string, samples ...string) {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, s := range samples {
+			_, _ = fmt.Fprintf(w, "%s%s\n", name, s)
+		}
+	}
+
+	metric("tpclash_info", "gauge", "Version of tpclash and the embedded clash core.",
+		fmt.Sprintf(`{version=%q,clash=%q} 1`, version, clash))
+
+	serviceStatusMu.Lock()
+	status := serviceStatus
+	serviceStatusMu.Unlock()
+	var states []string
+	for _, s := range []ServiceState{StateStarting, StateReady, StateDegraded, StateReloading, StateStopping} {
+		v := 0
+		if s == status.State {
+			v = 1
+		}
+		states = append(states, fmt.Sprintf(`{state=%q} %d`, s, v))
+	}
+	metric("tpclash_state", "gauge", "Current service state of tpclash.", states...)
+	metric("tpclash_state_since_seconds", "gauge", "Unix time the current service state was entered.",
+		fmt.Sprintf(" %d", status.Since.Unix()))
+
+	metric("tpclash_reloads_total", "counter", "Config reloads of the running clash by result.",
+		fmt.Sprintf(`{result="success"} %d`, metricReloadsOK.Load()),
+		fmt.Sprintf(`{result="failure"} %d`, metricReloadsFailed.Load()))
+	metric("tpclash_rollbacks_total", "counter", "Reloads rolled back by --auto-rollback.",
+		fmt.Sprintf(" %d", metricRollbacks.Load()))
+	metric("tpclash_core_crashes_total", "counter", "Unexpected exits of the clash process.",
+		fmt.Sprintf(" %d", metricCoreCrashes.Load()))
+
+	// the config applied by the last successful reload, the proxies of proxy-providers are not
+	// part of it
+	if cc := currentClashConf.Load(); cc != nil {
+		metric("tpclash_config_proxies", "gauge", "Proxies defined in the applied clash config.", fmt.Sprintf(" %d", len(cc.Proxies)))
+		metric("tpclash_config_groups", "gauge", "Proxy groups defined in the applied clash config.", fmt.Sprintf(" %d", len(cc.ProxyGroups)))
+		metric("tpclash_config_rules", "gauge", "Rules defined in the applied clash config.", fmt.Sprintf(" %d", len(cc.Rules)))
+	}
+
+	var conns struct {
+		UploadTotal   int64             `json:"uploadTotal"`
+		DownloadTotal int64             `json:"downloadTotal"`
+		Connections   []json.RawMessage `json:"connections"`
+	}
+	up := 0
+	if cc := currentClashConf.Load(); cc != nil {
+		if bs, err := clashAPIRequest(cc, "GET", "/connections", nil); err != nil {
+			logrus.Debugf("[metrics] failed to get clash connections: %v", err)
+		} else if err = json.Unmarshal(bs, &conns); err != nil {
+			logrus.Debugf("[metrics] failed to decode clash connections: %v", err)
+		} else {
+			up = 1
+		}
+	}
+	metric("clash_up", "gauge", "Whether the clash api responded.", fmt.Sprintf(" %d", up))
+	if up == 1 {
+		metric("clash_connections", "gauge", "Active connections of clash.", fmt.Sprintf(" %d", len(conns.Connections)))
+		metric("clash_upload_bytes_total", "counter", "Bytes uploaded through clash since it started.", fmt.Sprintf(" %d", conns.UploadTotal))
+		metric("clash_download_bytes_total", "counter", "Bytes downloaded through clash since it started.", fmt.Sprintf(" %d", conns.DownloadTotal))
+	}
+}
+
+// StartMetricsTextfile writes the metrics to the file every interval for the node_exporter
+// textfile collector, the file is replaced atomically. The returned func stops writing and
+// removes the file.
+func StartMetricsTextfile(path string, interval time.Duration) func() {
+	write := func() {
+		var buf bytes.Buffer
+		writeMetrics(&buf)
+		if err := WriteFileAtomic(path, buf.Bytes(), 0644); err != nil {
+			logrus.Errorf("[metrics] failed to write metrics textfile: %v", err)
+		}
+	}
+
+	logrus.Infof("[metrics] writing metrics to %s every %s", path, interval)
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		write()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				write()
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("[metrics] failed to remove metrics textfile: %v", err)
+		}
+	}
+}
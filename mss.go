@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// EnableClampMSS clamps the MSS of forwarded tcp SYN packets to the route MTU(--clamp-mss),
+// so that large packets are not black-holed when the path MTU through the tun is smaller.
+func EnableClampMSS() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[helper/mss] failed connect to nftables: %v", err)
+	}
+
+	// remove the table of previous runs first
+	if err = DisableClampMSS(); err != nil {
+		return err
+	}
+
+	table := nft.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: MSSTableName})
+	chain := nft.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityMangle,
+	})
+	nft.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			// meta l4proto tcp
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			// tcp flags & syn != 0
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x02}, Xor: []byte{0x00}},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x00}},
+			// tcp option maxseg size set rt mtu
+			&expr.Rt{Register: 1, Key: expr.RtTCPMSS},
+			&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 2, Size: 2},
+			&expr.Exthdr{SourceRegister: 1, Type: 2, Offset: 2, Len: 2, Op: expr.ExthdrOpTcpopt},
+		},
+		UserData: ruleComment(),
+	})
+
+	if err = nftFlush(nft, "enable clamp mss"); err != nil {
+		return fmt.Errorf("[helper/mss] failed to flush nftables: %v", err)
+	}
+	logrus.Info("[helper/mss] tcp mss clamped to the route mtu for forwarded traffic")
+	return nil
+}
+
+// DisableClampMSS removes the mss clamping table, a missing table is not an error
+func DisableClampMSS() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[helper/mss] failed connect to nftables: %v", err)
+	}
+
+	tables, err := nft.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("[helper/mss] failed to list nftables tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Name == MSSTableName {
+			nft.DelTable(t)
+			if err = nftFlush(nft, "disable clamp mss"); err != nil {
+				return fmt.Errorf("[helper/mss] failed to flush nftables: %v", err)
+			}
+		}
+	}
+	return nil
+}
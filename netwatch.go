@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// routeChangeCh asks the config watcher to send the current config again, it is triggered by
+// a changed default route(--reload-on-interface-change)
+var routeChangeCh = make(chan struct{}, 1)
+
+// WatchDefaultRoute subscribes to netlink route changes, fn is called(debounced) when
+// the default route of the main routing table changes, e.g. when switching networks.
+func WatchDefaultRoute(ctx context.Context, debounce time.Duration, fn func()) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("[netwatch] failed to create netlink socket: %w", err)
+	}
+
+	addr := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE,
+	}
+	if err = unix.Bind(fd, addr); err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("[netwatch] failed to bind netlink socket: %w", err)
+	}
+
+	// use a read timeout so that the context cancellation can be checked
+	tv := unix.Timeval{Sec: 1}
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		_ = unix.Close(fd)
+		return fmt.Errorf("[netwatch] failed to set netlink socket timeout: %w", err)
+	}
+
+	go func() {
+		defer func() { _ = unix.Close(fd) }()
+
+		var timer *time.Timer
+		buf := make([]byte, 64*1024)
+		for {
+			if ctx.Err() != nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+
+			n, _, err := unix.Recvfrom(fd, buf, 0)
+			if err != nil {
+				if err == unix.EAGAIN || err == unix.EWOULDBLOCK || err == unix.EINTR {
+					continue
+				}
+				logrus.Errorf("[netwatch] failed to read netlink message: %v", err)
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				logrus.Debugf("[netwatch] failed to parse netlink message: %v", err)
+				continue
+			}
+			if !hasDefaultRouteChange(msgs) {
+				continue
+			}
+
+			logrus.Debug("[netwatch] default route changed")
+			if timer == nil {
+				timer = time.AfterFunc(debounce, fn)
+			} else {
+				timer.Reset(debounce)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func hasDefaultRouteChange(msgs []syscall.NetlinkMessage) bool {
+	for _, msg := range msgs {
+		if msg.Header.Type != unix.RTM_NEWROUTE && msg.Header.Type != unix.RTM_DELROUTE {
+			continue
+		}
+		if len(msg.Data) < unix.SizeofRtMsg {
+			continue
+		}
+		// struct rtmsg: family, dst_len, src_len, tos, table...
+		if msg.Data[1] == 0 && msg.Data[4] == unix.RT_TABLE_MAIN {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DesktopNotify sends a desktop notification for key events, it is best-effort
+// and silently skipped if no notification daemon is present.
+func DesktopNotify(summary, format string, args ...any) {
+	if !conf.DesktopNotify {
+		return
+	}
+
+	if err := sendDesktopNotify(summary, fmt.Sprintf(format, args...)); err != nil {
+		logrus.Debugf("[notify] skip desktop notification: %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build dbus
+
+package main
+
+import (
+	"github.com/godbus/dbus/v5"
+)
+
+const featureDBusNotify = true
+
+// https://specifications.freedesktop.org/notification-spec/latest/protocol.html
+func sendDesktopNotify(summary, body string) error {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	obj := conn.Object("org.freedesktop.Notifications", "/org/freedesktop/Notifications")
+	call := obj.Call("org.freedesktop.Notifications.Notify", 0,
+		"TPClash", uint32(0), "", summary, body, []string{}, map[string]dbus.Variant{}, int32(5000))
+
+	return call.Err
+}
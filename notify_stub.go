@@ -0,0 +1,11 @@
+//go:build !dbus
+
+package main
+
+import "errors"
+
+const featureDBusNotify = false
+
+func sendDesktopNotify(_, _ string) error {
+	return errors.New("tpclash is built without dbus support(-tags dbus)")
+}
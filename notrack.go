@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sirupsen/logrus"
+)
+
+// EnableNotrack skips connection tracking for traffic to the clash fake-ip range(--notrack),
+// the rules live in a tpclash owned raw table so that teardown only drops that table.
+func EnableNotrack(fakeIPRange string) error {
+	_, ipNet, err := net.ParseCIDR(fakeIPRange)
+	if err != nil || ipNet.IP.To4() == nil {
+		return fmt.Errorf("[helper/notrack] invalid clash fake-ip range(dns.fake-ip-range): %s", fakeIPRange)
+	}
+
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[helper/notrack] failed connect to nftables: %v", err)
+	}
+
+	// remove the table of previous runs first
+	if err = DisableNotrack(); err != nil {
+		return err
+	}
+
+	table := nft.AddTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: NotrackTableName})
+	hooks := map[string]*nftables.ChainHook{"prerouting": nftables.ChainHookPrerouting, "output": nftables.ChainHookOutput}
+	for name, hook := range hooks {
+		chain := nft.AddChain(&nftables.Chain{
+			Name:     name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  hook,
+			Priority: nftables.ChainPriorityRaw,
+		})
+		nft.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// ip daddr
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: ipNet.Mask, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipNet.IP.To4()},
+				&expr.Notrack{},
+			},
+			UserData: ruleComment(),
+		})
+	}
+
+	if err = nftFlush(nft, "enable notrack"); err != nil {
+		return fmt.Errorf("[helper/notrack] failed to flush nftables: %v", err)
+	}
+	logrus.Infof("[helper/notrack] connection tracking disabled for %s", ipNet)
+	return nil
+}
+
+// DisableNotrack removes the notrack table, a missing table is not an error
+func DisableNotrack() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[helper/notrack] failed connect to nftables: %v", err)
+	}
+
+	tables, err := nft.ListTablesOfFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return fmt.Errorf("[helper/notrack] failed to list nftables tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Name == NotrackTableName {
+			nft.DelTable(t)
+			if err = nftFlush(nft, "disable notrack"); err != nil {
+				return fmt.Errorf("[helper/notrack] failed to flush nftables: %v", err)
+			}
+		}
+	}
+	return nil
+}
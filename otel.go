@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pipelineTrace records the phases of one startup or reload as OpenTelemetry spans, it is
+// exported to --otel-endpoint(OTLP/HTTP json) when it ends. A nil trace records nothing, so
+// the pipeline can be instrumented unconditionally.
+type pipelineTrace struct {
+	mu    sync.Mutex
+	root  *traceSpan
+	spans []*traceSpan
+}
+
+type traceSpan struct {
+	TraceID string
+	SpanID  string
+	Parent  string
+	Name    string
+	Start   time.Time
+	End     time.Time
+	Attrs   map[string]string
+	Err     error
+}
+
+// startTrace starts the trace of a pipeline run, nil is returned if tracing is disabled
+func startTrace(name string, attrs map[string]string) *pipelineTrace {
+	if conf.OtelEndpoint == "" {
+		return nil
+	}
+	root := &traceSpan{TraceID: randomHex(16), SpanID: randomHex(8), Name: name, Start: time.Now(), Attrs: attrs}
+	return &pipelineTrace{root: root, spans: []*traceSpan{root}}
+}
+
+// Phase starts a child span of the pipeline, the returned func ends it with the phase result
+func (t *pipelineTrace) Phase(name string) func(err error) {
+	if t == nil {
+		return func(error) {}
+	}
+
+	s := &traceSpan{TraceID: t.root.TraceID, SpanID: randomHex(8), Parent: t.root.SpanID, Name: name, Start: time.Now()}
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+	return func(err error) {
+		t.mu.Lock()
+		s.End, s.Err = time.Now(), err
+		t.mu.Unlock()
+	}
+}
+
+// End ends the pipeline and exports it in background, phases that were never ended(e.g. the
+// pipeline returned early) end together with the pipeline.
+func (t *pipelineTrace) End(err error) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	t.root.Err = err
+	for _, s := range t.spans {
+		if s.End.IsZero() {
+			s.End = now
+		}
+	}
+	body, merr := json.Marshal(otlpTraces(t.spans))
+	t.mu.Unlock()
+	if merr != nil {
+		logrus.Warnf("[otel] failed to encode trace: %v", merr)
+		return
+	}
+
+	go func() {
+		if err := exportTrace(body); err != nil {
+			logrus.Warnf("[otel] failed to export %s trace: %v", t.root.Name, err)
+		}
+	}()
+}
+
+func exportTrace(body []byte) error {
+	endpoint := strings.TrimSuffix(conf.OtelEndpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+
+	client := &http.Client{Timeout: otelExportTimeout}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if !(resp.StatusCode >= 200 && resp.StatusCode <= 299) {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+// otlpTraces converts the spans to an OTLP ExportTraceServiceRequest(json encoding)
+func otlpTraces(spans []*traceSpan) map[string]any {
+	kv := func(k, v string) otlpKeyValue {
+		var a otlpKeyValue
+		a.Key, a.Value.StringValue = k, v
+		return a
+	}
+
+	var out []otlpSpan
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.Parent,
+			Name:              s.Name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		for k, v := range s.Attrs {
+			o.Attributes = append(o.Attributes, kv(k, v))
+		}
+		o.Status.Code = 1 // STATUS_CODE_OK
+		if s.Err != nil {
+			o.Status.Code, o.Status.Message = 2, s.Err.Error() // STATUS_CODE_ERROR
+		}
+		out = append(out, o)
+	}
+
+	resource := []otlpKeyValue{kv("service.name", "tpclash"), kv("service.version", version), kv("clash.version", clash)}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": resource},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "tpclash"},
+				"spans": out,
+			}},
+		}},
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// loadOverrideFragments reads all yaml fragments in the override dir(--config-override-dir),
+// the fragments are sorted by file name and applied in that order(last wins).
+func loadOverrideFragments() ([]*yaml.Node, []string, error) {
+	entries, err := os.ReadDir(conf.ConfigOverrideDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("[override] failed to read override dir: %w", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || !isOverrideFragment(e.Name()) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	var nodes []*yaml.Node
+	var loaded []string
+	for _, name := range names {
+		bs, err := os.ReadFile(filepath.Join(conf.ConfigOverrideDir, name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("[override] failed to read override fragment %s: %w", name, err)
+		}
+
+		var node yaml.Node
+		if err = yaml.Unmarshal(bs, &node); err != nil {
+			return nil, nil, fmt.Errorf("[override] failed to parse override fragment %s: %w", name, err)
+		}
+		// empty file
+		if len(node.Content) == 0 {
+			continue
+		}
+		if node.Content[0].Kind != yaml.MappingNode {
+			return nil, nil, fmt.Errorf("[override] override fragment %s is not a yaml mapping", name)
+		}
+		nodes = append(nodes, node.Content[0])
+		loaded = append(loaded, name)
+	}
+
+	return nodes, loaded, nil
+}
+
+func isOverrideFragment(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// applyOverrides deep-merges the override fragments on top of the config:
+//
+//   - maps are merged recursively
+//   - lists and scalars replace the original value as a whole
+//   - an explicit null removes the key
+//   - append-proxies/append-proxy-groups are appended to proxies/proxy-groups, duplicate
+//     proxy names are resolved according to --on-duplicate
+//   - rules are placed according to --rules-position(or rules-position in the fragment),
+//     the last catch-all(MATCH) rule is kept at the end
+func applyOverrides(c string) (string, error) {
+	fragments, names, err := loadOverrideFragments()
+	if err != nil {
+		return c, err
+	}
+	if len(fragments) == 0 {
+		return c, nil
+	}
+
+	var rootNode yaml.Node
+	if err = yaml.Unmarshal([]byte(c), &rootNode); err != nil {
+		return c, fmt.Errorf("[override] failed to unmarshal yaml config: %w", err)
+	}
+	if len(rootNode.Content) == 0 || rootNode.Content[0].Kind != yaml.MappingNode {
+		return c, fmt.Errorf("[override] clash config is not a yaml mapping")
+	}
+
+	var stats duplicateStats
+	rulesMerged := false
+	for i, f := range fragments {
+		proxies := pullYamlKey(f, "append-proxies")
+		groups := pullYamlKey(f, "append-proxy-groups")
+
+		position := conf.RulesPosition
+		if n := pullYamlKey(f, "rules-position"); n != nil {
+			position = n.Value
+		}
+		var rules *yaml.Node
+		switch position {
+		case "replace":
+		case "prepend", "append":
+			rules = pullYamlKey(f, "rules")
+		default:
+			return c, fmt.Errorf("[override] invalid rules position in %s(replace/prepend/append): %s", names[i], position)
+		}
+		rulesMerged = rulesMerged || rules != nil || yamlMapValue(f, "rules") != nil
+
+		mergeYamlNode(rootNode.Content[0], f)
+		if rules != nil {
+			if err = mergeRules(rootNode.Content[0], rules, position); err != nil {
+				return c, fmt.Errorf("[override] %s: %w", names[i], err)
+			}
+		}
+		if err = appendProxies(rootNode.Content[0], proxies, groups, names[i], &stats); err != nil {
+			return c, err
+		}
+	}
+	if rulesMerged {
+		if err = fixTerminalRule(rootNode.Content[0]); err != nil {
+			return c, err
+		}
+	}
+	if stats.renamed+stats.skipped+stats.replaced > 0 {
+		logrus.Infof("[override] duplicate proxy names resolved: %d renamed, %d skipped, %d replaced",
+			stats.renamed, stats.skipped, stats.replaced)
+	}
+
+	bs, err := marshalYamlNode(&rootNode)
+	if err != nil {
+		return c, fmt.Errorf("[override] failed to marshal yaml config: %w", err)
+	}
+
+	logrus.Debugf("[override] applied override fragments: %s", strings.Join(names, ", "))
+	return string(bs), nil
+}
+
+// mergeYamlNode merges the src mapping into the dst mapping
+func mergeYamlNode(dst, src *yaml.Node) {
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key, value := src.Content[i], src.Content[i+1]
+
+		idx := -1
+		for j := 0; j+1 < len(dst.Content); j += 2 {
+			if dst.Content[j].Value == key.Value {
+				idx = j
+				break
+			}
+		}
+
+		switch {
+		case value.Tag == "!!null":
+			if idx >= 0 {
+				dst.Content = append(dst.Content[:idx], dst.Content[idx+2:]...)
+			}
+		case idx < 0:
+			dst.Content = append(dst.Content, key, value)
+		case value.Kind == yaml.MappingNode && dst.Content[idx+1].Kind == yaml.MappingNode:
+			mergeYamlNode(dst.Content[idx+1], value)
+		default:
+			dst.Content[idx+1] = keepYamlAnchor(dst.Content[idx+1], value)
+		}
+	}
+}
+
+// WatchOverrideDir notifies the returned chan when fragments in the override dir
+// change, a nil chan(never ready) is returned if the override dir is not set.
+func WatchOverrideDir(ctx context.Context) <-chan struct{} {
+	if conf.ConfigOverrideDir == "" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatalf(ExitConfigFetch, "[override] failed to create fs watcher: %v", err)
+	}
+	if err = watcher.Add(conf.ConfigOverrideDir); err != nil {
+		fatalf(ExitConfigFetch, "[override] failed add %s to fs watcher: %v", conf.ConfigOverrideDir, err)
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer func() { _ = watcher.Close() }()
+
+		// editors usually emit several events for one save
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !isOverrideFragment(filepath.Base(event.Name)) || event.Has(fsnotify.Chmod) {
+					continue
+				}
+				timer.Reset(overrideChangeDebounce)
+			case <-timer.C:
+				logrus.Info("[override] config override fragments changed")
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if err != nil {
+					logrus.Errorf("[override] fs watcher error: %v", err)
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+type duplicateStats struct {
+	renamed  int
+	skipped  int
+	replaced int
+}
+
+// appendProxies appends the proxies and proxy groups of an override fragment, proxy groups
+// of the same fragment referencing renamed proxies are updated accordingly.
+func appendProxies(root, proxies, groups *yaml.Node, source string, stats *duplicateStats) error {
+	if proxies == nil && groups == nil {
+		return nil
+	}
+	for _, n := range []*yaml.Node{proxies, groups} {
+		if n != nil && n.Kind != yaml.SequenceNode {
+			return fmt.Errorf("[override] append-proxies/append-proxy-groups in %s must be a list", source)
+		}
+	}
+
+	// proxy and group names share the same namespace in clash
+	existing := make(map[string]*yaml.Node)
+	isGroup := make(map[*yaml.Node]bool)
+	for _, key := range []string{"proxies", "proxy-groups"} {
+		if seq := yamlMapValue(root, key); seq != nil {
+			for _, n := range seq.Content {
+				if v := yamlMapValue(n, "name"); v != nil {
+					existing[v.Value] = n
+					isGroup[n] = key == "proxy-groups"
+				}
+			}
+		}
+	}
+
+	suffix := strings.TrimSuffix(source, filepath.Ext(source))
+	renamed := make(map[string]string)
+	var appended []*yaml.Node
+	if proxies != nil {
+		for _, p := range proxies.Content {
+			name := yamlMapValue(p, "name")
+			if name == nil {
+				return fmt.Errorf("[override] proxy without name in %s", source)
+			}
+
+			origin := name.Value
+			applied := false
+			for i := 1; existing[name.Value] != nil; i++ {
+				// autoFix may run more than once on the same config
+				if sameYamlNode(existing[name.Value], p) {
+					applied = true
+					break
+				}
+				if i == 1 {
+					switch conf.OnDuplicate {
+					case "skip":
+						logrus.Debugf("[override] skip duplicate proxy %s from %s", origin, source)
+						stats.skipped++
+						applied = true
+					case "replace":
+						old := existing[origin]
+						if isGroup[old] {
+							return fmt.Errorf("[override] proxy %s in %s conflicts with a proxy group", origin, source)
+						}
+						// in place, so that the proxy groups referencing it are unchanged
+						logrus.Debugf("[override] replace duplicate proxy %s from %s", origin, source)
+						*old = *keepYamlAnchor(old, p)
+						stats.replaced++
+						applied = true
+					case "error":
+						return fmt.Errorf("[override] duplicate proxy name %s in %s", origin, source)
+					}
+					if applied {
+						break
+					}
+				}
+				name.Value = fmt.Sprintf("%s@%s", origin, suffix)
+				if i > 1 {
+					name.Value = fmt.Sprintf("%s@%s-%d", origin, suffix, i)
+				}
+			}
+			if name.Value != origin {
+				renamed[origin] = name.Value
+			}
+			if applied {
+				continue
+			}
+			if name.Value != origin {
+				logrus.Debugf("[override] rename duplicate proxy %s from %s to %s", origin, source, name.Value)
+				stats.renamed++
+			}
+			existing[name.Value] = p
+			appended = append(appended, p)
+		}
+		appendYamlSeq(root, "proxies", appended)
+	}
+
+	if groups != nil {
+		appended = nil
+		for _, g := range groups.Content {
+			name := yamlMapValue(g, "name")
+			if name == nil {
+				return fmt.Errorf("[override] proxy group without name in %s", source)
+			}
+			if refs := yamlMapValue(g, "proxies"); refs != nil {
+				for _, ref := range refs.Content {
+					if n, ok := renamed[ref.Value]; ok {
+						ref.Value = n
+					}
+				}
+			}
+			if n := existing[name.Value]; n != nil {
+				if sameYamlNode(n, g) {
+					continue
+				}
+				return fmt.Errorf("[override] duplicate proxy group name %s in %s", name.Value, source)
+			}
+			existing[name.Value] = g
+			appended = append(appended, g)
+		}
+		appendYamlSeq(root, "proxy-groups", appended)
+	}
+
+	return nil
+}
+
+// keepYamlAnchor moves the anchor of the replaced value to the new value, so that
+// aliases referencing it still resolve after the replacement.
+func keepYamlAnchor(old, value *yaml.Node) *yaml.Node {
+	if old.Anchor != "" && value.Anchor == "" {
+		value.Anchor = old.Anchor
+	}
+	return value
+}
+
+// marshalYamlNode marshals the node with comments, anchors and aliases preserved, the
+// explicit !!merge tag yaml.v3 emits for merge keys(<<) is dropped.
+func marshalYamlNode(node *yaml.Node) ([]byte, error) {
+	clearMergeTags(node)
+	return yaml.Marshal(node)
+}
+
+func clearMergeTags(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if k := node.Content[i]; k.Value == "<<" && k.Tag == "!!merge" {
+				k.Tag = ""
+			}
+		}
+	}
+	for _, c := range node.Content {
+		clearMergeTags(c)
+	}
+}
+
+func sameYamlNode(a, b *yaml.Node) bool {
+	var va, vb any
+	if a.Decode(&va) != nil || b.Decode(&vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// yamlMapValue returns the value of the key in a mapping node
+func yamlMapValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// pullYamlKey removes the key from a mapping node and returns its value
+func pullYamlKey(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value := node.Content[i+1]
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return value
+		}
+	}
+	return nil
+}
+
+func appendYamlSeq(node *yaml.Node, key string, items []*yaml.Node) {
+	seq := yamlMapValue(node, key)
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		seq = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		mergeYamlNode(node, &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, seq,
+		}})
+	}
+	seq.Content = append(seq.Content, items...)
+}
+
+// mergeRules prepends/appends the rules of a fragment, rules already present are moved
+// rather than duplicated, so merging the same fragment again does not change the result.
+// Appended rules are placed before the trailing catch-all rule of the config.
+func mergeRules(root, rules *yaml.Node, position string) error {
+	if rules.Kind != yaml.SequenceNode {
+		return errors.New("rules must be a list")
+	}
+
+	added := make(map[string]bool)
+	for _, r := range rules.Content {
+		added[strings.TrimSpace(r.Value)] = true
+	}
+
+	var origin []*yaml.Node
+	if seq := yamlMapValue(root, "rules"); seq != nil {
+		for _, r := range seq.Content {
+			if !added[strings.TrimSpace(r.Value)] {
+				origin = append(origin, r)
+			}
+		}
+	}
+
+	merged := append([]*yaml.Node{}, rules.Content...)
+	if position == "prepend" {
+		merged = append(merged, origin...)
+	} else {
+		// appended rules land before the trailing catch-all rule, which is replaced if the
+		// fragment brings its own
+		var terminal *yaml.Node
+		if n := len(origin); n > 0 && isTerminalRule(origin[n-1].Value) {
+			terminal, origin = origin[n-1], origin[:n-1]
+		}
+		merged = append(origin, merged...)
+		if terminal != nil && !hasTerminalRule(merged) {
+			merged = append(merged, terminal)
+		}
+	}
+	setYamlSeq(root, "rules", merged)
+	return nil
+}
+
+func setYamlSeq(node *yaml.Node, key string, items []*yaml.Node) {
+	if seq := yamlMapValue(node, key); seq != nil && seq.Kind == yaml.SequenceNode {
+		seq.Content = items
+		return
+	}
+	appendYamlSeq(node, key, items)
+}
+
+// isTerminalRule checks whether the rule is a catch-all(MATCH, FINAL in old versions)
+func isTerminalRule(rule string) bool {
+	typ := strings.ToUpper(strings.TrimSpace(strings.SplitN(rule, ",", 2)[0]))
+	return typ == "MATCH" || typ == "FINAL"
+}
+
+func hasTerminalRule(rules []*yaml.Node) bool {
+	for _, r := range rules {
+		if isTerminalRule(r.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// fixTerminalRule keeps exactly one catch-all rule at the end of the rules, the last one is
+// kept(like all other override values, the later one wins). Moving or dropping a catch-all rule
+// makes the rules after it reachable, so this is refused in strict mode(--autofix-strict).
+func fixTerminalRule(root *yaml.Node) error {
+	seq := yamlMapValue(root, "rules")
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+
+	last := -1
+	for i, r := range seq.Content {
+		if isTerminalRule(r.Value) {
+			last = i
+		}
+	}
+	if last < 0 {
+		logrus.Warn("[override] no catch-all(MATCH) rule found after merging rules")
+		return nil
+	}
+
+	terminal := seq.Content[last]
+	var rules []*yaml.Node
+	var changes []string
+	for i, r := range seq.Content {
+		switch {
+		case !isTerminalRule(r.Value):
+			rules = append(rules, r)
+		case i != last:
+			changes = append(changes, fmt.Sprintf("duplicate catch-all rule %s is removed(%s is kept), the rules after it become reachable", r.Value, terminal.Value))
+		case i != len(seq.Content)-1:
+			changes = append(changes, fmt.Sprintf("catch-all rule %s is not the last rule, it is moved to the end and the rules after it become reachable", r.Value))
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if conf.AutoFixStrict {
+		return fmt.Errorf("[override] strict mode: %s", strings.Join(changes, "; "))
+	}
+	for _, c := range changes {
+		logrus.Warnf("[override] %s", c)
+	}
+	seq.Content = append(rules, terminal)
+	return nil
+}
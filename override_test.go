@@ -0,0 +1,421 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setupOverrideTest writes the fragments to a new override dir
+func setupOverrideTest(t *testing.T, fragments map[string]string) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.ConfigOverrideDir = t.TempDir()
+	conf.RulesPosition, conf.OnDuplicate = "replace", "rename"
+	for name, data := range fragments {
+		if err := os.WriteFile(filepath.Join(conf.ConfigOverrideDir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const testAnchorConfig = `# proxy defaults
+base: &base
+  type: ss # shared type
+  cipher: aes-128-gcm
+dns: &dns
+  enable: true
+  listen: 0.0.0.0:1053
+proxies:
+  - <<: *base
+    name: hk
+    server: hk.example.com
+  - <<: *base
+    name: jp
+    server: jp.example.com
+profile:
+  dns: *dns
+`
+
+func TestApplyOverridesKeepsAnchors(t *testing.T) {
+	setupOverrideTest(t, map[string]string{
+		"10-dns.yaml":  "dns:\n  listen: 0.0.0.0:5353\n",
+		"20-base.yaml": "base:\n  cipher: chacha20-ietf-poly1305\n",
+	})
+
+	out, err := applyOverrides(testAnchorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"# proxy defaults", "# shared type", "&base", "&dns", "<<: *base", "dns: *dns"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("%q is lost:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, "!!merge") {
+		t.Errorf("unexpected !!merge tag:\n%s", out)
+	}
+
+	// the merged values are visible through the aliases
+	var cc struct {
+		Proxies []map[string]string `yaml:"proxies"`
+		Profile struct {
+			DNS map[string]any `yaml:"dns"`
+		} `yaml:"profile"`
+	}
+	if err = yaml.Unmarshal([]byte(out), &cc); err != nil {
+		t.Fatalf("invalid yaml: %v\n%s", err, out)
+	}
+	if len(cc.Proxies) != 2 || cc.Proxies[1]["cipher"] != "chacha20-ietf-poly1305" || cc.Proxies[1]["server"] != "jp.example.com" {
+		t.Errorf("unexpected proxies: %v", cc.Proxies)
+	}
+	if cc.Profile.DNS["listen"] != "0.0.0.0:5353" {
+		t.Errorf("unexpected aliased dns: %v", cc.Profile.DNS)
+	}
+}
+
+func TestApplyOverridesReplaceAnchoredValue(t *testing.T) {
+	// the anchored value is replaced as a whole(list), the alias must still resolve
+	setupOverrideTest(t, map[string]string{
+		"10-nameserver.yaml": "nameserver:\n  - 223.5.5.5\n",
+	})
+
+	out, err := applyOverrides("nameserver: &ns\n  - 114.114.114.114\nfallback: *ns\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cc struct {
+		Nameserver []string `yaml:"nameserver"`
+		Fallback   []string `yaml:"fallback"`
+	}
+	if err = yaml.Unmarshal([]byte(out), &cc); err != nil {
+		t.Fatalf("invalid yaml: %v\n%s", err, out)
+	}
+	if len(cc.Fallback) != 1 || cc.Fallback[0] != "223.5.5.5" || cc.Nameserver[0] != "223.5.5.5" {
+		t.Errorf("unexpected nameservers: %+v\n%s", cc, out)
+	}
+}
+
+func overrideRules(t *testing.T, c string) []string {
+	var cc struct {
+		Rules []string `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal([]byte(c), &cc); err != nil {
+		t.Fatalf("invalid yaml: %v\n%s", err, c)
+	}
+	return cc.Rules
+}
+
+func TestApplyOverridesRules(t *testing.T) {
+	const origin = "rules:\n  - DOMAIN,a.com,DIRECT\n  - DOMAIN,b.com,PROXY\n  - MATCH,PROXY\n"
+
+	tests := []struct {
+		name     string
+		position string
+		fragment string
+		origin   string
+		strict   bool
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "replace",
+			position: "replace",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n  - MATCH,DIRECT\n",
+			want:     []string{"DOMAIN,c.com,DIRECT", "MATCH,DIRECT"},
+		},
+		{
+			name:     "prepend",
+			position: "prepend",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n",
+			want:     []string{"DOMAIN,c.com,DIRECT", "DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "MATCH,PROXY"},
+		},
+		{
+			name:     "append",
+			position: "append",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n",
+			want:     []string{"DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "DOMAIN,c.com,DIRECT", "MATCH,PROXY"},
+		},
+		{
+			name:     "duplicate rules are moved",
+			position: "prepend",
+			fragment: "rules:\n  - DOMAIN,b.com,PROXY\n  - DOMAIN,c.com,DIRECT\n",
+			want:     []string{"DOMAIN,b.com,PROXY", "DOMAIN,c.com,DIRECT", "DOMAIN,a.com,DIRECT", "MATCH,PROXY"},
+		},
+		{
+			name:     "append terminal replaces the trailing one",
+			position: "append",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n  - MATCH,DIRECT\n",
+			want:     []string{"DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "DOMAIN,c.com,DIRECT", "MATCH,DIRECT"},
+		},
+		{
+			name:     "prepend duplicate terminal keeps the last",
+			position: "prepend",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n  - MATCH,DIRECT\n",
+			want:     []string{"DOMAIN,c.com,DIRECT", "DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "MATCH,PROXY"},
+		},
+		{
+			name:     "same terminal is not duplicated",
+			position: "prepend",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n  - MATCH,PROXY\n",
+			want:     []string{"DOMAIN,c.com,DIRECT", "DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "MATCH,PROXY"},
+		},
+		{
+			name:     "append after a misplaced terminal",
+			position: "append",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n",
+			origin:   "rules:\n  - MATCH,PROXY\n  - DOMAIN,a.com,DIRECT\n",
+			want:     []string{"DOMAIN,a.com,DIRECT", "DOMAIN,c.com,DIRECT", "MATCH,PROXY"},
+		},
+		{
+			name:     "misplaced terminal is moved to the end",
+			position: "replace",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n  - FINAL,DIRECT\n  - DOMAIN,d.com,PROXY\n",
+			want:     []string{"DOMAIN,c.com,DIRECT", "DOMAIN,d.com,PROXY", "FINAL,DIRECT"},
+		},
+		{
+			name:     "strict duplicate terminal",
+			position: "prepend",
+			fragment: "rules:\n  - MATCH,DIRECT\n",
+			strict:   true,
+			wantErr:  true,
+		},
+		{
+			name:     "strict misplaced terminal",
+			position: "replace",
+			fragment: "rules:\n  - MATCH,DIRECT\n  - DOMAIN,d.com,PROXY\n",
+			strict:   true,
+			wantErr:  true,
+		},
+		{
+			name:     "strict clean rules",
+			position: "append",
+			fragment: "rules:\n  - DOMAIN,c.com,DIRECT\n",
+			strict:   true,
+			want:     []string{"DOMAIN,a.com,DIRECT", "DOMAIN,b.com,PROXY", "DOMAIN,c.com,DIRECT", "MATCH,PROXY"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupOverrideTest(t, map[string]string{"10-rules.yaml": tt.fragment})
+			conf.RulesPosition, conf.AutoFixStrict = tt.position, tt.strict
+
+			if tt.origin == "" {
+				tt.origin = origin
+			}
+			out, err := applyOverrides(tt.origin)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got:\n%s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := overrideRules(t, out)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("unexpected rules:\n got: %v\nwant: %v", got, tt.want)
+			}
+
+			// autoFix applies the overrides again on reload
+			again, err := applyOverrides(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got = overrideRules(t, again); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("merging again changed the rules: %v", got)
+			}
+		})
+	}
+}
+
+func TestApplyOverridesFragmentRulesPosition(t *testing.T) {
+	setupOverrideTest(t, map[string]string{
+		"10-rules.yaml": "rules-position: prepend\nrules:\n  - DOMAIN,c.com,DIRECT\n",
+	})
+
+	out, err := applyOverrides("rules:\n  - DOMAIN,a.com,DIRECT\n  - MATCH,PROXY\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "rules-position") {
+		t.Errorf("rules-position is left in the config:\n%s", out)
+	}
+	want := []string{"DOMAIN,c.com,DIRECT", "DOMAIN,a.com,DIRECT", "MATCH,PROXY"}
+	if got := overrideRules(t, out); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("unexpected rules: %v", got)
+	}
+}
+
+const testDuplicateConfig = `proxies:
+  - {name: hk, type: ss, server: hk.example.com}
+  - {name: jp, type: ss, server: jp.example.com}
+proxy-groups:
+  - {name: auto, type: url-test, proxies: [hk, jp]}
+`
+
+const testDuplicateFragment = `append-proxies:
+  - {name: hk, type: ss, server: hk2.example.com}
+  - {name: us, type: ss, server: us.example.com}
+append-proxy-groups:
+  - {name: extra, type: select, proxies: [hk, us]}
+`
+
+type testOverrideProxies struct {
+	Proxies []struct {
+		Name   string `yaml:"name"`
+		Server string `yaml:"server"`
+	} `yaml:"proxies"`
+	ProxyGroups []struct {
+		Name    string   `yaml:"name"`
+		Proxies []string `yaml:"proxies"`
+	} `yaml:"proxy-groups"`
+}
+
+func (c testOverrideProxies) proxies() string {
+	var ss []string
+	for _, p := range c.Proxies {
+		ss = append(ss, p.Name+"="+p.Server)
+	}
+	return strings.Join(ss, ",")
+}
+
+func (c testOverrideProxies) groups() string {
+	var ss []string
+	for _, g := range c.ProxyGroups {
+		ss = append(ss, g.Name+"="+strings.Join(g.Proxies, "/"))
+	}
+	return strings.Join(ss, ",")
+}
+
+func TestApplyOverridesOnDuplicate(t *testing.T) {
+	tests := []struct {
+		mode     string
+		fragment string
+		proxies  string
+		groups   string
+		wantErr  bool
+	}{
+		{
+			mode:     "rename",
+			fragment: testDuplicateFragment,
+			proxies:  "hk=hk.example.com,jp=jp.example.com,hk@20-extra=hk2.example.com,us=us.example.com",
+			groups:   "auto=hk/jp,extra=hk@20-extra/us",
+		},
+		{
+			mode:     "skip",
+			fragment: testDuplicateFragment,
+			proxies:  "hk=hk.example.com,jp=jp.example.com,us=us.example.com",
+			groups:   "auto=hk/jp,extra=hk/us",
+		},
+		{
+			mode:     "replace",
+			fragment: testDuplicateFragment,
+			proxies:  "hk=hk2.example.com,jp=jp.example.com,us=us.example.com",
+			groups:   "auto=hk/jp,extra=hk/us",
+		},
+		{
+			mode:     "error",
+			fragment: testDuplicateFragment,
+			wantErr:  true,
+		},
+		{
+			mode:     "replace",
+			fragment: "append-proxies:\n  - {name: auto, type: ss, server: auto.example.com}\n",
+			wantErr:  true,
+		},
+		{
+			mode:     "rename",
+			fragment: "append-proxy-groups:\n  - {name: auto, type: select, proxies: [hk]}\n",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			setupOverrideTest(t, map[string]string{"20-extra.yaml": tt.fragment})
+			conf.OnDuplicate = tt.mode
+
+			out, err := applyOverrides(testDuplicateConfig)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got:\n%s", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(out, "append-proxies") || strings.Contains(out, "append-proxy-groups") {
+				t.Errorf("append keys are left in the config:\n%s", out)
+			}
+
+			// autoFix applies the overrides again on reload, nothing must be appended twice
+			for i := 0; i < 2; i++ {
+				var cc testOverrideProxies
+				if err = yaml.Unmarshal([]byte(out), &cc); err != nil {
+					t.Fatalf("invalid yaml: %v\n%s", err, out)
+				}
+				if cc.proxies() != tt.proxies {
+					t.Errorf("unexpected proxies(round %d):\n got: %s\nwant: %s", i, cc.proxies(), tt.proxies)
+				}
+				if cc.groups() != tt.groups {
+					t.Errorf("unexpected proxy groups(round %d):\n got: %s\nwant: %s", i, cc.groups(), tt.groups)
+				}
+				if out, err = applyOverrides(out); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyOverridesMerge(t *testing.T) {
+	setupOverrideTest(t, map[string]string{
+		"10-dns.yaml": "dns:\n  nameserver: [223.5.5.5]\n  fallback: null\nhosts: null\n",
+		// later fragments win
+		"20-dns.yaml":  "dns:\n  listen: 0.0.0.0:5353\n  ipv6: false\nmode: global\n",
+		"30-none.yaml": "# only a comment\n",
+		".hidden.yaml": "mode: direct\n",
+		"40-other.txt": "mode: direct\n",
+	})
+
+	out, err := applyOverrides(`mode: rule
+hosts:
+  a.com: 1.1.1.1
+dns:
+  enable: true
+  listen: 0.0.0.0:1053
+  nameserver: [114.114.114.114, 119.29.29.29]
+  fallback: [8.8.8.8]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cc map[string]any
+	if err = yaml.Unmarshal([]byte(out), &cc); err != nil {
+		t.Fatalf("invalid yaml: %v\n%s", err, out)
+	}
+	if _, ok := cc["hosts"]; ok {
+		t.Errorf("hosts is not deleted:\n%s", out)
+	}
+	if cc["mode"] != "global" {
+		t.Errorf("unexpected mode %v", cc["mode"])
+	}
+	dns, _ := cc["dns"].(map[string]any)
+	if _, ok := dns["fallback"]; ok {
+		t.Errorf("dns.fallback is not deleted:\n%s", out)
+	}
+	if dns["enable"] != true || dns["ipv6"] != false || dns["listen"] != "0.0.0.0:5353" {
+		t.Errorf("dns is not deep-merged: %v", dns)
+	}
+	if ns, _ := dns["nameserver"].([]any); len(ns) != 1 || ns[0] != "223.5.5.5" {
+		t.Errorf("dns.nameserver is not replaced as a whole: %v", dns["nameserver"])
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// linux/ioprio.h
+const (
+	ioprioClassRT     = 1
+	ioprioClassBE     = 2
+	ioprioClassIdle   = 3
+	ioprioClassShift  = 13
+	ioprioWhoProcess  = 1
+	ioprioLevelNormal = 4
+)
+
+var ioprioClasses = map[string]int{"realtime": ioprioClassRT, "best-effort": ioprioClassBE, "idle": ioprioClassIdle}
+
+// parseIONice parses the io scheduling class and level(--clash-ionice), e.g. "idle",
+// "best-effort:7" or "realtime:0", the level defaults to 4. 0 means unchanged.
+func parseIONice(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	name, levelStr, hasLevel := strings.Cut(s, ":")
+	class, ok := ioprioClasses[name]
+	if !ok {
+		return 0, fmt.Errorf("[config] invalid clash io scheduling class %q(idle|best-effort[:level]|realtime[:level])", name)
+	}
+	level := ioprioLevelNormal
+	if class == ioprioClassIdle {
+		if hasLevel {
+			return 0, fmt.Errorf("[config] the idle io scheduling class has no level: %s", s)
+		}
+		level = 0
+	} else if hasLevel {
+		var err error
+		if level, err = strconv.Atoi(levelStr); err != nil || level < 0 || level > 7 {
+			return 0, fmt.Errorf("[config] invalid clash io scheduling level(0-7): %s", s)
+		}
+	}
+	return class<<ioprioClassShift | level, nil
+}
+
+func ioniceString(ioprio int) string {
+	if ioprio == 0 {
+		return "unchanged"
+	}
+	for name, class := range ioprioClasses {
+		if ioprio>>ioprioClassShift == class {
+			if class == ioprioClassIdle {
+				return name
+			}
+			return fmt.Sprintf("%s:%d", name, ioprio&(1<<ioprioClassShift-1))
+		}
+	}
+	return strconv.Itoa(ioprio)
+}
+
+// startWithPriority starts the command with the niceness and io priority(0 means unchanged).
+// Both are per thread on linux and inherited by the forked child, so they are set on a locked
+// thread that starts the command. The thread is discarded with the goroutine instead of being
+// restored, because raising its priority back may require CAP_SYS_NICE.
+func startWithPriority(cmd *exec.Cmd, nice, ioprio int) error {
+	if nice == 0 && ioprio == 0 {
+		return cmd.Start()
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		if nice != 0 {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, 0, nice); err != nil {
+				errCh <- fmt.Errorf("failed to set nice %d: %w", nice, err)
+				return
+			}
+		}
+		if ioprio != 0 {
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(ioprio)); errno != 0 {
+				errCh <- fmt.Errorf("failed to set io priority %s: %w", ioniceString(ioprio), errno)
+				return
+			}
+		}
+		errCh <- cmd.Start()
+	}()
+	return <-errCh
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ProxyMode prepares the host network for a transparent proxy mode.
+//
+// Contract for implementations:
+//   - EnableProxy is called once after the clash process has been started.
+//   - DisableProxy is called once during shutdown, it is also called when EnableProxy
+//     failed halfway, so it must tolerate partially applied(or missing) rules.
+//   - The pause/resume commands of the control socket call DisableProxy and EnableProxy
+//     again while clash keeps running.
+//   - Both must be idempotent, running them again must not duplicate or fail on rules.
+//   - Neither should block for long, shutdown waits for DisableProxy to return.
+type ProxyMode interface {
+	EnableProxy() error
+	DisableProxy() error
+}
+
+var proxyModes = map[string]func(*TPClashConf) (ProxyMode, error){}
+
+// RegisterProxyMode registers a proxy mode factory, built-in modes register themselves
+// in init, downstream builds can register custom modes in the same way.
+func RegisterProxyMode(name string, factory func(*TPClashConf) (ProxyMode, error)) {
+	if _, ok := proxyModes[name]; ok {
+		panic(fmt.Sprintf("proxy mode %s already registered", name))
+	}
+	proxyModes[name] = factory
+}
+
+// NewProxyMode creates the proxy mode selected by --proxy-mode
+func NewProxyMode(c *TPClashConf) (ProxyMode, error) {
+	factory, ok := proxyModes[c.ProxyMode]
+	if !ok {
+		return nil, fmt.Errorf("[proxy] unsupported proxy mode: %s(%s)", c.ProxyMode, strings.Join(ProxyModeNames(), "|"))
+	}
+	return factory(c)
+}
+
+func ProxyModeNames() []string {
+	var names []string
+	for name := range proxyModes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tunProxyMode relies on the clash tun(auto-route/ebpf) for traffic redirection,
+// only docker compatible rules are required on the host.
+type tunProxyMode struct {
+	rulesFile string
+	notrack   bool
+	clampMSS  bool
+	fwmark    uint32
+	fwmarkDev string
+	apiBypass []IPRule
+}
+
+func (m *tunProxyMode) EnableProxy() error {
+	cc := currentClashConf.Load()
+	if cc == nil {
+		return fmt.Errorf("[proxy] clash config is not loaded")
+	}
+
+	// the clash api must stay reachable from the host for reloads, it is never routed into the tun
+	if err := checkClashAPILocal(cc); err != nil {
+		logrus.Warn(err)
+	}
+	rules, err := clashAPIBypassRules(cc)
+	if err != nil {
+		return err
+	}
+	// the rules of an earlier enable are replaced, the api address may change with a reload
+	if err = DisableAPIBypass(m.apiBypass); err != nil {
+		logrus.Warn(err)
+	}
+	m.apiBypass = rules
+	if err = EnableAPIBypass(rules); err != nil {
+		return err
+	}
+
+	if m.notrack {
+		if err := EnableNotrack(cc.DNS.FakeIPRange); err != nil {
+			return err
+		}
+	}
+
+	if m.clampMSS {
+		if err := EnableClampMSS(); err != nil {
+			return err
+		}
+	}
+
+	if m.fwmark != 0 {
+		dev, err := EnableFwmarkRoute(cc, m.fwmark)
+		m.fwmarkDev = dev
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.rulesFile != "" {
+		return ApplyRulesFile(m.rulesFile)
+	}
+	return EnableDockerCompatible()
+}
+
+func (m *tunProxyMode) Plan() []string {
+	var plan []string
+	if cc := currentClashConf.Load(); cc != nil {
+		rules, err := clashAPIBypassRules(cc)
+		if err != nil {
+			plan = append(plan, fmt.Sprintf("clash api bypass(%v)", err))
+		}
+		for _, r := range rules {
+			plan = append(plan, fmt.Sprintf("ip rule %s, keep the clash api out of the proxy", r))
+		}
+		if cc.Tun.AutoRoute {
+			plan = append(plan, "clash tun(auto-route) routes all traffic of the host through clash, it is already active since clash has started")
+		}
+		if len(cc.Ebpf.RedirectToTun) > 0 {
+			plan = append(plan, fmt.Sprintf("clash ebpf redirects the traffic of %s to the tun", strings.Join(cc.Ebpf.RedirectToTun, ", ")))
+		}
+		if m.notrack {
+			plan = append(plan, fmt.Sprintf("nftables table ip %s: skip conntrack for the fake-ip range %s", NotrackTableName, cc.DNS.FakeIPRange))
+		}
+		if m.fwmark != 0 {
+			for _, family := range fwmarkFamilies(cc) {
+				r := IPRule{Family: family, Priority: fwmarkRulePriority, Table: fwmarkRouteTable, Mark: m.fwmark}
+				plan = append(plan, fmt.Sprintf("ip rule %s, default route via the clash tun in table %d", r, fwmarkRouteTable))
+			}
+		}
+	}
+	if m.clampMSS {
+		plan = append(plan, fmt.Sprintf("nftables table ip %s: clamp the tcp mss of forwarded traffic to the path mtu", MSSTableName))
+	}
+	if m.rulesFile != "" {
+		bs, err := os.ReadFile(m.rulesFile)
+		if err != nil {
+			return append(plan, fmt.Sprintf("nft -f %s(failed to read: %v)", m.rulesFile, err))
+		}
+		return append(plan, fmt.Sprintf("nft -f %s:\n%s", m.rulesFile, strings.TrimSpace(string(bs))))
+	}
+	return append(plan, fmt.Sprintf("nftables chain ip filter %s: insert an accept rule(if docker is installed)", ChainDockerUser))
+}
+
+func (m *tunProxyMode) DisableProxy() error {
+	// every step runs, a failing one must not leave the rules of the others behind
+	var errs []error
+	if m.notrack {
+		errs = append(errs, DisableNotrack())
+	}
+	if m.clampMSS {
+		errs = append(errs, DisableClampMSS())
+	}
+	if m.fwmark != 0 {
+		errs = append(errs, DisableFwmarkRoute(m.fwmark, m.fwmarkDev))
+	}
+	errs = append(errs, DisableAPIBypass(m.apiBypass))
+	errs = append(errs, DisableDockerCompatible())
+	// also without --rules-file, the rules file of an earlier run may have left its rules
+	errs = append(errs, DisableRulesFile())
+	return errors.Join(errs...)
+}
+
+func init() {
+	RegisterProxyMode("tun", func(c *TPClashConf) (ProxyMode, error) {
+		return &tunProxyMode{rulesFile: c.RulesFile, notrack: c.Notrack, clampMSS: c.ClampMSS, fwmark: c.ProxyFwmark}, nil
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var redactCmd = &cobra.Command{
+	Use:   "redact",
+	Short: "Print the config with secrets and server addresses replaced, safe to attach to issues",
+	Run: func(cmd *cobra.Command, args []string) {
+		var c string
+		var err error
+		if isRemoteConfig() {
+			c, _, err = loadRemoteConfig()
+		} else {
+			c, err = loadLocalConfig()
+		}
+		if err != nil {
+			fatal(ExitConfigFetch, err)
+		}
+
+		out, err := anonymizeConfig(c)
+		if err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		fmt.Print(out)
+	},
+}
+
+// anonymizedAddrKeys are the config keys holding node addresses, they are replaced by
+// placeholders of the same kind(ip or domain) so that the config still parses.
+var anonymizedAddrKeys = map[string]bool{
+	"server":     true,
+	"ip":         true,
+	"ipv6":       true,
+	"servername": true,
+	"sni":        true,
+	"host":       true,
+	"Host":       true,
+}
+
+// anonymizer replaces each distinct address with the same placeholder, so that the
+// relations between proxies(e.g. two proxies on one server) are kept.
+type anonymizer struct {
+	addrs          map[string]string
+	ip4, ip6, host int
+}
+
+// anonymizeConfig redacts the secrets like --redact-fifo does, and additionally replaces the
+// server addresses, sni and subscription urls, the structure of the config is unchanged.
+func anonymizeConfig(c string) (string, error) {
+	var rootNode yaml.Node
+	if err := yaml.Unmarshal([]byte(c), &rootNode); err != nil {
+		return "", fmt.Errorf("[redact] failed to unmarshal config: %w", err)
+	}
+	redactYamlNode(&rootNode)
+
+	a := &anonymizer{addrs: map[string]string{}}
+	a.anonymize(&rootNode)
+	// subscription urls carry the account token
+	if len(rootNode.Content) > 0 {
+		if providers := yamlMapValue(rootNode.Content[0], "proxy-providers"); providers != nil && providers.Kind == yaml.MappingNode {
+			for i := 1; i < len(providers.Content); i += 2 {
+				if u := yamlMapValue(providers.Content[i], "url"); u != nil && u.Kind == yaml.ScalarNode {
+					u.Value, u.Style = "https://example.com/redacted", 0
+				}
+			}
+		}
+	}
+
+	bs, err := marshalYamlNode(&rootNode)
+	if err != nil {
+		return "", fmt.Errorf("[redact] failed to marshal config: %w", err)
+	}
+	return string(bs), nil
+}
+
+func (a *anonymizer) anonymize(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.MappingNode:
+		for i := 0; i < len(n.Content)-1; i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if anonymizedAddrKeys[k.Value] {
+				// h2-opts.host is a list of hosts
+				for _, s := range append([]*yaml.Node{v}, v.Content...) {
+					// e.g. "ipv6: true" is a switch, not an address
+					if s.Kind == yaml.ScalarNode && s.ShortTag() == "!!str" && s.Value != "" {
+						s.Value, s.Style = a.addr(s.Value), 0
+					}
+				}
+				continue
+			}
+			a.anonymize(v)
+		}
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, c := range n.Content {
+			a.anonymize(c)
+		}
+	}
+}
+
+// addr returns the placeholder of the address, ips(with an optional prefix length) are mapped
+// into the documentation ranges(RFC 5737/3849) and domains to example.com.
+func (a *anonymizer) addr(s string) string {
+	if p, ok := a.addrs[s]; ok {
+		return p
+	}
+
+	ipStr, suffix, _ := strings.Cut(s, "/")
+	if suffix != "" {
+		suffix = "/" + suffix
+	}
+	var p string
+	if ip := net.ParseIP(ipStr); ip != nil && ip.To4() != nil {
+		a.ip4++
+		p = fmt.Sprintf("192.0.2.%d%s", a.ip4%254+1, suffix)
+	} else if ip != nil {
+		a.ip6++
+		p = fmt.Sprintf("2001:db8::%x%s", a.ip6, suffix)
+	} else {
+		a.host++
+		p = fmt.Sprintf("server%d.example.com", a.host)
+	}
+	a.addrs[s] = p
+	return p
+}
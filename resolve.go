@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UnresolvedServer is a proxy whose server hostname does not resolve
+type UnresolvedServer struct {
+	Proxy  string
+	Server string
+	Err    error
+}
+
+func (u UnresolvedServer) String() string {
+	return fmt.Sprintf("%s(%s): %v", u.Proxy, u.Server, u.Err)
+}
+
+// UnresolvedServers resolves the server hostname of each proxy and returns the proxies whose
+// server does not resolve. The servers are resolved by --fetch-resolver, the first plain ip
+// of dns.default-nameserver or the system resolver.
+func UnresolvedServers(cc *ClashConf) []UnresolvedServer {
+	proxies := make(map[string][]string)
+	for _, p := range cc.Proxies {
+		if p.Server == "" || net.ParseIP(p.Server) != nil {
+			continue
+		}
+		proxies[p.Server] = append(proxies[p.Server], p.Name)
+	}
+	if len(proxies) == 0 {
+		return nil
+	}
+
+	resolver := serverResolver(cc)
+	_, fakeIPNet, _ := net.ParseCIDR(cc.DNS.FakeIPRange)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed []UnresolvedServer
+	sem := make(chan struct{}, resolveConcurrency)
+	for host, names := range proxies {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string, names []string) {
+			defer func() { <-sem; wg.Done() }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+			defer cancel()
+			ips, err := resolver.LookupIPAddr(ctx, host)
+			if err == nil {
+				// the dns of the host is hijacked by clash, a fake ip proves nothing
+				if fakeIPNet != nil && len(ips) > 0 && fakeIPNet.Contains(ips[0].IP) {
+					logrus.Debugf("[resolve] %s resolved to a fake ip, skip", host)
+				}
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			for _, name := range names {
+				failed = append(failed, UnresolvedServer{Proxy: name, Server: host, Err: err})
+			}
+		}(host, names)
+	}
+	wg.Wait()
+
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Proxy < failed[j].Proxy })
+	return failed
+}
+
+func serverResolver(cc *ClashConf) *net.Resolver {
+	addr := ""
+	if conf.FetchResolver != "" {
+		addr = fetchResolverAddr()
+	} else {
+		for _, ns := range cc.DNS.DefaultNameserver {
+			if net.ParseIP(ns) != nil {
+				addr = net.JoinHostPort(ns, "53")
+				break
+			}
+		}
+	}
+	if addr == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// warnUnresolvedServers logs the proxies whose server does not resolve(--resolve-servers)
+func warnUnresolvedServers(cc *ClashConf) {
+	failed := UnresolvedServers(cc)
+	if len(failed) == 0 {
+		return
+	}
+	var lines []string
+	for _, f := range failed {
+		lines = append(lines, f.String())
+	}
+	logrus.Warnf("[resolve] %d proxies have a server that does not resolve:\n  - %s", len(failed), strings.Join(lines, "\n  - "))
+}
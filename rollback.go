@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clashErrorLine matches the clash log lines counted as errors by --auto-rollback, clash logs
+// failed dials and dns queries at warning level.
+var clashErrorLine = regexp.MustCompile(`level=(warning|error)`)
+
+// logErrorCounter records the time of each clash error log line
+type logErrorCounter struct {
+	mu    sync.Mutex
+	line  []byte
+	times []time.Time
+	keep  time.Duration
+}
+
+func newLogErrorCounter(keep time.Duration) *logErrorCounter {
+	return &logErrorCounter{keep: keep}
+}
+
+func (c *logErrorCounter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.line = append(c.line, p...)
+	for {
+		i := bytes.IndexByte(c.line, '\n')
+		if i < 0 {
+			break
+		}
+		if clashErrorLine.Match(c.line[:i]) {
+			c.times = append(c.times, now)
+		}
+		c.line = c.line[i+1:]
+	}
+	if len(c.line) > restartOnLogMaxLine {
+		c.line = c.line[:0]
+	}
+
+	// drop the records that are too old to be compared
+	n := 0
+	for n < len(c.times) && now.Sub(c.times[n]) > c.keep {
+		n++
+	}
+	c.times = c.times[n:]
+	return len(p), nil
+}
+
+// Count returns the number of error lines logged in [from, to)
+func (c *logErrorCounter) Count(from, to time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, t := range c.times {
+		if !t.Before(from) && t.Before(to) {
+			n++
+		}
+	}
+	return n
+}
+
+// clashErrors counts the clash error logs, it is only set with --auto-rollback
+var clashErrors *logErrorCounter
+
+// reloadGeneration is increased by each applied reload, a pending rollback check is dropped
+// once a newer config has been applied.
+var reloadGeneration atomic.Int64
+
+// previousConfig is the config replaced by the last reload or rollback, it is restored by the
+// rollback command of the control socket
+var previousConfig atomic.Pointer[string]
+
+// watchReload compares the clash error logs of the window after a reload with the window
+// before it, the previous config is restored if the errors spiked(--auto-rollback).
+func watchReload(previous, writePath string, reloaded time.Time) {
+	gen := reloadGeneration.Load()
+	window := conf.RollbackWindow
+	time.Sleep(time.Until(reloaded.Add(window)))
+
+	before := clashErrors.Count(reloaded.Add(-window), reloaded)
+	after := clashErrors.Count(reloaded, reloaded.Add(window))
+	if after < conf.RollbackMinErrors || float64(after) <= float64(before)*conf.RollbackFactor {
+		logrus.Debugf("[rollback] reload kept: %d clash errors within %s after the reload, %d before", after, window, before)
+		return
+	}
+
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	if reloadGeneration.Load() != gen {
+		logrus.Infof("[rollback] clash errors spiked after the reload(%d, %d before), but a newer config has been applied, skip rollback", after, before)
+		return
+	}
+
+	logrus.Warnf("[rollback] %d clash errors within %s after the reload, %d before(factor %.1f, minimum %d), rolling back to the previous config...",
+		after, window, before, conf.RollbackFactor, conf.RollbackMinErrors)
+	if err := rollbackConfig(previous, writePath); err != nil {
+		logrus.Errorf("[rollback] failed to roll back clash config: %v", err)
+		DesktopNotify("TPClash rollback failed", "%v", err)
+		return
+	}
+	metricRollbacks.Add(1)
+	reloadGeneration.Add(1)
+	logrus.Warn("[rollback] previous clash config restored, the new config stays inactive until it changes again")
+	DesktopNotify("TPClash config rolled back", "%d clash errors within %s after the reload(%d before)", after, window, before)
+}
+
+// rollbackConfig applies the previous config again, it was valid when it was applied
+func rollbackConfig(previous, writePath string) error {
+	cc, err := CheckConfig(previous)
+	if err != nil {
+		return err
+	}
+	current := loadAppliedConfig(writePath)
+	if conf.InMemory {
+		inMemoryConfig.Store(&previous)
+	} else if err = WriteFileAtomic(writePath, []byte(previous), 0644); err != nil {
+		return err
+	}
+	if err = reloadClashConfig(cc, writePath); err != nil {
+		return err
+	}
+
+	currentClashConf.Store(cc)
+	ApplyGroupDefaults(cc)
+	// a second rollback switches back to the config just replaced
+	if current != "" && current != previous {
+		previousConfig.Store(&current)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// IPRule is a policy routing rule(ip rule), the zero values of Mark, Dst and TCPSport are
+// not matched
+type IPRule struct {
+	Family   int
+	Priority uint32
+	Table    uint32
+	Mark     uint32
+	Dst      *net.IPNet
+	TCPSport uint16
+}
+
+func (r IPRule) String() string {
+	s := fmt.Sprintf("pref %d", r.Priority)
+	if r.Dst != nil {
+		s += " to " + r.Dst.String()
+	}
+	if r.TCPSport != 0 {
+		s += fmt.Sprintf(" ipproto tcp sport %d", r.TCPSport)
+	}
+	if r.Mark != 0 {
+		s += fmt.Sprintf(" fwmark %#x", r.Mark)
+	}
+	return s + fmt.Sprintf(" lookup %d", r.Table)
+}
+
+// AddIPRule adds the rule, an existing identical rule is not an error
+func AddIPRule(r IPRule) error {
+	err := rtnlRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, r.message())
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add ip rule(%s): %w", r, err)
+	}
+	return nil
+}
+
+// DelIPRule deletes the rule, a missing rule is not an error
+func DelIPRule(r IPRule) error {
+	err := rtnlRequest(unix.RTM_DELRULE, 0, r.message())
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete ip rule(%s): %w", r, err)
+	}
+	return nil
+}
+
+// ListIPRules returns the ip rules of both families
+func ListIPRules() ([]IPRule, error) {
+	// an AF_UNSPEC header dumps the rules of all families
+	msgs, err := rtnlDump(unix.RTM_GETRULE, make([]byte, unix.SizeofRtMsg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ip rules: %w", err)
+	}
+	var rules []IPRule
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWRULE {
+			continue
+		}
+		if r, ok := parseIPRule(m.Data); ok {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// parseIPRule parses a fib_rule_hdr and its attributes, the attributes IPRule does not
+// represent(e.g. the source or the interface) are skipped
+func parseIPRule(b []byte) (IPRule, bool) {
+	if len(b) < unix.SizeofRtMsg {
+		return IPRule{}, false
+	}
+	r := IPRule{Family: int(b[0]), Table: uint32(b[4])}
+	dstLen := int(b[1])
+	for attrs := b[unix.SizeofRtMsg:]; len(attrs) >= unix.SizeofRtAttr; {
+		l := int(binary.NativeEndian.Uint16(attrs[0:2]))
+		if l < unix.SizeofRtAttr || l > len(attrs) {
+			return IPRule{}, false
+		}
+		data := attrs[unix.SizeofRtAttr:l]
+		switch binary.NativeEndian.Uint16(attrs[2:4]) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER) {
+		case unix.FRA_PRIORITY:
+			if len(data) >= 4 {
+				r.Priority = binary.NativeEndian.Uint32(data)
+			}
+		case unix.FRA_TABLE:
+			if len(data) >= 4 {
+				r.Table = binary.NativeEndian.Uint32(data)
+			}
+		case unix.FRA_FWMARK:
+			if len(data) >= 4 {
+				r.Mark = binary.NativeEndian.Uint32(data)
+			}
+		case unix.FRA_DST:
+			if len(data) == net.IPv4len || len(data) == net.IPv6len {
+				r.Dst = &net.IPNet{IP: net.IP(append([]byte(nil), data...)), Mask: net.CIDRMask(dstLen, len(data)*8)}
+			}
+		case unix.FRA_SPORT_RANGE:
+			if len(data) >= 4 {
+				r.TCPSport = binary.NativeEndian.Uint16(data[0:2])
+			}
+		}
+		attrs = attrs[min((l+unix.RTA_ALIGNTO-1) & ^(unix.RTA_ALIGNTO-1), len(attrs)):]
+	}
+	return r, true
+}
+
+func (r IPRule) message() []byte {
+	// struct fib_rule_hdr has the same layout as struct rtmsg
+	hdr := make([]byte, unix.SizeofRtMsg)
+	hdr[0] = byte(r.Family)
+	hdr[4] = unix.RT_TABLE_UNSPEC
+	hdr[7] = unix.FR_ACT_TO_TBL
+
+	b := rtnlAttr(hdr, unix.FRA_PRIORITY, rtnlUint32(r.Priority))
+	b = rtnlAttr(b, unix.FRA_TABLE, rtnlUint32(r.Table))
+	if r.Mark != 0 {
+		b = rtnlAttr(b, unix.FRA_FWMARK, rtnlUint32(r.Mark))
+		b = rtnlAttr(b, unix.FRA_FWMASK, rtnlUint32(0xffffffff))
+	}
+	if r.Dst != nil {
+		ones, _ := r.Dst.Mask.Size()
+		b[1] = byte(ones)
+		b = rtnlAttr(b, unix.FRA_DST, rtnlIP(r.Family, r.Dst.IP))
+	}
+	if r.TCPSport != 0 {
+		// struct fib_rule_port_range{start, end}
+		ports := make([]byte, 4)
+		binary.NativeEndian.PutUint16(ports[0:2], r.TCPSport)
+		binary.NativeEndian.PutUint16(ports[2:4], r.TCPSport)
+		b = rtnlAttr(b, unix.FRA_IP_PROTO, []byte{unix.IPPROTO_TCP})
+		b = rtnlAttr(b, unix.FRA_SPORT_RANGE, ports)
+	}
+	return b
+}
+
+// AddDeviceRoute adds a default route via the device to the routing table, an existing
+// route is not an error
+func AddDeviceRoute(family int, table uint32, dev string) error {
+	msg, err := deviceRouteMessage(family, table, dev)
+	if err != nil {
+		return err
+	}
+	err = rtnlRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg)
+	if errors.Is(err, unix.EEXIST) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add default route via %s to table %d: %w", dev, table, err)
+	}
+	return nil
+}
+
+// DelDeviceRoute deletes the default route via the device, a missing route or device is not
+// an error, the route is removed by the kernel together with the device.
+func DelDeviceRoute(family int, table uint32, dev string) error {
+	msg, err := deviceRouteMessage(family, table, dev)
+	if err != nil {
+		return nil
+	}
+	err = rtnlRequest(unix.RTM_DELROUTE, 0, msg)
+	if errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENODEV) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete default route via %s from table %d: %w", dev, table, err)
+	}
+	return nil
+}
+
+func deviceRouteMessage(family int, table uint32, dev string) ([]byte, error) {
+	iface, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, unix.SizeofRtMsg)
+	hdr[0] = byte(family)
+	hdr[4] = unix.RT_TABLE_UNSPEC
+	hdr[5] = unix.RTPROT_BOOT
+	hdr[6] = unix.RT_SCOPE_LINK
+	hdr[7] = unix.RTN_UNICAST
+
+	b := rtnlAttr(hdr, unix.RTA_TABLE, rtnlUint32(table))
+	return rtnlAttr(b, unix.RTA_OIF, rtnlUint32(uint32(iface.Index))), nil
+}
+
+// rtnlSend opens a rtnetlink socket and sends a single request on it, the socket has to be
+// closed by the caller
+func rtnlSend(typ uint16, flags uint16, body []byte) (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return -1, err
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+	if err = unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// rtnlDump sends a rtnetlink dump request and returns the messages of the reply
+func rtnlDump(typ uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := rtnlSend(typ, unix.NLM_F_DUMP, body)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	var msgs []syscall.NetlinkMessage
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		parts, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range parts {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return msgs, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+						return nil, unix.Errno(-errno)
+					}
+				}
+				return msgs, nil
+			default:
+				msgs = append(msgs, m)
+			}
+		}
+	}
+}
+
+// rtnlRequest sends a single rtnetlink request and waits for its ack
+func rtnlRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := rtnlSend(typ, unix.NLM_F_ACK|flags, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	buf := make([]byte, 4096)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != syscall.NLMSG_ERROR || len(m.Data) < 4 {
+				continue
+			}
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return unix.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+func rtnlAttr(b []byte, typ uint16, data []byte) []byte {
+	l := unix.SizeofRtAttr + len(data)
+	attr := make([]byte, (l+unix.NLMSG_ALIGNTO-1) & ^(unix.NLMSG_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(attr[0:2], uint16(l))
+	binary.NativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[unix.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+func rtnlUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.NativeEndian.PutUint32(b, v)
+	return b
+}
+
+func rtnlIP(family int, ip net.IP) []byte {
+	if family == unix.AF_INET {
+		return ip.To4()
+	}
+	return ip.To16()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// rulesFileComment tags the rules applied from a rules file(--rules-file), the prefix
+// is shared with the programmatic rules so that both are cleaned up the same way.
+const rulesFileComment = ruleCommentPrefix + "rules-file"
+
+var exportRulesCmd = &cobra.Command{
+	Use:   "export-rules [FILENAME]",
+	Short: "Export tpclash's own nftables rules as a nft script",
+	Run: func(cmd *cobra.Command, args []string) {
+		var buf bytes.Buffer
+		if err := ExportRules(&buf); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if len(args) == 0 {
+			fmt.Print(buf.String())
+			return
+		}
+		if err := WriteFileAtomic(args[0], buf.Bytes(), 0644); err != nil {
+			logrus.Fatalf("[rules] failed to write rules file: %v", err)
+		}
+		logrus.Infof("[rules] rules file storage location %s", args[0])
+	},
+}
+
+// dockerUserChains returns the DOCKER-USER chains that tpclash installs rules into
+func dockerUserChains(nft *nftables.Conn) ([]*nftables.Chain, error) {
+	cs, err := nft.ListChainsOfTableFamily(nftables.TableFamilyIPv4)
+	if err != nil {
+		return nil, fmt.Errorf("[rules] failed to list nftables chain: %w", err)
+	}
+
+	var chains []*nftables.Chain
+	for _, chain := range cs {
+		if chain.Name == ChainDockerUser {
+			chains = append(chains, chain)
+		}
+	}
+	return chains, nil
+}
+
+// ExportRules writes the rules EnableProxy would install as a `nft -f` compatible script,
+// only tpclash's own rules are included so it can be applied without clobbering others.
+func ExportRules(w io.Writer) error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[rules] failed connect to nftables: %v", err)
+	}
+
+	chains, err := dockerUserChains(nft)
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(w, "# generated by tpclash %s, only contains tpclash's own rules\n", version)
+	if len(chains) == 0 {
+		_, _ = fmt.Fprintf(w, "# no %s chain found, docker compatible rules are not required\n", ChainDockerUser)
+		return nil
+	}
+	for _, chain := range chains {
+		_, _ = fmt.Fprintf(w, "insert rule %s %s %s accept comment %q\n", tableFamilyName(chain.Table.Family), chain.Table.Name, chain.Name, rulesFileComment)
+	}
+	return nil
+}
+
+// ApplyRulesFile applies a pre-generated rules file(export-rules) with nft, every rule in
+// the file must carry a tpclash comment so that it can be removed by DisableProxy.
+func ApplyRulesFile(name string) error {
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("[rules] failed to read rules file: %w", err)
+	}
+	if err = checkRulesFile(bs); err != nil {
+		return err
+	}
+
+	nftBin, err := resolveTool("nft", conf.NftBin)
+	if err != nil {
+		return fmt.Errorf("[rules] nft command is required to apply rules file: %w", err)
+	}
+
+	// remove the rules of previous runs first, so that applying is idempotent
+	if err = DisableDockerCompatible(); err != nil {
+		return err
+	}
+	if err = DisableRulesFile(); err != nil {
+		return err
+	}
+
+	out, err := runFirewallCmd(nftBin, "-f", name)
+	if err != nil {
+		return fmt.Errorf("[rules] failed to apply rules file: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	logrus.Infof("[rules] rules file %s applied", name)
+	return nil
+}
+
+// DisableRulesFile removes the rules applied from a rules file, the file may add rules to any
+// chain of any table, so all chains are searched for the rules-file comment.
+func DisableRulesFile() error {
+	nft, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("[rules] failed connect to nftables: %v", err)
+	}
+
+	chains, err := nft.ListChains()
+	if err != nil {
+		return fmt.Errorf("[rules] failed to list nftables chain: %w", err)
+	}
+	deleted := 0
+	for _, chain := range chains {
+		rs, err := nft.GetRules(chain.Table, chain)
+		if err != nil {
+			return fmt.Errorf("[rules] failed to get nftables rules of %s: %w", chain.Name, err)
+		}
+		for _, rule := range rs {
+			if ruleCommentText(rule) != rulesFileComment {
+				continue
+			}
+			if err = nft.DelRule(rule); err != nil {
+				return fmt.Errorf("[rules] failed to delete nftables rules: %w", err)
+			}
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return nil
+	}
+	if err = nftFlush(nft, "disable rules file"); err != nil {
+		return fmt.Errorf("[rules] failed to flush nftables: %v", err)
+	}
+	logrus.Infof("[rules] %d rules of the rules file removed", deleted)
+	return nil
+}
+
+// checkRulesFile makes sure that the rules file only adds tpclash tagged rules
+func checkRulesFile(bs []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(bs))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !(strings.HasPrefix(line, "insert rule ") || strings.HasPrefix(line, "add rule ")) ||
+			!strings.Contains(line, fmt.Sprintf("comment %q", rulesFileComment)) {
+			return fmt.Errorf("[rules] rules file line %d is not a tpclash rule(insert/add rule ... comment %q): %s", n, rulesFileComment, line)
+		}
+	}
+	return scanner.Err()
+}
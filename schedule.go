@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// scheduleDefaultSource switches back to the config of --config
+const scheduleDefaultSource = "default"
+
+// cronSpec is a standard 5 field cron expression(minute hour day-of-month month day-of-week),
+// each field is a bitset of the matching values.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+// parseCron parses the cron expression, fields support '*', values, ranges, steps and lists
+// (e.g. "*/15 9-18 * * 1-5"), day-of-week 0 and 7 are both Sunday.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields(minute hour day-of-month month day-of-week), got %d", len(fields))
+	}
+
+	var spec cronSpec
+	var err error
+	bounds := []struct {
+		field    *uint64
+		min, max int
+	}{{&spec.minute, 0, 59}, {&spec.hour, 0, 23}, {&spec.dom, 1, 31}, {&spec.month, 1, 12}, {&spec.dow, 0, 7}}
+	for i, b := range bounds {
+		if *b.field, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("field %q: %w", fields[i], err)
+		}
+	}
+	if spec.dow&(1<<7) != 0 {
+		spec.dow |= 1
+	}
+	spec.domAny, spec.dowAny = fields[2] == "*", fields[4] == "*"
+	return &spec, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			loStr, hiStr, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(loStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", loStr)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(hiStr); err != nil {
+					return 0, fmt.Errorf("invalid value %q", hiStr)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// Match checks whether the minute of t matches the expression, like cron the day matches
+// either day field if both are restricted.
+func (s *cronSpec) Match(t time.Time) bool {
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	dom, dow := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// ScheduleEntry switches the config source at the times matching the cron expression(--schedule)
+type ScheduleEntry struct {
+	Cron   string
+	Source string
+	spec   *cronSpec
+}
+
+func parseSchedules() ([]ScheduleEntry, error) {
+	var entries []ScheduleEntry
+	for _, s := range conf.Schedules {
+		expr, source, ok := strings.Cut(s, "=>")
+		expr, source = strings.TrimSpace(expr), strings.TrimSpace(source)
+		if !ok || expr == "" || source == "" {
+			return nil, fmt.Errorf("[schedule] failed to parse schedule(<cron>=><config file|default>): %s", s)
+		}
+		spec, err := parseCron(expr)
+		if err != nil {
+			return nil, fmt.Errorf("[schedule] invalid cron expression %q: %w", expr, err)
+		}
+		if strings.Contains(source, "://") {
+			return nil, fmt.Errorf("[schedule] scheduled config must be a local file: %s", source)
+		}
+		if source == conf.ClashConfig {
+			source = scheduleDefaultSource
+		}
+		if source != scheduleDefaultSource {
+			if _, err = os.Stat(source); err != nil {
+				return nil, fmt.Errorf("[schedule] scheduled config is not accessible: %w", err)
+			}
+		}
+		entries = append(entries, ScheduleEntry{Cron: expr, Source: source, spec: spec})
+	}
+	return entries, nil
+}
+
+// scheduledSourceAt returns the source switched to by the last schedule boundary at or before t,
+// "" means the config of --config.
+func scheduledSourceAt(entries []ScheduleEntry, t time.Time) string {
+	t = t.Truncate(time.Minute)
+	for end := t.Add(-scheduleLookback); !t.Before(end); t = t.Add(-time.Minute) {
+		// the last entry wins if several match the same minute
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].spec.Match(t) {
+				return entries[i].source()
+			}
+		}
+	}
+	return ""
+}
+
+func (e ScheduleEntry) source() string {
+	if e.Source == scheduleDefaultSource {
+		return ""
+	}
+	return e.Source
+}
+
+// nextSchedule returns the first schedule boundary after t and the source switched to
+func nextSchedule(entries []ScheduleEntry, t time.Time) (time.Time, string, bool) {
+	t = t.Truncate(time.Minute)
+	for end := t.Add(scheduleLookback); t.Before(end); {
+		t = t.Add(time.Minute)
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].spec.Match(t) {
+				return t, entries[i].source(), true
+			}
+		}
+	}
+	return time.Time{}, "", false
+}
+
+// ActiveSchedule returns the config source active now(--schedule), "" means --config
+func ActiveSchedule() string {
+	entries, err := parseSchedules()
+	if err != nil || len(entries) == 0 {
+		return ""
+	}
+	return scheduledSourceAt(entries, time.Now())
+}
+
+// WatchSchedule notifies the returned chan with the config source at each schedule boundary,
+// "" means switching back to --config. A nil chan(never ready) is returned without --schedule.
+// The schedule follows the local time of tpclash(TZ).
+func WatchSchedule(ctx context.Context) <-chan string {
+	entries, err := parseSchedules()
+	if err != nil {
+		fatal(ExitConfigInvalid, err)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	ch := make(chan string, 1)
+	go func() {
+		for {
+			at, source, ok := nextSchedule(entries, time.Now())
+			if !ok {
+				logrus.Warn("[schedule] no schedule boundary within a year, stop scheduling")
+				return
+			}
+			logrus.Debugf("[schedule] next config switch at %s", at.Format(time.RFC3339))
+
+			timer := time.NewTimer(time.Until(at))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			name := source
+			if name == "" {
+				name = conf.ClashConfig
+			}
+			logrus.Infof("[schedule] switching the config source to %s", name)
+			select {
+			case ch <- source:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// loadScheduledConfig reads the config of a schedule entry, it is decrypted like --config
+func loadScheduledConfig(source string) (string, error) {
+	bs, err := os.ReadFile(source)
+	if err != nil {
+		return "", fmt.Errorf("[schedule] scheduled config read error: %w", err)
+	}
+	if conf.ConfigEncPassword != "" {
+		plaintext, err := Decrypt(bs, conf.ConfigEncPassword)
+		return string(plaintext), err
+	}
+	return string(bs), nil
+}
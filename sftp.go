@@ -0,0 +1,237 @@
+//go:build !nosftp
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const featureSFTP = true
+
+// sftp packet types(draft-ietf-secsh-filexfer-02, version 3)
+const (
+	sshFxpInit    = 1
+	sshFxpVersion = 2
+	sshFxpOpen    = 3
+	sshFxpClose   = 4
+	sshFxpRead    = 5
+	sshFxpStatus  = 101
+	sshFxpHandle  = 102
+	sshFxpData    = 103
+
+	sshFxEOF        = 1
+	sshFxfRead      = 1
+	sftpReadSize    = 32 * 1024
+	sftpMaxFileSize = 64 << 20
+)
+
+// loadSFTPConfig downloads the config from sftp://user@host[:port]/path, the server host key
+// is verified with --ssh-known-hosts, the client authenticates with --ssh-key or ssh-agent.
+func loadSFTPConfig(u *url.URL) ([]byte, error) {
+	if u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("[sftp] user is required(sftp://user@host/path)")
+	}
+
+	hostKeyCallback, err := knownhosts.New(conf.SSHKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("[sftp] failed to load known hosts(--ssh-known-hosts): %w", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if conf.SSHKey != "" {
+		bs, err := os.ReadFile(conf.SSHKey)
+		if err != nil {
+			return nil, fmt.Errorf("[sftp] failed to read ssh key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(bs)
+		if err != nil {
+			return nil, fmt.Errorf("[sftp] failed to parse ssh key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	} else if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, fmt.Errorf("[sftp] failed to connect to ssh-agent: %w", err)
+		}
+		defer func() { _ = conn.Close() }()
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	} else {
+		return nil, errors.New("[sftp] no ssh key(--ssh-key) or ssh-agent(SSH_AUTH_SOCK) available")
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            u.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         conf.HttpTimeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("[sftp] failed to connect to %s: %w", addr, err)
+	}
+	defer func() { _ = client.Close() }()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("[sftp] failed to create ssh session: %w", err)
+	}
+	defer func() { _ = session.Close() }()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return nil, fmt.Errorf("[sftp] failed to request sftp subsystem: %w", err)
+	}
+
+	bs, err := (&sftpConn{r: r, w: w}).readFile(u.Path)
+	if err != nil {
+		return nil, fmt.Errorf("[sftp] failed to read %s: %w", u.Path, err)
+	}
+	return bs, nil
+}
+
+// sftpConn is a minimal sftp client, only reading a whole file is supported
+type sftpConn struct {
+	r  io.Reader
+	w  io.Writer
+	id uint32
+}
+
+func (c *sftpConn) readFile(path string) ([]byte, error) {
+	if err := c.send(sshFxpInit, nil, uint32(3)); err != nil {
+		return nil, err
+	}
+	if typ, _, err := c.recv(); err != nil {
+		return nil, err
+	} else if typ != sshFxpVersion {
+		return nil, fmt.Errorf("unexpected sftp packet %d, want version", typ)
+	}
+
+	// open(filename, pflags, attrs)
+	if err := c.request(sshFxpOpen, []byte(path), uint32(sshFxfRead), uint32(0)); err != nil {
+		return nil, err
+	}
+	typ, data, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if typ != sshFxpHandle {
+		return nil, sftpStatusError(typ, data)
+	}
+	handle, _, err := sftpString(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if c.request(sshFxpClose, handle) == nil {
+			_, _, _ = c.recv()
+		}
+	}()
+
+	var buf bytes.Buffer
+	for {
+		if err = c.request(sshFxpRead, handle, uint64(buf.Len()), uint32(sftpReadSize)); err != nil {
+			return nil, err
+		}
+		typ, data, err = c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if typ == sshFxpStatus && len(data) >= 8 && binary.BigEndian.Uint32(data[4:8]) == sshFxEOF {
+			return buf.Bytes(), nil
+		}
+		if typ != sshFxpData {
+			return nil, sftpStatusError(typ, data)
+		}
+		chunk, _, err := sftpString(data[4:])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(chunk)
+		if buf.Len() > sftpMaxFileSize {
+			return nil, fmt.Errorf("file is larger than %d bytes", sftpMaxFileSize)
+		}
+	}
+}
+
+// request sends a packet with a new request id
+func (c *sftpConn) request(typ byte, fields ...any) error {
+	c.id++
+	return c.send(typ, fields, c.id)
+}
+
+func (c *sftpConn) send(typ byte, fields []any, first uint32) error {
+	var payload bytes.Buffer
+	payload.WriteByte(typ)
+	_ = binary.Write(&payload, binary.BigEndian, first)
+	for _, f := range fields {
+		switch v := f.(type) {
+		case []byte:
+			_ = binary.Write(&payload, binary.BigEndian, uint32(len(v)))
+			payload.Write(v)
+		default:
+			_ = binary.Write(&payload, binary.BigEndian, v)
+		}
+	}
+
+	var pkt bytes.Buffer
+	_ = binary.Write(&pkt, binary.BigEndian, uint32(payload.Len()))
+	pkt.Write(payload.Bytes())
+	_, err := c.w.Write(pkt.Bytes())
+	return err
+}
+
+// recv reads a packet, the returned data starts with the request id(or the version)
+func (c *sftpConn) recv() (byte, []byte, error) {
+	var l uint32
+	if err := binary.Read(c.r, binary.BigEndian, &l); err != nil {
+		return 0, nil, err
+	}
+	if l < 5 || l > sftpReadSize+1024 {
+		return 0, nil, fmt.Errorf("invalid sftp packet length %d", l)
+	}
+	pkt := make([]byte, l)
+	if _, err := io.ReadFull(c.r, pkt); err != nil {
+		return 0, nil, err
+	}
+	return pkt[0], pkt[1:], nil
+}
+
+func sftpString(b []byte) ([]byte, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, errors.New("short sftp packet")
+	}
+	l := binary.BigEndian.Uint32(b)
+	if uint32(len(b)-4) < l {
+		return nil, nil, errors.New("short sftp packet")
+	}
+	return b[4 : 4+l], b[4+l:], nil
+}
+
+func sftpStatusError(typ byte, data []byte) error {
+	if typ != sshFxpStatus || len(data) < 8 {
+		return fmt.Errorf("unexpected sftp packet %d", typ)
+	}
+	msg, _, _ := sftpString(data[8:])
+	return fmt.Errorf("sftp status %d: %s", binary.BigEndian.Uint32(data[4:8]), msg)
+}
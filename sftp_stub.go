@@ -0,0 +1,14 @@
+//go:build nosftp
+
+package main
+
+import (
+	"errors"
+	"net/url"
+)
+
+const featureSFTP = false
+
+func loadSFTPConfig(_ *url.URL) ([]byte, error) {
+	return nil, errors.New("[sftp] tpclash is built without sftp support(-tags nosftp)")
+}
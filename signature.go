@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignPublicKey is a minisign(https://jedisct1.github.io/minisign/) ed25519 public key
+type minisignPublicKey struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+// loadMinisignPublicKey loads the public key(--verify-key) from a minisign .pub file or the base64 key itself
+func loadMinisignPublicKey(s string) (*minisignPublicKey, error) {
+	if bs, err := os.ReadFile(s); err == nil {
+		lines := minisignLines(bs)
+		if len(lines) < 2 {
+			return nil, errors.New("[signature] invalid minisign public key file")
+		}
+		s = lines[1]
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(raw) != 42 || string(raw[:2]) != "Ed" {
+		return nil, errors.New("[signature] invalid minisign public key")
+	}
+	pk := &minisignPublicKey{key: ed25519.PublicKey(raw[10:])}
+	copy(pk.keyID[:], raw[2:10])
+	return pk, nil
+}
+
+// Verify checks the data against a minisign detached signature(.minisig), both the
+// legacy(Ed) and the prehashed(ED) signatures are supported.
+func (pk *minisignPublicKey) Verify(data, sig []byte) error {
+	lines := minisignLines(sig)
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("[signature] invalid minisign signature file")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(raw) != 74 {
+		return errors.New("[signature] invalid minisign signature")
+	}
+	if !bytes.Equal(raw[2:10], pk.keyID[:]) {
+		return fmt.Errorf("[signature] signature key id %X does not match the public key %X", raw[2:10], pk.keyID)
+	}
+
+	msg := data
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		sum := blake2b.Sum512(data)
+		msg = sum[:]
+	default:
+		return fmt.Errorf("[signature] unsupported signature algorithm %q", raw[:2])
+	}
+	if !ed25519.Verify(pk.key, msg, raw[10:]) {
+		return errors.New("[signature] signature verification failed")
+	}
+
+	// the global signature covers the signature and the trusted comment
+	global, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(global) != ed25519.SignatureSize {
+		return errors.New("[signature] invalid minisign global signature")
+	}
+	comment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(pk.key, append(append([]byte{}, raw[10:]...), comment...), global) {
+		return errors.New("[signature] trusted comment verification failed")
+	}
+	return nil
+}
+
+func minisignLines(bs []byte) []string {
+	var lines []string
+	for _, l := range strings.Split(string(bs), "\n") {
+		if l = strings.TrimRight(l, "\r"); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// sshSession returns the client address and the server port of the current ssh session
+// (SSH_CONNECTION), a nil address is returned if tpclash is not run over ssh.
+func sshSession() (net.IP, uint16) {
+	// SSH_CONNECTION: <client ip> <client port> <server ip> <server port>
+	fields := strings.Fields(os.Getenv("SSH_CONNECTION"))
+	if len(fields) != 4 {
+		return nil, 0
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, 0
+	}
+	return net.ParseIP(fields[0]), uint16(port)
+}
+
+// sshBypassRules are the rules that send the replies of the ssh session through the main
+// routing table, ahead of the rules of the clash tun(auto-route) and --proxy-fwmark.
+func sshBypassRules() []IPRule {
+	client, port := sshSession()
+	if client == nil {
+		return nil
+	}
+
+	r := IPRule{Priority: sshBypassRulePriority, Table: unix.RT_TABLE_MAIN, TCPSport: port}
+	if ip4 := client.To4(); ip4 != nil {
+		r.Family, r.Dst = unix.AF_INET, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	} else {
+		r.Family, r.Dst = unix.AF_INET6, &net.IPNet{IP: client, Mask: net.CIDRMask(128, 128)}
+	}
+	return []IPRule{r}
+}
+
+// EnableSSHBypass keeps the current ssh session(--ssh-safe) out of the proxy, so that
+// enabling the proxy never drops the session of the administrator.
+func EnableSSHBypass() error {
+	for _, r := range sshBypassRules() {
+		logrus.Infof("[ssh-safe] bypassing the proxy for the ssh session: ip rule %s", r)
+		if err := AddIPRule(r); err != nil {
+			return fmt.Errorf("[ssh-safe] %w", err)
+		}
+	}
+	return nil
+}
+
+// DisableSSHBypass removes the rules of EnableSSHBypass
+func DisableSSHBypass() error {
+	for _, r := range sshBypassRules() {
+		if err := DelIPRule(r); err != nil {
+			return fmt.Errorf("[ssh-safe] %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// stateFiles are the clash home files bundled by export-state, cache.db holds
+// the proxy selections and the fake-ip cache
+var stateFiles = []string{InternalConfigName, clashCacheName}
+
+// stateFilePath returns the location of a state file, cache.db is created by clash in its
+// asset dir unless it is pinned by --cache-file
+func stateFilePath(name string) string {
+	if name == InternalConfigName {
+		return filepath.Join(conf.ClashHome, name)
+	}
+	if name == clashCacheName && conf.CacheFile != "" {
+		return conf.CacheFile
+	}
+	return filepath.Join(clashAssetDir(), name)
+}
+
+// StateManifest describes the files contained in a state bundle
+type StateManifest struct {
+	Version  string            `json:"version"`
+	Clash    string            `json:"clash"`
+	Hostname string            `json:"hostname"`
+	Created  time.Time         `json:"created"`
+	Files    map[string]string `json:"files"` // file name -> sha256
+}
+
+var exportStateCmd = &cobra.Command{
+	Use:   "export-state [FILENAME]",
+	Short: "Export clash state to a tarball",
+	Run: func(cmd *cobra.Command, args []string) {
+		target := fmt.Sprintf("tpclash-state-%s.tar.gz", time.Now().Format("20060102150405"))
+		if len(args) == 1 {
+			target = args[0]
+		}
+
+		if err := exportState(target); err != nil {
+			fatal(ExitGeneral, err)
+		}
+		logrus.Infof("[state] state bundle storage location %s", target)
+	},
+}
+
+var importStateCmd = &cobra.Command{
+	Use:   "import-state FILENAME",
+	Short: "Import clash state from a tarball",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			_ = cmd.Help()
+			return
+		}
+
+		if pid, ok := clashRunning(); ok {
+			if !conf.ForceImportState {
+				fatalf(ExitGeneral, "[state] clash is running(pid %d) with home %s, stop it first or use --force", pid, conf.ClashHome)
+			}
+			logrus.Warnf("[state] clash is running(pid %d), force overwriting its state...", pid)
+		}
+
+		if err := importState(args[0]); err != nil {
+			fatal(ExitConfigInvalid, err)
+		}
+		// the internal config is replaced by the fetched config at startup unless it is frozen
+		logrus.Infof("[state] state bundle imported to %s, restart tpclash to apply", conf.ClashHome)
+		logrus.Warnf("[state] the imported %s is only kept if tpclash starts with --frozen, otherwise it is replaced by the config of --config", InternalConfigName)
+	},
+}
+
+func exportState(target string) error {
+	hostname, _ := os.Hostname()
+	manifest := StateManifest{
+		Version:  version,
+		Clash:    clash,
+		Hostname: hostname,
+		Created:  time.Now(),
+		Files:    map[string]string{},
+	}
+
+	for _, name := range stateFiles {
+		bs, err := os.ReadFile(stateFilePath(name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				logrus.Warnf("[state] %s does not exist, skip...", name)
+				continue
+			}
+			return fmt.Errorf("[state] failed to read %s: %w", name, err)
+		}
+		sum := sha256.Sum256(bs)
+		manifest.Files[name] = hex.EncodeToString(sum[:])
+	}
+	if len(manifest.Files) == 0 {
+		return fmt.Errorf("[state] no state files found in %s", conf.ClashHome)
+	}
+
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("[state] failed to create state bundle: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	mbs, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("[state] failed to marshal manifest: %w", err)
+	}
+	if err = writeTarFile(tw, stateManifestName, mbs); err != nil {
+		return err
+	}
+
+	for name := range manifest.Files {
+		bs, err := os.ReadFile(stateFilePath(name))
+		if err != nil {
+			return fmt.Errorf("[state] failed to read %s: %w", name, err)
+		}
+		if err = writeTarFile(tw, name, bs); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return fmt.Errorf("[state] failed to close tar writer: %w", err)
+	}
+	if err = gw.Close(); err != nil {
+		return fmt.Errorf("[state] failed to close gzip writer: %w", err)
+	}
+
+	return nil
+}
+
+func importState(source string) error {
+	f, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("[state] failed to open state bundle: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("[state] invalid state bundle: %w", err)
+	}
+	defer func() { _ = gr.Close() }()
+
+	var manifest *StateManifest
+	files := map[string][]byte{}
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("[state] invalid state bundle: %w", err)
+		}
+
+		bs, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("[state] failed to read %s from state bundle: %w", hdr.Name, err)
+		}
+
+		if hdr.Name == stateManifestName {
+			manifest = &StateManifest{}
+			if err = json.Unmarshal(bs, manifest); err != nil {
+				return fmt.Errorf("[state] invalid state manifest: %w", err)
+			}
+			continue
+		}
+		if !isStateFile(hdr.Name) {
+			return fmt.Errorf("[state] unexpected file in state bundle: %s", hdr.Name)
+		}
+		files[hdr.Name] = bs
+	}
+
+	if manifest == nil {
+		return errors.New("[state] invalid state bundle: missing manifest")
+	}
+	if len(manifest.Files) != len(files) {
+		return errors.New("[state] invalid state bundle: file list does not match the manifest")
+	}
+	for name, bs := range files {
+		sum := sha256.Sum256(bs)
+		if manifest.Files[name] != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("[state] invalid state bundle: checksum mismatch: %s", name)
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	if manifest.Hostname != hostname {
+		logrus.Warnf("[state] state bundle was exported from %s, host-specific settings(e.g. interface-name) may need to be adjusted", manifest.Hostname)
+	}
+
+	if err = os.MkdirAll(conf.ClashHome, 0755); err != nil {
+		return fmt.Errorf("[state] failed to create clash home: %w", err)
+	}
+	if err = os.MkdirAll(clashAssetDir(), 0755); err != nil {
+		return fmt.Errorf("[state] failed to create clash asset dir: %w", err)
+	}
+	for name, bs := range files {
+		// the internal config contains the clash secret
+		perm := os.FileMode(0644)
+		if name == InternalConfigName {
+			perm = 0600
+		}
+		logrus.Infof("[state] restore -> %s", stateFilePath(name))
+		if err = WriteFileAtomic(stateFilePath(name), bs, perm); err != nil {
+			return fmt.Errorf("[state] failed to restore %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, bs []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(bs)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("[state] failed to write tar header: %s: %w", name, err)
+	}
+	if _, err := tw.Write(bs); err != nil {
+		return fmt.Errorf("[state] failed to write tar file: %s: %w", name, err)
+	}
+	return nil
+}
+
+func isStateFile(name string) bool {
+	for _, s := range stateFiles {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// clashRunning checks whether a clash process started from the current clash home is running
+func clashRunning() (int, bool) {
+	binPath := filepath.Join(conf.ClashHome, InternalClashBinName)
+
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, false
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		exe, err := os.Readlink(filepath.Join("/proc", entry.Name(), "exe"))
+		if err != nil {
+			continue
+		}
+		if exe == binPath {
+			return pid, true
+		}
+	}
+	return 0, false
+}
+
+func init() {
+	importStateCmd.PersistentFlags().BoolVar(&conf.ForceImportState, "force", false, "overwrite the state of a running instance")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
@@ -39,7 +40,12 @@ func extract(efs embed.FS, dirEntries []fs.DirEntry, origin, target string) erro
 				return err
 			}
 		} else {
-			sf, err := static.Open(filepath.Join(origin, dirEntry.Name()))
+			var sf io.ReadCloser
+			if overlay := overlayAsset(filepath.Join(origin, dirEntry.Name())); overlay != "" {
+				sf, err = os.Open(overlay)
+			} else {
+				sf, err = static.Open(filepath.Join(origin, dirEntry.Name()))
+			}
 			if err != nil {
 				return err
 			}
@@ -64,39 +70,161 @@ func extract(efs embed.FS, dirEntries []fs.DirEntry, origin, target string) erro
 
 func ExtractFiles() {
 	logrus.Info("[static] creating storage dir...")
+	fresh := false
 	info, err := os.Stat(conf.ClashHome)
 	if err == nil {
 		if !info.IsDir() {
-			logrus.Fatalf("[static] clash home path is not a dir")
-		}
-
-		if !conf.ForceExtract {
-			logrus.Infof("[static] storage dir %s already exist, skip extract...", conf.ClashHome)
-			return
+			fatal(ExitConfigInvalid, "[static] clash home path is not a dir")
 		}
 	} else {
 		if os.IsNotExist(err) {
 			if err = os.MkdirAll(conf.ClashHome, 0755); err != nil {
-				logrus.Fatalf("[static] failed to create storage dir: %v", err)
+				fatalf(ExitCoreStart, "[static] failed to create storage dir: %v", err)
 			}
+			fresh = true
 		} else {
-			logrus.Fatalf("[static] failed to read storage dir: %v", err)
+			fatalf(ExitCoreStart, "[static] failed to read storage dir: %v", err)
 		}
 	}
 
-	logrus.Info("[static] copy static files...")
 	dirEntries, err := static.ReadDir("static")
 	if err != nil {
-		logrus.Fatalf("[static] failed to read embed dir: %v", err)
+		fatalf(ExitCoreStart, "[static] failed to read embed dir: %v", err)
 	}
 
-	err = extract(static, dirEntries, "static", conf.ClashHome)
+	if fresh || conf.ForceExtract {
+		logrus.Info("[static] copy static files...")
+		err = extract(static, dirEntries, "static", conf.ClashHome)
+	} else {
+		err = extractChanged(dirEntries)
+	}
 	if err != nil {
-		logrus.Fatalf("[static] failed to extract embed files: %v", err)
+		fatalf(ExitCoreStart, "[static] failed to extract embed files: %v", err)
 	}
 
 	err = os.Chmod(filepath.Join(conf.ClashHome, InternalClashBinName), 0755)
 	if err != nil {
-		logrus.Fatalf("[static] failed to update internal clash bin mode: %v", err)
+		fatalf(ExitCoreStart, "[static] failed to update internal clash bin mode: %v", err)
+	}
+
+	if err = os.WriteFile(filepath.Join(conf.ClashHome, extractMarkerName), []byte(embeddedVersion()), 0644); err != nil {
+		logrus.Warnf("[static] failed to write extraction marker: %v", err)
+	}
+}
+
+// extractChanged updates an existing clash home: the dashboards are re-extracted when the
+// embedded version differs from the extraction marker(or --force-extract-ui), other files
+// may have been replaced by the user(e.g. the clash binary) and are only extracted if missing.
+func extractChanged(dirEntries []fs.DirEntry) error {
+	marker, _ := os.ReadFile(filepath.Join(conf.ClashHome, extractMarkerName))
+	changed := string(marker) != embeddedVersion()
+	if !changed && !conf.ForceExtractUI {
+		logrus.Infof("[static] storage dir %s is up to date(%s), skip extract...", conf.ClashHome, embeddedVersion())
+		return nil
+	}
+
+	for _, e := range dirEntries {
+		target := filepath.Join(conf.ClashHome, e.Name())
+		if isEmbeddedUI(e) {
+			logrus.Infof("[static] extract dashboard %s...", e.Name())
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		} else if !changed {
+			continue
+		} else if _, err := os.Stat(target); err == nil {
+			logrus.Debugf("[static] %s already exists, skip extract", target)
+			continue
+		}
+
+		if err := extract(static, []fs.DirEntry{e}, "static", conf.ClashHome); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// embeddedVersion identifies the embedded assets, they only change with the tpclash build
+func embeddedVersion() string {
+	return fmt.Sprintf("version=%s commit=%s clash=%s", version, commit, clash)
+}
+
+// isEmbeddedUI reports whether the embedded entry is a dashboard
+func isEmbeddedUI(e fs.DirEntry) bool {
+	if !e.IsDir() {
+		return false
+	}
+	_, err := fs.Stat(static, filepath.Join("static", e.Name(), "index.html"))
+	return err == nil
+}
+
+// CheckUI verifies that the dashboard dir contains a valid dashboard, an invalid one(e.g. a
+// partial extraction) is replaced by the embedded dashboard. It returns false if no valid
+// dashboard is available.
+func CheckUI() bool {
+	uiPath := filepath.Join(conf.ClashHome, conf.ClashUI)
+	if isValidUI(uiPath) {
+		return true
+	}
+
+	logrus.Warnf("[static] dashboard %s is invalid(missing index.html), extracting the embedded dashboard...", uiPath)
+	embedPath := filepath.Join("static", conf.ClashUI)
+	dirEntries, err := static.ReadDir(embedPath)
+	if err != nil {
+		logrus.Errorf("[static] embedded dashboard %s not found: %v", conf.ClashUI, err)
+		return false
+	}
+
+	if err = os.MkdirAll(uiPath, 0755); err != nil {
+		logrus.Errorf("[static] failed to create dashboard dir: %v", err)
+		return false
 	}
+	if err = extract(static, dirEntries, embedPath, uiPath); err != nil {
+		logrus.Errorf("[static] failed to extract embedded dashboard: %v", err)
+		return false
+	}
+
+	return isValidUI(uiPath)
+}
+
+func isValidUI(dir string) bool {
+	info, err := os.Stat(filepath.Join(dir, "index.html"))
+	return err == nil && !info.IsDir() && info.Size() > 0
+}
+
+// overlayAsset returns the file in the asset overlay dir(--asset-overlay) that shadows the
+// embedded file, the same path relative to the embedded static dir is used. An empty string
+// is returned if there is no valid overlay file, the embedded file is used then.
+func overlayAsset(embedPath string) string {
+	if conf.AssetOverlay == "" {
+		return ""
+	}
+
+	rel, err := filepath.Rel("static", embedPath)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Join(conf.AssetOverlay, rel)
+	info, err := os.Stat(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Warnf("[static] failed to read overlay asset %s, using the embedded one: %v", name, err)
+		}
+		return ""
+	}
+	if !info.Mode().IsRegular() || info.Size() == 0 {
+		logrus.Warnf("[static] overlay asset %s is not a regular non-empty file, using the embedded one", name)
+		return ""
+	}
+	if rel == InternalClashBinName {
+		ver, err := ProbeCoreBinary(name)
+		if err != nil {
+			logrus.Warnf("[static] overlay clash binary %s is invalid, using the embedded one: %v", name, err)
+			return ""
+		}
+		logrus.Infof("[static] using overlay clash binary: %s", ver)
+	}
+
+	logrus.Infof("[static] extract overlay asset %s", name)
+	return name
 }
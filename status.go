@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ServiceState is the state reported by the health endpoint(--health-addr)
+type ServiceState string
+
+const (
+	StateStarting  ServiceState = "starting"
+	StateReady     ServiceState = "ready"
+	StateDegraded  ServiceState = "degraded"
+	StateReloading ServiceState = "reloading"
+	StateStopping  ServiceState = "stopping"
+)
+
+type ServiceStatus struct {
+	State  ServiceState `json:"state"`
+	Reason string       `json:"reason,omitempty"`
+	Since  time.Time    `json:"since"`
+}
+
+var (
+	serviceStatusMu sync.Mutex
+	serviceStatus   = ServiceStatus{State: StateStarting, Since: time.Now()}
+)
+
+// setServiceState updates the service state, the reason explains degraded states
+func setServiceState(state ServiceState, reason string) {
+	serviceStatusMu.Lock()
+	defer serviceStatusMu.Unlock()
+
+	if serviceStatus.State == StateStopping {
+		return
+	}
+	if serviceStatus.State != state || serviceStatus.Reason != reason {
+		logrus.Debugf("[status] %s -> %s %s", serviceStatus.State, state, reason)
+		serviceStatus.State, serviceStatus.Reason, serviceStatus.Since = state, reason, time.Now()
+	}
+}
+
+// serviceStateCode maps the state to a http status code, reloading is an expected transition
+// and keeps reporting healthy so that orchestrators do not flap.
+func serviceStateCode(state ServiceState) int {
+	switch state {
+	case StateReady, StateReloading:
+		return http.StatusOK
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// StartHealthServer serves the service state on /healthz and the metrics on /metrics, the
+// returned func stops the server
+func StartHealthServer(addr string) (func(), error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serviceStatusMu.Lock()
+		bs, _ := json.Marshal(&serviceStatus)
+		code := serviceStateCode(serviceStatus.State)
+		serviceStatusMu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_, _ = w.Write(append(bs, '\n'))
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("[status] failed to listen %s: %w", addr, err)
+	}
+
+	go func() {
+		logrus.Infof("[status] health endpoint listening on http://%s/healthz", addr)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logrus.Errorf("[status] health endpoint stopped: %v", err)
+		}
+	}()
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	}, nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var topCmd = &cobra.Command{
+	Use:   "top",
+	Short: "Show a refreshing view of the clash traffic, proxy groups and tpclash state",
+	Run: func(cmd *cobra.Command, args []string) {
+		cc, err := loadInternalConfig()
+		if err != nil {
+			fatalf(ExitGeneral, "[top] failed to load clash config, is tpclash running? %v", err)
+		}
+		if conf.TopInterval <= 0 {
+			fatalf(ExitConfigInvalid, "[top] invalid refresh interval: %s", conf.TopInterval)
+		}
+
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		ticker := time.NewTicker(conf.TopInterval)
+		defer ticker.Stop()
+
+		var last *topSnapshot
+		for {
+			snap := takeTopSnapshot(cc)
+			renderTop(os.Stdout, snap, last)
+			last = snap
+
+			select {
+			case <-ctx.Done():
+				fmt.Println()
+				return
+			case <-ticker.C:
+			}
+		}
+	},
+}
+
+type topGroup struct {
+	Name  string
+	Type  string
+	Now   string
+	Delay int
+}
+
+// topSnapshot is a point-in-time view of clash and tpclash, errors are shown instead of data
+type topSnapshot struct {
+	Time        time.Time
+	Upload      int64
+	Download    int64
+	Connections int
+	Groups      []topGroup
+	Status      *ServiceStatus
+	ClashErr    error
+	StatusErr   error
+}
+
+func takeTopSnapshot(cc *ClashConf) *topSnapshot {
+	snap := &topSnapshot{Time: time.Now()}
+
+	var conns struct {
+		UploadTotal   int64             `json:"uploadTotal"`
+		DownloadTotal int64             `json:"downloadTotal"`
+		Connections   []json.RawMessage `json:"connections"`
+	}
+	bs, err := clashAPIRequest(cc, "GET", "/connections", nil)
+	if err == nil {
+		err = json.Unmarshal(bs, &conns)
+	}
+	if err != nil {
+		snap.ClashErr = err
+		return snap
+	}
+	snap.Upload, snap.Download, snap.Connections = conns.UploadTotal, conns.DownloadTotal, len(conns.Connections)
+
+	var proxies struct {
+		Proxies map[string]struct {
+			Type    string   `json:"type"`
+			Now     string   `json:"now"`
+			All     []string `json:"all"`
+			History []struct {
+				Delay int `json:"delay"`
+			} `json:"history"`
+		} `json:"proxies"`
+	}
+	bs, err = clashAPIRequest(cc, "GET", "/proxies", nil)
+	if err == nil {
+		err = json.Unmarshal(bs, &proxies)
+	}
+	if err != nil {
+		snap.ClashErr = err
+		return snap
+	}
+	for name, p := range proxies.Proxies {
+		if name == "GLOBAL" || len(p.All) == 0 {
+			continue
+		}
+		g := topGroup{Name: name, Type: p.Type, Now: p.Now, Delay: -1}
+		if now, ok := proxies.Proxies[p.Now]; ok && len(now.History) > 0 {
+			g.Delay = now.History[len(now.History)-1].Delay
+		}
+		snap.Groups = append(snap.Groups, g)
+	}
+	sort.Slice(snap.Groups, func(i, j int) bool { return snap.Groups[i].Name < snap.Groups[j].Name })
+
+	if conf.HealthAddr != "" {
+		snap.Status, snap.StatusErr = fetchServiceStatus(conf.HealthAddr)
+	}
+	return snap
+}
+
+// fetchServiceStatus reads the state of the running tpclash from its health endpoint
+func fetchServiceStatus(addr string) (*ServiceStatus, error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get("http://" + addr + "/healthz")
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var status ServiceStatus
+	if err = json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func renderTop(w io.Writer, snap, last *topSnapshot) {
+	var buf strings.Builder
+	// clear the screen and move the cursor home
+	buf.WriteString("\033[H\033[2J")
+	buf.WriteString(fmt.Sprintf("tpclash top - %s (Ctrl-C to exit)\n\n", snap.Time.Format("15:04:05")))
+
+	switch {
+	case conf.HealthAddr == "":
+		buf.WriteString("tpclash: unknown(start tpclash and top with --health-addr to show the state)\n")
+	case snap.StatusErr != nil:
+		buf.WriteString(fmt.Sprintf("tpclash: unreachable(%v)\n", snap.StatusErr))
+	default:
+		buf.WriteString(fmt.Sprintf("tpclash: %s since %s", snap.Status.State, snap.Status.Since.Local().Format("15:04:05")))
+		if snap.Status.Reason != "" {
+			buf.WriteString(" - " + snap.Status.Reason)
+		}
+		buf.WriteString("\n")
+	}
+
+	if snap.ClashErr != nil {
+		buf.WriteString(fmt.Sprintf("clash:   unreachable(%v)\n", snap.ClashErr))
+		_, _ = io.WriteString(w, buf.String())
+		return
+	}
+
+	up, down := "-", "-"
+	if last != nil && last.ClashErr == nil {
+		secs := snap.Time.Sub(last.Time).Seconds()
+		up = formatBytes(float64(snap.Upload-last.Upload)/secs) + "/s"
+		down = formatBytes(float64(snap.Download-last.Download)/secs) + "/s"
+	}
+	buf.WriteString(fmt.Sprintf("clash:   %d connections, up %s(total %s), down %s(total %s)\n\n",
+		snap.Connections, up, formatBytes(float64(snap.Upload)), down, formatBytes(float64(snap.Download))))
+
+	tw := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "GROUP\tTYPE\tNOW\tDELAY")
+	for _, g := range snap.Groups {
+		delay := "-"
+		if g.Delay > 0 {
+			delay = fmt.Sprintf("%dms", g.Delay)
+		} else if g.Delay == 0 {
+			delay = "timeout"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", g.Name, g.Type, g.Now, delay)
+	}
+	if err := tw.Flush(); err != nil {
+		logrus.Debugf("[top] failed to render: %v", err)
+	}
+
+	_, _ = io.WriteString(w, buf.String())
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
+func init() {
+	topCmd.PersistentFlags().DurationVar(&conf.TopInterval, "interval", 2*time.Second, "refresh interval")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// WatchTriggerFile notifies the returned chan when the trigger file(--reload-trigger-file) is
+// touched or written, a nil chan(never ready) is returned if the trigger file is not set.
+// The file is owned by the user, it is neither created nor removed by tpclash.
+func WatchTriggerFile(ctx context.Context) <-chan struct{} {
+	if conf.ReloadTriggerFile == "" {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fatalf(ExitConfigInvalid, "[trigger] failed to create fs watcher: %v", err)
+	}
+	// watch the dir, so that the file can be created(touch) after tpclash started
+	if err = watcher.Add(filepath.Dir(conf.ReloadTriggerFile)); err != nil {
+		fatalf(ExitConfigInvalid, "[trigger] failed add %s to fs watcher: %v", filepath.Dir(conf.ReloadTriggerFile), err)
+	}
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer func() { _ = watcher.Close() }()
+
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// touch on an existing file only changes its attributes(chmod event)
+				if event.Name != conf.ReloadTriggerFile || event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename) {
+					continue
+				}
+				timer.Reset(triggerFileDebounce)
+			case <-timer.C:
+				logrus.Infof("[trigger] reload triggered by %s", conf.ReloadTriggerFile)
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				if err != nil {
+					logrus.Errorf("[trigger] fs watcher error: %v", err)
+				}
+			}
+		}
+	}()
+
+	return ch
+}
+
+// mergeTriggers forwards the reload triggers of all sources to one chan, nil sources are ignored
+func mergeTriggers(ctx context.Context, sources ...<-chan struct{}) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	for _, src := range sources {
+		if src == nil {
+			continue
+		}
+		go func(src <-chan struct{}) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-src:
+					select {
+					case ch <- struct{}{}:
+					default:
+					}
+				}
+			}
+		}(src)
+	}
+	return ch
+}
@@ -55,6 +55,13 @@ var upgradeCmd = &cobra.Command{
 			logrus.Infof("[upgrade] upgrade to the latest version: v%s", target)
 		}
 
+		var verifyKey *minisignPublicKey
+		if conf.VerifyKey != "" {
+			if verifyKey, err = loadMinisignPublicKey(conf.VerifyKey); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+
 		currentPath, err := os.Executable()
 		if err != nil {
 			logrus.Fatalf("[upgrade] failed to get current executable file path: %v", err)
@@ -84,6 +91,14 @@ var upgradeCmd = &cobra.Command{
 			logrus.Fatalf("[upgrade] failed to write temp file: %v", err)
 		}
 
+		if verifyKey != nil {
+			if err = verifyUpgradeFile(verifyKey, tmpFile.Name(), downAddr+".minisig"); err != nil {
+				_ = os.Remove(tmpFile.Name())
+				logrus.Fatalf("[upgrade] %v, the current version is kept", err)
+			}
+			logrus.Info("[upgrade] signature verified")
+		}
+
 		if err = os.Rename(tmpFile.Name(), currentPath); err != nil {
 			logrus.Fatalf("[upgrade] rename failed: %v", err)
 		}
@@ -92,6 +107,30 @@ var upgradeCmd = &cobra.Command{
 	},
 }
 
+// verifyUpgradeFile checks the downloaded file against its minisign signature(--verify-key)
+func verifyUpgradeFile(pk *minisignPublicKey, name, sigAddr string) error {
+	logrus.Infof("[upgrade] start downloading signature: %s", sigAddr)
+	client := &http.Client{Timeout: upgradeSignatureTimeout}
+	resp, err := client.Get(sigAddr)
+	if err != nil {
+		return fmt.Errorf("failed to download signature: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download signature: %s", resp.Status)
+	}
+
+	sig, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %w", err)
+	}
+	bs, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return pk.Verify(bs, sig)
+}
+
 func init() {
 	upgradeCmd.PersistentFlags().BoolVar(&conf.UpgradeWithGhProxy, "with-ghproxy", true, "use ghproxy.com to download upgrade files")
 }
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// ValidateConfig is CheckConfig with a validation cache, an unchanged config skips
+// re-validation on restart. The cache is keyed by the config content, the validation
+// related flags and the core binary, so it is invalidated when the core is replaced.
+func ValidateConfig(c string) (*ClashConf, error) {
+	if conf.NoValidateCache || conf.InMemory {
+		return CheckConfig(c)
+	}
+
+	cachePath := filepath.Join(conf.ClashHome, validateCacheName)
+	key, err := validateCacheKey(c)
+	if err != nil {
+		logrus.Debugf("[validate] skip validation cache: %v", err)
+		return CheckConfig(c)
+	}
+
+	if bs, err := os.ReadFile(cachePath); err == nil && strings.TrimSpace(string(bs)) == key {
+		var cc ClashConf
+		if err = yaml.Unmarshal([]byte(c), &cc); err == nil {
+			logrus.Debug("[validate] config unchanged, validation cache hit")
+			return &cc, nil
+		}
+	}
+
+	cc, err := CheckConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if err = WriteFileAtomic(cachePath, []byte(key), 0644); err != nil {
+		logrus.Warnf("[validate] failed to write validation cache: %v", err)
+	}
+	return cc, nil
+}
+
+func validateCacheKey(c string) (string, error) {
+	info, err := os.Stat(filepath.Join(conf.ClashHome, InternalClashBinName))
+	if err != nil {
+		return "", fmt.Errorf("failed to stat clash binary: %w", err)
+	}
+
+	// every flag CheckConfig reads, a changed flag may reject an unchanged config
+	flags, err := json.Marshal(struct {
+		AllowStandardDNSPort bool
+		RoutePorts           []string
+		GroupDefaults        []string
+		GroupTestURLs        []string
+		GroupTestIntervals   []string
+	}{conf.AllowStandardDNSPort, conf.RoutePorts, conf.GroupDefaults, conf.GroupTestURLs, conf.GroupTestIntervals})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal validation flags: %w", err)
+	}
+
+	h := sha256.New()
+	_, _ = fmt.Fprintf(h, "%s\n%d\n%d\n", version, info.Size(), info.ModTime().UnixNano())
+	h.Write(flags)
+	h.Write([]byte{'\n'})
+	h.Write([]byte(c))
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyConfigWithCore tests the config with the clash core(-t), the core output is
+// returned in the error so that it can be reported to the user.
+func VerifyConfigWithCore(c string) error {
+	testPath := filepath.Join(conf.ClashHome, coreTestConfigName)
+	if conf.InMemory {
+		testPath = filepath.Join(inMemoryConfigDir(), fmt.Sprintf("tpclash-%d%s", os.Getpid(), coreTestConfigName))
+	}
+	return verifyConfigWithCore(filepath.Join(conf.ClashHome, InternalClashBinName), clashAssetDir(), testPath, c)
+}
+
+func verifyConfigWithCore(bin, assetDir, testPath, c string) error {
+	if err := WriteFileAtomic(testPath, []byte(c), 0600); err != nil {
+		return fmt.Errorf("[validate] failed to write test config: %w", err)
+	}
+	defer func() { _ = os.Remove(testPath) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, bin, "-t", "-d", assetDir, "-f", testPath)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("[validate] clash core rejected the config: %v: %s", err, strings.TrimSpace(out.String()))
+	}
+
+	return nil
+}
+
+var validateCmd = &cobra.Command{
+	Use:   "validate [FILENAME...]",
+	Short: "Validate clash config files(merge/auto fix/check/core test)",
+	Run: func(cmd *cobra.Command, args []string) {
+		if conf.PreCommit {
+			logrus.SetLevel(logrus.WarnLevel)
+		}
+
+		files := args
+		if len(files) == 0 && conf.ValidateStaged {
+			var err error
+			if files, err = stagedConfigFiles(); err != nil {
+				fatal(ExitGeneral, err)
+			}
+		}
+		if len(files) == 0 && !conf.ValidateStaged {
+			files = []string{conf.ClashConfig}
+		}
+
+		v, err := newValidator()
+		if err != nil {
+			fatal(ExitGeneral, err)
+		}
+		defer v.Close()
+
+		failed := 0
+		for _, name := range files {
+			problems := v.Validate(name)
+			for _, p := range problems {
+				if conf.PreCommit {
+					fmt.Println(p)
+				} else {
+					logrus.Error(p)
+				}
+			}
+			if len(problems) > 0 {
+				failed++
+			} else if !conf.PreCommit {
+				logrus.Infof("[validate] %s: ok", name)
+			}
+		}
+		if failed > 0 {
+			logrus.Exit(ExitConfigInvalid)
+		}
+	},
+}
+
+// stagedConfigFiles returns the staged(added/copied/modified) yaml files of the git index
+func stagedConfigFiles() ([]string, error) {
+	out, err := exec.Command("git", "diff", "--cached", "--name-only", "--diff-filter=ACM").Output()
+	if err != nil {
+		return nil, fmt.Errorf("[validate] failed to list staged files: %w", err)
+	}
+
+	var files []string
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if ext := filepath.Ext(name); ext == ".yaml" || ext == ".yml" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// validator runs the full config pipeline, the core test uses the clash binary in the
+// clash home, or the embedded one if it is not extracted yet.
+type validator struct {
+	bin      string
+	assetDir string
+	tmpDir   string
+}
+
+func newValidator() (*validator, error) {
+	tmpDir, err := os.MkdirTemp("", "tpclash-validate")
+	if err != nil {
+		return nil, fmt.Errorf("[validate] failed to create temp dir: %w", err)
+	}
+	v := &validator{bin: filepath.Join(conf.ClashHome, InternalClashBinName), assetDir: clashAssetDir(), tmpDir: tmpDir}
+	if _, err = os.Stat(v.bin); err == nil {
+		return v, nil
+	}
+
+	v.bin, v.assetDir = filepath.Join(tmpDir, InternalClashBinName), tmpDir
+	for _, name := range append([]string{InternalClashBinName}, geoAssets...) {
+		bs, err := static.ReadFile(filepath.Join("static", name))
+		if err != nil {
+			continue
+		}
+		if err = os.WriteFile(filepath.Join(tmpDir, name), bs, 0755); err != nil {
+			v.Close()
+			return nil, fmt.Errorf("[validate] failed to extract %s: %w", name, err)
+		}
+	}
+	return v, nil
+}
+
+func (v *validator) Close() {
+	_ = os.RemoveAll(v.tmpDir)
+}
+
+// Validate returns the problems of the config file as "file:line: message"
+func (v *validator) Validate(name string) []string {
+	var bs []byte
+	var err error
+	if conf.ValidateStaged {
+		bs, err = exec.Command("git", "show", ":"+name).Output()
+	} else {
+		bs, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return []string{fmt.Sprintf("%s: failed to read config: %v", name, err)}
+	}
+	if conf.ConfigEncPassword != "" {
+		if bs, err = Decrypt(bs, conf.ConfigEncPassword); err != nil {
+			return []string{fmt.Sprintf("%s: failed to decrypt config: %v", name, err)}
+		}
+	}
+	c := string(bs)
+
+	problem := func(err error) []string {
+		return []string{fmt.Sprintf("%s:%d: %s", name, errorLine(c, err), trimComponent(err.Error()))}
+	}
+
+	var node yaml.Node
+	if err = yaml.Unmarshal(bs, &node); err != nil {
+		return problem(err)
+	}
+
+	fixed, err := autoFix(c)
+	if err != nil {
+		return problem(err)
+	}
+	if err = checkAutoFixIdempotent(fixed); err != nil {
+		return []string{fmt.Sprintf("%s:0: %s", name, strings.ReplaceAll(trimComponent(err.Error()), "\n", " "))}
+	}
+	cc, err := CheckConfig(fixed)
+	if err != nil {
+		return problem(err)
+	}
+	if err = verifyConfigWithCore(v.bin, v.assetDir, filepath.Join(v.tmpDir, coreTestConfigName), fixed); err != nil {
+		return []string{fmt.Sprintf("%s:0: %s", name, strings.ReplaceAll(trimComponent(err.Error()), "\n", " "))}
+	}
+
+	// a server that does not resolve only breaks its proxy, it is not a config error
+	if !conf.ValidateNoResolve {
+		for _, f := range UnresolvedServers(cc) {
+			logrus.Warnf("%s:%d: proxy server does not resolve: %s", name, proxyLine(&node, f.Proxy), f)
+		}
+	}
+
+	return nil
+}
+
+var (
+	yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+	configKeyPath = regexp.MustCompile(`\(([a-z][a-z0-9-]*(?:\.[a-z][a-z0-9-]*)*)\)`)
+)
+
+// errorLine finds the line the error refers to, either from a yaml error or from the
+// config key path(e.g. "(dns.listen)") in the error, 0 if unknown
+func errorLine(c string, err error) int {
+	if m := yamlErrorLine.FindStringSubmatch(err.Error()); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+
+	m := configKeyPath.FindStringSubmatch(err.Error())
+	if m == nil {
+		return 0
+	}
+	var node yaml.Node
+	if yaml.Unmarshal([]byte(c), &node) != nil || len(node.Content) == 0 {
+		return 0
+	}
+
+	line, cur := 0, node.Content[0]
+	for _, key := range strings.Split(m[1], ".") {
+		next := yamlMapValue(cur, key)
+		if next == nil {
+			break
+		}
+		for i := 0; i+1 < len(cur.Content); i += 2 {
+			if cur.Content[i+1] == next {
+				line = cur.Content[i].Line
+			}
+		}
+		cur = next
+	}
+	return line
+}
+
+// proxyLine returns the line of the proxy in the config, 0 if it is not defined there
+func proxyLine(root *yaml.Node, name string) int {
+	if len(root.Content) == 0 {
+		return 0
+	}
+	proxies := yamlMapValue(root.Content[0], "proxies")
+	if proxies == nil {
+		return 0
+	}
+	for _, p := range proxies.Content {
+		if n := yamlMapValue(p, "name"); n != nil && n.Value == name {
+			return p.Line
+		}
+	}
+	return 0
+}
+
+// trimComponent removes the "[component] " prefix of tpclash errors
+func trimComponent(s string) string {
+	if strings.HasPrefix(s, "[") {
+		if i := strings.Index(s, "] "); i > 0 {
+			return s[i+2:]
+		}
+	}
+	return s
+}
+
+func init() {
+	validateCmd.PersistentFlags().BoolVar(&conf.PreCommit, "pre-commit", false, "terse file:line output for git hooks")
+	validateCmd.PersistentFlags().BoolVar(&conf.ValidateStaged, "staged", false, "validate the staged version of the files(all staged yaml files if none given)")
+	validateCmd.PersistentFlags().BoolVar(&conf.ValidateNoResolve, "no-resolve", false, "do not warn about proxy servers that do not resolve")
+}
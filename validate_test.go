@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const validateTestConfig = `
+interface-name: eth0
+tun:
+  enable: true
+  auto-route: true
+dns:
+  listen: 0.0.0.0:1053
+  enhanced-mode: fake-ip
+  fake-ip-range: 198.18.0.1/16
+proxy-groups:
+  - name: Proxy
+    type: select
+    proxies: [a]
+  - name: Auto
+    type: url-test
+    proxies: [a]
+`
+
+func TestValidateCacheFlags(t *testing.T) {
+	old := conf
+	t.Cleanup(func() { conf = old })
+	conf.ClashHome, conf.NoValidateCache, conf.InMemory = t.TempDir(), false, false
+	conf.AllowStandardDNSPort, conf.RoutePorts = false, nil
+	conf.GroupDefaults, conf.GroupTestURLs, conf.GroupTestIntervals = nil, nil, nil
+	if err := os.WriteFile(filepath.Join(conf.ClashHome, InternalClashBinName), []byte("clash"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := validateCacheKey(validateTestConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ValidateConfig(validateTestConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		set  func()
+	}{
+		{"group-default", func() { conf.GroupDefaults = []string{"Proxy=missing"} }},
+		{"group-test-url", func() { conf.GroupTestURLs = []string{"Proxy=http://example.com"} }},
+		{"group-test-interval", func() { conf.GroupTestIntervals = []string{"Proxy=5m"} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf.GroupDefaults, conf.GroupTestURLs, conf.GroupTestIntervals = nil, nil, nil
+			tt.set()
+			key, err := validateCacheKey(validateTestConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key == base {
+				t.Fatal("expected the flag to change the validation cache key")
+			}
+			// the cached key of the valid config must not let the rejected flag through
+			if _, err = ValidateConfig(validateTestConfig); err == nil {
+				t.Fatal("expected a cache miss and a validation error")
+			}
+		})
+	}
+}